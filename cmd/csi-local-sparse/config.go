@@ -16,6 +16,16 @@ limitations under the License.
 
 package main
 
+import (
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
 // Config application config
 type Config struct {
 	// LogLevel log level
@@ -24,12 +34,439 @@ type Config struct {
 	LogJSON bool `long:"log-json" description:"Enable force log format JSON" env:"LOG_JSON"`
 	// GrpcSocket grpc listening socket
 	GrpcSocket string `long:"grpc-listen-socket" description:"Listening socket of grpc-server (only unix socket supported)" env:"GRPC_LISTEN_SOCKET" required:"true"`
+	// SocketMode permissions of grpc unix socket
+	SocketMode string `long:"socket-mode" description:"Octal permissions set on grpc unix socket after it's created, e.g. 0600. Umask default if empty" env:"SOCKET_MODE"`
+	// SocketOwner ownership of grpc unix socket
+	SocketOwner string `long:"socket-owner" description:"Owner set on grpc unix socket after it's created as uid:gid, uid or :gid. Unchanged if empty" env:"SOCKET_OWNER"`
+	// LimitOnlyDefaultSize provision default size capped by limit when only limit bytes requested
+	LimitOnlyDefaultSize bool `long:"limit-only-default-size" description:"When capacity range has only limit bytes, provision default size (capped by the limit) instead of the limit" env:"LIMIT_ONLY_DEFAULT_SIZE"`
+	// RequireExplicitSize fail volume create when capacity range has neither required nor limit bytes
+	RequireExplicitSize bool `long:"require-explicit-size" description:"Fail volume create when capacity range has neither required nor limit bytes instead of provision default size" env:"REQUIRE_EXPLICIT_SIZE"`
+	// EnableNbdExport serve /export endpoint on metrics server exporting volume images over nbd
+	EnableNbdExport bool `long:"enable-nbd-export" description:"Serve /export admin endpoint on metrics server exporting volume images read-only over nbd with qemu-nbd, requires admin-token-file" env:"ENABLE_NBD_EXPORT"`
+	// NbdExportAddress listening address of nbd servers
+	NbdExportAddress string `long:"nbd-export-address" description:"Listening address of nbd servers, exports have no authentication, so only local clients can connect by default" env:"NBD_EXPORT_ADDRESS" default:"127.0.0.1"`
+	// NbdExportPort first port of nbd servers
+	NbdExportPort int `long:"nbd-export-port" description:"First port of nbd servers, each exported volume takes its own port" env:"NBD_EXPORT_PORT" default:"10809"`
+	// NbdExportMaxCount maximum count of simultaneously exported volumes
+	NbdExportMaxCount int `long:"nbd-export-max-count" description:"Maximum count of simultaneously exported volumes" env:"NBD_EXPORT_MAX_COUNT" default:"8"`
+	// MountDirMode permissions of created mount target directories
+	MountDirMode string `long:"mount-dir-mode" description:"Octal permissions of created staging and publish target directories" env:"MOUNT_DIR_MODE" default:"0750"`
+	// FindMntTimeout timeout of findmnt mount lookups
+	FindMntTimeout time.Duration `long:"findmnt-timeout" description:"Timeout of findmnt mount lookups independent of request deadline, disabled if 0" env:"FINDMNT_TIMEOUT" default:"10s"`
+	// LoopAutoclear set autoclear flag of staged loop devices
+	LoopAutoclear bool `long:"loop-autoclear" description:"Set autoclear flag of loop device after it's mounted on stage, so kernel detaches it once the last mount is gone, even if plugin crashed before unstage. Mount-loop devices always have it" env:"LOOP_AUTOCLEAR"`
+	// FsckOnStage check and repair filesystem which wasn't cleanly unmounted on stage
+	FsckOnStage bool `long:"fsck-on-stage" description:"Check ext filesystem with e2fsck preen before mount on stage, escalating to full check if preen gives up. Cleanly unmounted filesystems are skipped" env:"FSCK_ON_STAGE"`
+	// UnmountRetries count of plain unmount attempts
+	UnmountRetries int `long:"unmount-retries" description:"Count of plain unmount attempts of unpublish and unstage, busy targets are often released in a moment" env:"UNMOUNT_RETRIES" default:"3"`
+	// UnmountRetryBackoff delay before unmount retry
+	UnmountRetryBackoff time.Duration `long:"unmount-retry-backoff" description:"Delay before second plain unmount attempt, doubled after each next failure" env:"UNMOUNT_RETRY_BACKOFF" default:"500ms"`
+	// LazyUnmount lazily unmount target after plain unmount attempts
+	LazyUnmount bool `long:"lazy-unmount" description:"Lazily unmount target with umount -l once plain unmount attempts are exhausted, so busy target is detached when it's released" env:"LAZY_UNMOUNT"`
+	// RemountReadOnlyRecovery remount read-write volume filesystem which became read-only
+	RemountReadOnlyRecovery bool `long:"remount-read-only-recovery" description:"Remount read-write volume filesystem which became read-only because of io errors, if read-only e2fsck check of its device is clean" env:"REMOUNT_READ_ONLY_RECOVERY"`
+	// ExpandOverProvisionRatio maximum ratio of logical sizes sum of pool volumes after expand to pool storage size
+	ExpandOverProvisionRatio float64 `long:"expand-overprovision-ratio" description:"Warn on NodeExpandVolume when sum of logical sizes of pool volumes after expand exceeds pool storage size multiplied by given ratio, disabled if 0" env:"EXPAND_OVERPROVISION_RATIO"`
+	// ExpandOverProvisionFail reject expand exceeding over-provision ratio
+	ExpandOverProvisionFail bool `long:"expand-overprovision-fail" description:"Reject NodeExpandVolume exceeding expand-overprovision-ratio with OUT_OF_RANGE instead of only warning" env:"EXPAND_OVERPROVISION_FAIL"`
+	// RateLimit maximum rate of mutating rpc calls per second
+	RateLimit float64 `long:"rate-limit" description:"Maximum rate of mutating rpc calls per second, exceeding calls are rejected with RESOURCE_EXHAUSTED. Probes, capabilities, stats and listing are never limited. Disabled if 0" env:"RATE_LIMIT"`
+	// RateLimitBurst maximum count of mutating rpc calls above rate limit at once
+	RateLimitBurst int `long:"rate-limit-burst" description:"Maximum count of mutating rpc calls accepted at once above rate-limit" env:"RATE_LIMIT_BURST" default:"10"`
+	// LoopDevicesWarningThreshold used to total loop devices ratio to warn about
+	LoopDevicesWarningThreshold float64 `long:"loop-devices-warning-threshold" description:"Warn on pool accounting when used to total loop devices ratio exceeds given value, disabled if 0. Total is max_loop parameter of loop module or count of existing loop devices if they are created on demand" env:"LOOP_DEVICES_WARNING_THRESHOLD" default:"0.9"`
+	// LoopDevicesProbeFail report not ready in Probe while loop devices usage exceeds warning threshold
+	LoopDevicesProbeFail bool `long:"loop-devices-probe-fail" description:"Report plugin not ready in Probe while loop devices usage exceeds loop-devices-warning-threshold" env:"LOOP_DEVICES_PROBE_FAIL"`
+	// MaxVolumesPerNode maximum count of volumes on node
+	MaxVolumesPerNode int `long:"max-volumes-per-node" description:"Maximum count of volumes on node, advertised to CO and enforced on CreateVolume with RESOURCE_EXHAUSTED" env:"MAX_VOLUMES_PER_NODE" default:"200"`
+	// VolumeContextKeys create parameters propagated to volume context
+	VolumeContextKeys []string `long:"volume-context-key" description:"Create parameter key persisted with volume and returned in its volume context, so it reaches node calls, e.g. csi.storage.k8s.io/pvc/name. Repeatable" env:"VOLUME_CONTEXT_KEYS" env-delim:","`
+	// ListVolumesWorkers count of parallel volume stat calls of ListVolumes
+	ListVolumesWorkers int `long:"list-volumes-workers" description:"Count of parallel volume stat calls of ListVolumes" env:"LIST_VOLUMES_WORKERS" default:"8"`
+	// OrphanGCInterval interval of orphan volumes lookup
+	OrphanGCInterval time.Duration `long:"orphan-gc-interval" description:"Interval of looking for volume images absent from orphan-gc-known-volumes-file, disabled if 0" env:"ORPHAN_GC_INTERVAL"`
+	// OrphanGCKnownVolumesFile file with volume ids known to CO
+	OrphanGCKnownVolumesFile string `long:"orphan-gc-known-volumes-file" description:"File with volume ids known to CO, one per line, written by external tooling. Images created after the file was written are never collected" env:"ORPHAN_GC_KNOWN_VOLUMES_FILE"`
+	// OrphanGCMinAge minimum age of orphan volume image
+	OrphanGCMinAge time.Duration `long:"orphan-gc-min-age" description:"Minimum time since last modification of orphan volume image" env:"ORPHAN_GC_MIN_AGE" default:"24h"`
+	// OrphanGCDelete delete orphan volumes
+	OrphanGCDelete bool `long:"orphan-gc-delete" description:"Delete orphan volumes which are not staged or attached instead of only logging them" env:"ORPHAN_GC_DELETE"`
+	// ReconcileMountsInterval interval of mounts reconciliation
+	ReconcileMountsInterval time.Duration `long:"reconcile-mounts-interval" description:"Interval of looking for mounts under kubelet dir of loop devices bound to deleted volume images and attached volumes without mounts, also done on start. Disabled if 0" env:"RECONCILE_MOUNTS_INTERVAL"`
+	// ReconcileMountsCleanup clean orphaned mounts up
+	ReconcileMountsCleanup bool `long:"reconcile-mounts-cleanup" description:"Unmount orphaned mounts and detach their loop devices instead of only logging them" env:"RECONCILE_MOUNTS_CLEANUP"`
+	// KubeletDir kubelet root dir
+	KubeletDir string `long:"kubelet-dir" description:"Kubelet root dir as seen by plugin, where mounts are reconciled" env:"KUBELET_DIR" default:"/var/lib/kubelet"`
+	// PoolAccountingInterval interval of volumes disk usage accounting
+	PoolAccountingInterval time.Duration `long:"pool-accounting-interval" description:"Interval of summing logical and allocated sizes of all volume images for metrics, disabled if 0" env:"POOL_ACCOUNTING_INTERVAL" default:"1m"`
+	// Maintenance start in maintenance mode
+	Maintenance bool `long:"maintenance" description:"Start in maintenance mode: reject new volumes and stages, but allow teardown. Toggled by SIGUSR1" env:"MAINTENANCE"`
+	// AdminTokenFile file with bearer token of admin endpoints
+	AdminTokenFile string `long:"admin-token-file" description:"File with bearer token of /force-cleanup, /compact and /export admin endpoints on metrics server, disabled if empty" env:"ADMIN_TOKEN_FILE"`
+	// EnableReflection register grpc server reflection and health services
+	EnableReflection bool `long:"enable-reflection" description:"Register grpc server reflection and grpc.health.v1 health services on plugin socket for debugging with grpcurl" env:"ENABLE_REFLECTION"`
+	// OperationTimeout maximum duration of rpc call
+	OperationTimeout time.Duration `long:"operation-timeout" description:"Maximum duration of rpc call, applied when CO sends no or later deadline, so hung external commands are killed. Disabled if 0" env:"OPERATION_TIMEOUT"`
+	// FormatTimeout maximum duration of volume image creation and format
+	FormatTimeout time.Duration `long:"format-timeout" description:"Maximum duration of volume image creation (preallocation, template copy) and format within rpc call, operation timeout still applies. Disabled if 0" env:"FORMAT_TIMEOUT"`
+	// ResizeTimeout maximum duration of volume expand
+	ResizeTimeout time.Duration `long:"resize-timeout" description:"Maximum duration of volume image and filesystem expand within rpc call, operation timeout still applies. Disabled if 0" env:"RESIZE_TIMEOUT"`
+	// AttachTimeout maximum duration of loop device attach and detach
+	AttachTimeout time.Duration `long:"attach-timeout" description:"Maximum duration of loop device attach and detach within rpc call, operation timeout still applies. Disabled if 0" env:"ATTACH_TIMEOUT"`
+	// TempDir directory of temporary files and mount points
+	TempDir string `long:"temp-dir" description:"Writable directory of temporary mount points, e.g. of volume compaction, also passed to external commands as TMPDIR. Allows read-only root filesystem of plugin container. $TMPDIR or /tmp if empty" env:"TEMP_DIR"`
+	// ReadyFile file signaling plugin readiness
+	ReadyFile string `long:"ready-file" description:"File created once grpc server is listening and storage self-check passed, removed on shutdown. Disabled if empty" env:"READY_FILE"`
+	// GrpcMaxRecvMsgSize maximum size of received grpc message
+	GrpcMaxRecvMsgSize int `long:"grpc-max-recv-msg-size" description:"Maximum size of received grpc message in bytes, grpc default (4MiB) if 0" env:"GRPC_MAX_RECV_MSG_SIZE"`
+	// GrpcMaxSendMsgSize maximum size of sent grpc message
+	GrpcMaxSendMsgSize int `long:"grpc-max-send-msg-size" description:"Maximum size of sent grpc message in bytes, grpc default if 0" env:"GRPC_MAX_SEND_MSG_SIZE"`
+	// GrpcKeepaliveTime interval of server pings of idle connections
+	GrpcKeepaliveTime time.Duration `long:"grpc-keepalive-time" description:"Interval of server pings of idle grpc connections, grpc default if 0" env:"GRPC_KEEPALIVE_TIME"`
+	// GrpcKeepaliveTimeout wait time for ping ack before closing connection
+	GrpcKeepaliveTimeout time.Duration `long:"grpc-keepalive-timeout" description:"Wait time for ping ack before closing grpc connection, grpc default if 0" env:"GRPC_KEEPALIVE_TIMEOUT"`
+	// GrpcKeepaliveMinTime minimum interval of client pings
+	GrpcKeepaliveMinTime time.Duration `long:"grpc-keepalive-min-time" description:"Minimum allowed interval of client pings, grpc default if 0" env:"GRPC_KEEPALIVE_MIN_TIME"`
+	// GrpcKeepalivePermitWithoutStream allow client pings without active streams
+	GrpcKeepalivePermitWithoutStream bool `long:"grpc-keepalive-permit-without-stream" description:"Allow client pings when there are no active grpc streams" env:"GRPC_KEEPALIVE_PERMIT_WITHOUT_STREAM"`
 	// ImagesDir Path where sparse files will be store (must be existed)
 	ImagesDir string `long:"images-dir" description:"Path where sparse files will be store (must be existed)" env:"IMAGES_DIR" required:"true"`
+	// SkipImagesDirCheck don't check images dir on start
+	SkipImagesDirCheck bool `long:"skip-images-dir-check" description:"Don't check images dirs exist and are writable on start, for controller deployment without images dir" env:"SKIP_IMAGES_DIR_CHECK"`
+	// ImagesDirMode permissions enforced on images dirs on start
+	ImagesDirMode string `long:"images-dir-mode" description:"Octal permissions set on images dirs on start, e.g. 0700. Unchanged if empty" env:"IMAGES_DIR_MODE"`
+	// ImagesDirOwner ownership enforced on images dirs on start
+	ImagesDirOwner string `long:"images-dir-owner" description:"Owner set on images dirs on start as uid:gid, uid or :gid. Unchanged if empty" env:"IMAGES_DIR_OWNER"`
+	// TemplatesDir directory of volume template images
+	TemplatesDir string `long:"templates-dir" description:"Directory of volume template images <name>.<image-extension> selected with reinstall.ru/template storage class parameter, <images-dir>/templates if empty" env:"TEMPLATES_DIR"`
+	// NoSyncOnCreate skip fsync of created image and images dir
+	NoSyncOnCreate bool `long:"no-sync-on-create" description:"Skip fsync of created volume image and images dir. By default created image survives power loss right after CreateVolume" env:"NO_SYNC_ON_CREATE"`
+	// PunchHolesOnDelete deallocate all blocks of volume image before removing it
+	PunchHolesOnDelete bool `long:"punch-holes-on-delete" description:"Deallocate all blocks of volume image with fallocate --punch-hole before removing it, so space is freed on copy-on-write and deduplicating filesystems where snapshots share image extents" env:"PUNCH_HOLES_ON_DELETE"`
+	// Preallocate allocate all blocks of created volume images
+	Preallocate bool `long:"preallocate" description:"Allocate all blocks of created volume image with fallocate instead of leaving it sparse, so volume never hits ENOSPC of node storage. Space added by expand stays sparse" env:"PREALLOCATE"`
+	// DetachSingle detach only the loop device of volume instead of all loop devices bound to its image
+	DetachSingle bool `long:"detach-single" description:"Detach only the loop device resolved for volume instead of all loop devices bound to its image, keeping devices bound to the image by hand" env:"DETACH_SINGLE"`
+	// ScanBusyDeviceHolders log processes holding busy loop device open
+	ScanBusyDeviceHolders bool `long:"scan-busy-device-holders" description:"Scan /proc/*/fd for processes holding loop device open when detach fails because device is busy, and log them" env:"SCAN_BUSY_DEVICE_HOLDERS"`
+	// Pools additional named images dirs
+	Pools []string `long:"pool" description:"Additional named storage pool as name=/path, selected with reinstall.ru/pool storage class parameter. Repeatable" env:"POOLS" env-delim:","`
+	// ImageExtension volume image file extension
+	ImageExtension string `long:"image-extension" description:"Volume image file extension without dot" env:"IMAGE_EXTENSION" default:"img"`
+	// ImagePrefix volume image file name prefix
+	ImagePrefix string `long:"image-prefix" description:"Volume image file name prefix" env:"IMAGE_PREFIX"`
 	// NodeId Identifier of node where this instance is running
 	NodeId string `long:"node" description:"Identifier of node where this instance is running" env:"NODE_ID" required:"true"`
 	// NodeNameTopologyKey kubernetes node label, that will be used for accessible topology
 	NodeNameTopologyKey string `long:"node-name-topology-key" description:"Kubernetes node label, that will be used for accessible topology" env:"NODE_NAME_TOPOLOGY_KEY" required:"true"`
 	// UseDirectIO
 	UseDirectIO bool `long:"direct-io" description:"Use direct-io on loop devices" env:"DIRECT_IO"`
+	// IOCgroup cgroup v2 directory where per volume io limits are applied
+	IOCgroup string `long:"io-cgroup" description:"Cgroup v2 directory where per volume io limits (io.max) are applied, e.g. /sys/fs/cgroup/kubepods.slice. Disabled if empty" env:"IO_CGROUP"`
+	// NameLinks create human-friendly symlinks to volume images
+	NameLinks bool `long:"name-links" description:"Create <images-dir>/by-name/<pvc-namespace>-<pvc-name> symlinks to volume images" env:"NAME_LINKS"`
+	// FormatJitter maximum random delay before mkfs
+	FormatJitter time.Duration `long:"format-jitter" description:"Wait random time up to given duration before mkfs of volume, spreading disk load when many volumes are staged at once, e.g. on StatefulSet scale up. Disabled if 0" env:"FORMAT_JITTER"`
+	// MkfsNice niceness of mkfs and resize commands
+	MkfsNice int `long:"mkfs-nice" description:"Run mkfs and resize commands with given niceness (-20..19), unchanged if 0" env:"MKFS_NICE"`
+	// MkfsIoniceClass io scheduling class of mkfs and resize commands
+	MkfsIoniceClass int `long:"mkfs-ionice-class" description:"Run mkfs and resize commands with given io scheduling class: 1 - realtime, 2 - best-effort, 3 - idle, unchanged if 0" env:"MKFS_IONICE_CLASS" choice:"0" choice:"1" choice:"2" choice:"3"`
+	// EnableAttach advertise controller publish/unpublish capability
+	EnableAttach bool `long:"enable-attach" description:"Advertise PUBLISH_UNPUBLISH_VOLUME controller capability for setups expecting external-attacher" env:"ENABLE_ATTACH"`
+	// FakeVolumesCapacity use in-memory volume controller and mounter with given capacity, for testing only
+	FakeVolumesCapacity int64 `long:"fake-volumes-capacity" description:"Testing only. Use in-memory volume controller and mounter with given capacity in bytes instead of images and loop devices, e.g. for csi-sanity. Disabled if 0" env:"FAKE_VOLUMES_CAPACITY"`
+	// MetricsListen metrics http server listening address
+	MetricsListen string `long:"metrics-listen" description:"Listening address of metrics http server, e.g. :9810. Disabled if empty" env:"METRICS_LISTEN"`
+	// EnableDebugEndpoints serve read-only debug endpoints on metrics server
+	EnableDebugEndpoints bool `long:"enable-debug-endpoints" description:"Serve read-only /volumes and /pool debug endpoints on metrics server" env:"ENABLE_DEBUG_ENDPOINTS"`
+	// UsageWarningThreshold used to total bytes ratio of volume to warn about
+	UsageWarningThreshold float64 `long:"usage-warning-threshold" description:"Warn when used to total bytes ratio of mounted volume exceeds given value, disabled if 0" env:"USAGE_WARNING_THRESHOLD" default:"0.9"`
+	// UsageCheckInterval interval of staged volumes usage sampling
+	UsageCheckInterval time.Duration `long:"usage-check-interval" description:"Interval of staged volumes usage sampling, disabled if 0" env:"USAGE_CHECK_INTERVAL" default:"1m"`
+	// MountLoop mount volume images with "mount -o loop"
+	MountLoop bool `long:"mount-loop" description:"Mount volume images with \"mount -o loop\" and let kernel allocate loop device instead of explicit losetup, for kernels without /dev/loop-control" env:"MOUNT_LOOP"`
+	// FsLabel set filesystem label to volume id on format
+	FsLabel bool `long:"fs-label" description:"Set filesystem label to volume id (truncated to 16 characters) on format" env:"FS_LABEL"`
+	// FsUUID set filesystem UUID derived from volume id on format
+	FsUUID bool `long:"fs-uuid" description:"Set filesystem UUID derived from volume id on format and verify it on attached device before stage mount" env:"FS_UUID"`
+	// FsMaxMountCount maximum mount count between ext filesystem checks
+	FsMaxMountCount int `long:"fs-max-mount-count" description:"Maximum mount count between ext filesystem checks set with tune2fs -c on format and stage of detached volume, 0 disables count based checks, which can stall stage with fsck of old volume. Unchanged if negative" env:"FS_MAX_MOUNT_COUNT" default:"-1"`
+	// FsCheckIntervalDays maximum days between ext filesystem checks
+	FsCheckIntervalDays int `long:"fs-check-interval-days" description:"Maximum days between ext filesystem checks set with tune2fs -i on format and stage of detached volume, 0 disables time based checks. Unchanged if negative" env:"FS_CHECK_INTERVAL_DAYS" default:"-1"`
+	// FsReservedBlocksPercent percentage of filesystem blocks reserved for root on format
+	FsReservedBlocksPercent int `long:"fs-reserved-blocks-percent" description:"Percentage of ext4 blocks reserved for root on format (mkfs -m), e.g. 0 or 1 to give volume owners nearly all requested capacity. Already formatted volumes are unchanged. Mkfs default (5) if negative" env:"FS_RESERVED_BLOCKS_PERCENT" default:"-1"`
+	// AuditLogFile volume lifecycle events log file
+	AuditLogFile string `long:"audit-log-file" description:"Path of volume lifecycle events log file, disabled if empty" env:"AUDIT_LOG_FILE"`
+	// AuditLogFormat volume lifecycle events log format
+	AuditLogFormat string `long:"audit-log-format" description:"Format of volume lifecycle events log" env:"AUDIT_LOG_FORMAT" choice:"json" choice:"text" default:"json"`
+	// LoopReadAheadKB read-ahead of loop devices
+	LoopReadAheadKB uint64 `long:"loop-read-ahead-kb" description:"Read-ahead of loop devices in kilobytes, set after stage. Overridden by reinstall.ru/read-ahead-kb storage class parameter. Kernel default if 0" env:"LOOP_READ_AHEAD_KB"`
+	// LoopScheduler io scheduler of loop devices
+	LoopScheduler string `long:"loop-scheduler" description:"IO scheduler of loop devices, e.g. none or mq-deadline, set after stage. Overridden by reinstall.ru/scheduler storage class parameter. Kernel default if empty" env:"LOOP_SCHEDULER"`
+	// LoopSectorSize logical sector size of loop devices of newly formatted volumes
+	LoopSectorSize int `long:"loop-sector-size" description:"Logical sector size of loop devices of newly formatted volumes: 512 or 4096. Already formatted volumes keep their sector size. Losetup default if 0" env:"LOOP_SECTOR_SIZE"`
+}
+
+// Validate checks config values which can't be checked by flags parser
+func (c *Config) Validate() error {
+	if c.LoopSectorSize != 0 && c.LoopSectorSize != 512 && c.LoopSectorSize != 4096 {
+		return fmt.Errorf("loop-sector-size must be 512 or 4096, but %d given", c.LoopSectorSize)
+	}
+
+	if err := c.DeviceTuning().Validate(); err != nil {
+		return fmt.Errorf("loop-scheduler: %w", err)
+	}
+
+	if c.FsReservedBlocksPercent > volumes.MaxReservedBlocksPercent {
+		return fmt.Errorf("fs-reserved-blocks-percent must not exceed %d, but %d given", volumes.MaxReservedBlocksPercent, c.FsReservedBlocksPercent)
+	}
+
+	if _, err := c.ParsePools(); err != nil {
+		return err
+	}
+
+	if _, err := c.ParseMountDirMode(); err != nil {
+		return err
+	}
+
+	if _, err := c.ParseImagesDirOptions(); err != nil {
+		return err
+	}
+
+	if _, _, _, err := c.ParseSocketOptions(); err != nil {
+		return err
+	}
+
+	if c.TempDir != "" && !filepath.IsAbs(c.TempDir) {
+		return fmt.Errorf("temp-dir must be absolute path, but %q given", c.TempDir)
+	}
+
+	// operation class timeouts are layered under operation timeout, so a longer one would never expire
+	for flag, timeout := range map[string]time.Duration{
+		"format-timeout": c.FormatTimeout,
+		"resize-timeout": c.ResizeTimeout,
+		"attach-timeout": c.AttachTimeout,
+	} {
+		if timeout < 0 {
+			return fmt.Errorf("%s must not be negative, but %s given", flag, timeout)
+		}
+		if c.OperationTimeout > 0 && timeout > c.OperationTimeout {
+			return fmt.Errorf("%s (%s) must not exceed operation-timeout (%s)", flag, timeout, c.OperationTimeout)
+		}
+	}
+
+	if c.ReconcileMountsCleanup && c.ReconcileMountsInterval <= 0 {
+		return fmt.Errorf("reconcile-mounts-cleanup requires reconcile-mounts-interval")
+	}
+
+	if c.ReconcileMountsInterval > 0 && !filepath.IsAbs(c.KubeletDir) {
+		return fmt.Errorf("kubelet-dir must be absolute path, but %q given", c.KubeletDir)
+	}
+
+	if c.OrphanGCInterval > 0 && c.OrphanGCKnownVolumesFile == "" {
+		return fmt.Errorf("orphan-gc-interval requires orphan-gc-known-volumes-file")
+	}
+
+	if c.ExpandOverProvisionRatio < 0 {
+		return fmt.Errorf("expand-overprovision-ratio must not be negative, but %v given", c.ExpandOverProvisionRatio)
+	}
+
+	if c.ExpandOverProvisionFail && c.ExpandOverProvisionRatio == 0 {
+		return fmt.Errorf("expand-overprovision-fail requires expand-overprovision-ratio")
+	}
+
+	if c.LoopDevicesWarningThreshold < 0 || c.LoopDevicesWarningThreshold > 1 {
+		return fmt.Errorf("loop-devices-warning-threshold must be from 0 to 1, but %v given", c.LoopDevicesWarningThreshold)
+	}
+
+	if c.LoopDevicesProbeFail && (c.LoopDevicesWarningThreshold == 0 || c.PoolAccountingInterval == 0) {
+		return fmt.Errorf("loop-devices-probe-fail requires loop-devices-warning-threshold and pool-accounting-interval")
+	}
+
+	if c.FormatJitter < 0 {
+		return fmt.Errorf("format-jitter must not be negative, but %v given", c.FormatJitter)
+	}
+
+	if c.MaxVolumesPerNode < 1 {
+		return fmt.Errorf("max-volumes-per-node must be at least 1, but %d given", c.MaxVolumesPerNode)
+	}
+
+	if c.RateLimit < 0 {
+		return fmt.Errorf("rate-limit must not be negative, but %v given", c.RateLimit)
+	}
+
+	if c.RateLimit > 0 && c.RateLimitBurst < 1 {
+		return fmt.Errorf("rate-limit-burst must be at least 1, but %d given", c.RateLimitBurst)
+	}
+
+	if c.UnmountRetries < 1 {
+		return fmt.Errorf("unmount-retries must be at least 1, but %d given", c.UnmountRetries)
+	}
+
+	if c.UnmountRetryBackoff < 0 {
+		return fmt.Errorf("unmount-retry-backoff must not be negative, but %v given", c.UnmountRetryBackoff)
+	}
+
+	if c.FsckOnStage && c.MountLoop {
+		return fmt.Errorf("fsck-on-stage is not supported with mount-loop")
+	}
+
+	if c.AdminTokenFile != "" && c.MetricsListen == "" {
+		return fmt.Errorf("admin-token-file requires metrics-listen")
+	}
+
+	if c.EnableNbdExport && c.AdminTokenFile == "" {
+		return fmt.Errorf("enable-nbd-export requires admin-token-file")
+	}
+
+	// metadata files are stored next to images as <volumeId>.json
+	if c.ImageExtension == "" || c.ImageExtension == "json" || c.ImageExtension == "tmp" || strings.ContainsAny(c.ImageExtension, "/.") {
+		return fmt.Errorf("image-extension must be non-empty name without dots and slashes other than json and tmp, but %q given", c.ImageExtension)
+	}
+
+	if strings.Contains(c.ImagePrefix, "/") || strings.HasPrefix(c.ImagePrefix, ".") {
+		return fmt.Errorf("image-prefix must not contain slashes and start with dot, but %q given", c.ImagePrefix)
+	}
+
+	return nil
+}
+
+// ParsePools returns images dirs of additional storage pools by pool name
+func (c *Config) ParsePools() (map[string]string, error) {
+	pools := make(map[string]string, len(c.Pools))
+	for _, pool := range c.Pools {
+		name, dir, ok := strings.Cut(pool, "=")
+		if !ok || name == "" || dir == "" {
+			return nil, fmt.Errorf("pool must be name=/path, but %q given", pool)
+		}
+
+		if _, ok := pools[name]; ok {
+			return nil, fmt.Errorf("pool %q is given more than once", name)
+		}
+		pools[name] = dir
+	}
+
+	return pools, nil
+}
+
+// ParseMountDirMode returns permissions of created mount target directories
+func (c *Config) ParseMountDirMode() (os.FileMode, error) {
+	mode, err := strconv.ParseUint(c.MountDirMode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("mount-dir-mode must be octal permissions, e.g. 0750, but %q given", c.MountDirMode)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// ReservedBlocksPercent returns percentage of filesystem blocks reserved for root on format, nil for mkfs default
+func (c *Config) ReservedBlocksPercent() *int {
+	if c.FsReservedBlocksPercent < 0 {
+		return nil
+	}
+
+	percent := c.FsReservedBlocksPercent
+	return &percent
+}
+
+// DeviceTuning returns default read-ahead and io scheduler of loop devices
+func (c *Config) DeviceTuning() *volumes.DeviceTuning {
+	return &volumes.DeviceTuning{
+		ReadAheadKB: c.LoopReadAheadKB,
+		Scheduler:   c.LoopScheduler,
+	}
+}
+
+// MaxMountCount returns maximum mount count between ext filesystem checks, nil if unchanged
+func (c *Config) MaxMountCount() *int {
+	if c.FsMaxMountCount < 0 {
+		return nil
+	}
+
+	count := c.FsMaxMountCount
+	return &count
+}
+
+// CheckIntervalDays returns maximum days between ext filesystem checks, nil if unchanged
+func (c *Config) CheckIntervalDays() *int {
+	if c.FsCheckIntervalDays < 0 {
+		return nil
+	}
+
+	days := c.FsCheckIntervalDays
+	return &days
+}
+
+// ParseImagesDirOptions returns permissions and ownership enforced on images dirs
+func (c *Config) ParseImagesDirOptions() (volumes.ImagesDirOptions, error) {
+	opts := volumes.ImagesDirOptions{}
+
+	var err error
+	if opts.Mode, err = parseOptionalMode("images-dir-mode", c.ImagesDirMode); err != nil {
+		return opts, err
+	}
+
+	if opts.UID, opts.GID, err = parseOptionalOwner("images-dir-owner", c.ImagesDirOwner); err != nil {
+		return opts, err
+	}
+
+	return opts, nil
+}
+
+// ParseSocketOptions returns permissions and ownership set on grpc unix socket, unchanged if nil
+func (c *Config) ParseSocketOptions() (mode *os.FileMode, uid *int, gid *int, err error) {
+	if mode, err = parseOptionalMode("socket-mode", c.SocketMode); err != nil {
+		return nil, nil, nil, err
+	}
+
+	if uid, gid, err = parseOptionalOwner("socket-owner", c.SocketOwner); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return mode, uid, gid, nil
+}
+
+// parseOptionalMode returns octal permissions of the flag, nil if empty
+func parseOptionalMode(flag string, value string) (*os.FileMode, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return nil, fmt.Errorf("%s must be octal permissions, e.g. 0700, but %q given", flag, value)
+	}
+
+	fileMode := os.FileMode(mode)
+	return &fileMode, nil
+}
+
+// parseOptionalOwner returns numeric uid and gid of the flag given as uid:gid, uid or :gid, nil if absent
+func parseOptionalOwner(flag string, value string) (*int, *int, error) {
+	if value == "" {
+		return nil, nil, nil
+	}
+
+	uidValue, gidValue, _ := strings.Cut(value, ":")
+	if uidValue == "" && gidValue == "" {
+		return nil, nil, fmt.Errorf("%s must be uid:gid, uid or :gid, but %q given", flag, value)
+	}
+
+	var uid, gid *int
+	for _, id := range []struct {
+		value  string
+		target **int
+	}{{uidValue, &uid}, {gidValue, &gid}} {
+		if id.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(id.value)
+		if err != nil || n < 0 {
+			return nil, nil, fmt.Errorf("%s must be numeric uid:gid, uid or :gid, but %q given", flag, value)
+		}
+		*id.target = &n
+	}
+
+	return uid, gid, nil
 }
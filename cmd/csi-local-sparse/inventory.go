@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"io"
+	"os"
+)
+
+// InventoryCommand options of inventory subcommand
+type InventoryCommand struct {
+	// Output file to write inventory to, stdout if empty
+	Output string `long:"output" description:"File to write inventory to, stdout if empty"`
+}
+
+// inventoryVolume single line of inventory
+type inventoryVolume struct {
+	// VolumeId .
+	VolumeId string `json:"volumeId"`
+	// ImagePath path of volume image
+	ImagePath string `json:"imagePath"`
+	// SizeBytes logical (apparent) size of volume image
+	SizeBytes int64 `json:"sizeBytes"`
+	// AllocatedBytes actually allocated size of volume image
+	AllocatedBytes int64 `json:"allocatedBytes"`
+	// FsType filesystem of volume, empty if volume isn't formatted
+	FsType string `json:"fsType"`
+	// Device attached loop device
+	Device string `json:"device,omitempty"`
+	// MountTargets targets attached device is mounted to
+	MountTargets []string `json:"mountTargets,omitempty"`
+	// Metadata persisted per volume options
+	Metadata *volumes.VolumeMetadata `json:"metadata,omitempty"`
+	// Error error of volume state collection
+	Error string `json:"error,omitempty"`
+}
+
+// runInventory writes one JSON object per volume found in images dir.
+// It only reads state, so it is safe to run while plugin serves
+func runInventory(ctx context.Context, opts InventoryCommand, volumeController volumes.VolumeController, mounter volumes.Mounter, stdout io.Writer) error {
+	out := stdout
+	if opts.Output != "" {
+		f, err := os.Create(opts.Output)
+		if err != nil {
+			return fmt.Errorf("error create output file: %w", err)
+		}
+		defer func() { _ = f.Close() }()
+		out = f
+	}
+
+	volumeIds, err := volumeController.ListVolumeIds(ctx)
+	if err != nil {
+		return fmt.Errorf("error list volumes: %w", err)
+	}
+
+	encoder := json.NewEncoder(out)
+	for _, volumeId := range volumeIds {
+		if err := encoder.Encode(collectInventoryVolume(ctx, volumeId, volumeController, mounter)); err != nil {
+			return fmt.Errorf("error write inventory: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// collectInventoryVolume collects state of single volume. Collection errors are reported in the result
+func collectInventoryVolume(ctx context.Context, volumeId string, volumeController volumes.VolumeController, mounter volumes.Mounter) inventoryVolume {
+	v := inventoryVolume{
+		VolumeId: volumeId,
+	}
+
+	var err error
+	v.ImagePath, err = volumeController.GetImagePath(ctx, volumeId)
+	if err == nil {
+		v.SizeBytes, v.AllocatedBytes, err = volumeController.GetVolumeDiskUsage(ctx, volumeId)
+	}
+	if err == nil {
+		v.Metadata, err = volumeController.GetMetadata(ctx, volumeId)
+	}
+	if err == nil {
+		v.FsType, err = volumeController.GetFilesystemType(ctx, volumeId)
+	}
+	if err == nil {
+		v.Device, err = volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	}
+	if err == nil && v.Device != "" {
+		v.MountTargets, err = mounter.GetMountRefs(ctx, v.Device)
+	}
+	if err != nil {
+		v.Error = err.Error()
+	}
+
+	return v
+}
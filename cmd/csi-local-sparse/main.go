@@ -20,11 +20,14 @@ import (
 	"context"
 	"fmt"
 	"github.com/jessevdk/go-flags"
+	"github.com/reinstall/csi-local-sparse/internal/audit"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
 	"github.com/reinstall/csi-local-sparse/internal/plugin"
 	"github.com/reinstall/csi-local-sparse/internal/volumes"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 	"log"
+	"os"
 	"os/signal"
 	"strings"
 	"syscall"
@@ -42,16 +45,39 @@ var cfg Config
 
 func main() {
 	parser := flags.NewParser(&cfg, flags.Default)
-	_, err := parser.Parse()
+	parser.SubcommandsOptional = true
+	selfTest := SelfTestCommand{}
+	_, err := parser.AddCommand("selftest", "Run volume lifecycle selftest", "Create, format, mount, expand and delete temporary volume in images dir and report result of each step", &selfTest)
+	if err != nil {
+		log.Fatal(fatalJsonLog("Failed to init config parser.", err))
+	}
+	inventory := InventoryCommand{}
+	_, err = parser.AddCommand("inventory", "Export volumes inventory", "Write one JSON object per volume with its size, filesystem, attached device, mount targets and metadata. Safe to run while plugin serves", &inventory)
+	if err != nil {
+		log.Fatal(fatalJsonLog("Failed to init config parser.", err))
+	}
+
+	_, err = parser.Parse()
 	if err != nil {
 		log.Fatal(fatalJsonLog("Failed to parse config.", err))
 	}
 
+	if err := cfg.Validate(); err != nil {
+		log.Fatal(fatalJsonLog("Invalid config.", err))
+	}
+
 	logger, err := initLogger(cfg.LogLevel, cfg.LogJSON)
 	if err != nil {
 		log.Fatal(fatalJsonLog("Failed to init logger.", err))
 	}
 
+	// temporary directories of plugin and external commands are created there, so root filesystem can be read-only
+	if cfg.TempDir != "" {
+		if err := os.Setenv("TMPDIR", cfg.TempDir); err != nil {
+			logger.Fatal("Failed to set temp dir", zap.Error(err))
+		}
+	}
+
 	ctx, cancelFunc := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
 	defer cancelFunc()
 	go func() {
@@ -66,9 +92,147 @@ func main() {
 		}
 	}()
 
-	volumeManager := volumes.NewLinuxSparseFileVolumeController(cfg.ImagesDir, cfg.UseDirectIO, logger)
-	mounter := volumes.NewLinuxMounter(logger)
-	csiPlugin := plugin.NewPlugin(PluginName, PluginVersion, cfg.NodeId, cfg.NodeNameTopologyKey, cfg.GrpcSocket, volumeManager, mounter, logger)
+	auditLogger, err := audit.NewLogger(cfg.AuditLogFile, cfg.AuditLogFormat)
+	if err != nil {
+		logger.Fatal("Failed to init audit logger", zap.Error(err))
+	}
+	defer func() { _ = auditLogger.Sync() }()
+
+	pools, err := cfg.ParsePools()
+	if err != nil {
+		logger.Fatal("Failed to parse pools", zap.Error(err))
+	}
+
+	mountDirMode, err := cfg.ParseMountDirMode()
+	if err != nil {
+		logger.Fatal("Failed to parse mount dir mode", zap.Error(err))
+	}
+
+	socketMode, socketUID, socketGID, err := cfg.ParseSocketOptions()
+	if err != nil {
+		logger.Fatal("Failed to parse socket options", zap.Error(err))
+	}
+
+	var volumeManager volumes.VolumeController
+	var mounter volumes.Mounter
+	if cfg.FakeVolumesCapacity > 0 {
+		logger.Warn("Fake volumes are enabled, volumes are kept in memory only")
+		fakeMounter := volumes.NewFakeMounter()
+		volumeManager = volumes.NewFakeVolumeController(cfg.FakeVolumesCapacity, fakeMounter)
+		mounter = fakeMounter
+	} else {
+		volumeManager, mounter, err = newPlatform(pools, mountDirMode, logger)
+		if err != nil {
+			logger.Fatal("Failed to init platform", zap.Error(err))
+		}
+	}
+
+	if parser.Active != nil && parser.Active.Name == "selftest" {
+		if err := runSelfTest(ctx, selfTest, volumeManager, mounter, os.Stdout); err != nil {
+			logger.Fatal("Selftest failed", zap.Error(err))
+		}
+		return
+	}
+
+	if parser.Active != nil && parser.Active.Name == "inventory" {
+		if err := runInventory(ctx, inventory, volumeManager, mounter, os.Stdout); err != nil {
+			logger.Fatal("Inventory failed", zap.Error(err))
+		}
+		return
+	}
+
+	csiPlugin := plugin.NewPlugin(PluginName, PluginVersion, cfg.NodeId, cfg.NodeNameTopologyKey, cfg.GrpcSocket, volumeManager, mounter, plugin.Options{
+		EnableAttach:                     cfg.EnableAttach,
+		MountLoop:                        cfg.MountLoop,
+		UsageWarningThreshold:            cfg.UsageWarningThreshold,
+		UsageCheckInterval:               cfg.UsageCheckInterval,
+		AuditLogger:                      auditLogger,
+		GrpcMaxRecvMsgSize:               cfg.GrpcMaxRecvMsgSize,
+		GrpcMaxSendMsgSize:               cfg.GrpcMaxSendMsgSize,
+		GrpcKeepaliveTime:                cfg.GrpcKeepaliveTime,
+		GrpcKeepaliveTimeout:             cfg.GrpcKeepaliveTimeout,
+		GrpcKeepaliveMinTime:             cfg.GrpcKeepaliveMinTime,
+		GrpcKeepalivePermitWithoutStream: cfg.GrpcKeepalivePermitWithoutStream,
+		ReadyFile:                        cfg.ReadyFile,
+		SocketMode:                       socketMode,
+		SocketUID:                        socketUID,
+		SocketGID:                        socketGID,
+		OperationTimeout:                 cfg.OperationTimeout,
+		FormatTimeout:                    cfg.FormatTimeout,
+		ResizeTimeout:                    cfg.ResizeTimeout,
+		AttachTimeout:                    cfg.AttachTimeout,
+		RateLimit:                        cfg.RateLimit,
+		RateLimitBurst:                   cfg.RateLimitBurst,
+		EnableReflection:                 cfg.EnableReflection,
+		LimitOnlyDefaultSize:             cfg.LimitOnlyDefaultSize,
+		RequireExplicitSize:              cfg.RequireExplicitSize,
+		Maintenance:                      cfg.Maintenance,
+		PoolAccountingInterval:           cfg.PoolAccountingInterval,
+		OrphanGCInterval:                 cfg.OrphanGCInterval,
+		OrphanGCKnownVolumesFile:         cfg.OrphanGCKnownVolumesFile,
+		OrphanGCMinAge:                   cfg.OrphanGCMinAge,
+		OrphanGCDelete:                   cfg.OrphanGCDelete,
+		ReconcileMountsInterval:          cfg.ReconcileMountsInterval,
+		ReconcileMountsCleanup:           cfg.ReconcileMountsCleanup,
+		KubeletDir:                       cfg.KubeletDir,
+		ListVolumesWorkers:               cfg.ListVolumesWorkers,
+		VolumeContextKeys:                cfg.VolumeContextKeys,
+		MaxVolumesPerNode:                cfg.MaxVolumesPerNode,
+		LoopDevicesWarningThreshold:      cfg.LoopDevicesWarningThreshold,
+		LoopDevicesProbeFail:             cfg.LoopDevicesProbeFail,
+		LoopAutoclear:                    cfg.LoopAutoclear,
+		FsckOnStage:                      cfg.FsckOnStage,
+		UnmountRetries:                   cfg.UnmountRetries,
+		UnmountRetryBackoff:              cfg.UnmountRetryBackoff,
+		LazyUnmount:                      cfg.LazyUnmount,
+		RemountReadOnlyRecovery:          cfg.RemountReadOnlyRecovery,
+		ExpandOverProvisionRatio:         cfg.ExpandOverProvisionRatio,
+		ExpandOverProvisionFail:          cfg.ExpandOverProvisionFail,
+	}, logger)
+
+	if maintenanceSignal != nil {
+		maintenanceSignals := make(chan os.Signal, 1)
+		signal.Notify(maintenanceSignals, maintenanceSignal)
+		go func() {
+			for {
+				select {
+				case <-ctx.Done():
+					signal.Stop(maintenanceSignals)
+					return
+				case <-maintenanceSignals:
+					csiPlugin.ToggleMaintenance()
+				}
+			}
+		}()
+	}
+
+	if cfg.MetricsListen != "" {
+		metricsServer := metrics.NewServer(cfg.MetricsListen, logger)
+		if cfg.EnableDebugEndpoints {
+			metricsServer.Handle("/volumes", csiPlugin.VolumesHandler())
+			metricsServer.Handle("/pool", csiPlugin.PoolHandler())
+		}
+		if cfg.AdminTokenFile != "" {
+			token, err := os.ReadFile(cfg.AdminTokenFile)
+			if err != nil {
+				logger.Fatal("Failed to read admin token file", zap.Error(err))
+			}
+			if strings.TrimSpace(string(token)) == "" {
+				logger.Fatal("Admin token file is empty", zap.String("file", cfg.AdminTokenFile))
+			}
+			metricsServer.Handle("/force-cleanup", csiPlugin.ForceCleanupHandler(strings.TrimSpace(string(token))))
+			metricsServer.Handle("/compact", csiPlugin.CompactHandler(strings.TrimSpace(string(token))))
+			if cfg.EnableNbdExport {
+				metricsServer.Handle("/export", csiPlugin.ExportHandler(strings.TrimSpace(string(token))))
+			}
+		}
+		go func() {
+			if err := metricsServer.Run(ctx); err != nil {
+				logger.Error("Error run metrics server", zap.Error(err))
+				cancelFunc()
+			}
+		}()
+	}
 
 	err = csiPlugin.Run(ctx)
 	if err != nil {
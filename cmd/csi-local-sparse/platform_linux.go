@@ -0,0 +1,98 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"os"
+	"sort"
+	"syscall"
+)
+
+// maintenanceSignal signal toggling maintenance mode
+var maintenanceSignal os.Signal = syscall.SIGUSR1
+
+// newPlatform returns volume controller of sparse file images attached to loop devices and linux mounter.
+// Images dir and pool dirs are checked first, unless the check is skipped
+func newPlatform(pools map[string]string, mountDirMode os.FileMode, logger *zap.Logger) (volumes.VolumeController, volumes.Mounter, error) {
+	if !cfg.SkipImagesDirCheck {
+		imagesDirOpts, err := cfg.ParseImagesDirOptions()
+		if err != nil {
+			return nil, nil, fmt.Errorf("error parse images dir options: %w", err)
+		}
+
+		for _, dir := range append([]string{cfg.ImagesDir}, sortedPoolDirs(pools)...) {
+			if err := volumes.PrepareImagesDir(dir, imagesDirOpts); err != nil {
+				return nil, nil, fmt.Errorf("invalid images dir: %w", err)
+			}
+		}
+	}
+
+	volumeController := volumes.NewLinuxSparseFileVolumeController(cfg.ImagesDir, volumes.SparseFileVolumeControllerOptions{
+		DirectIO:                 cfg.UseDirectIO,
+		DeviceTuning:             *cfg.DeviceTuning(),
+		IOCgroup:                 cfg.IOCgroup,
+		NameLinks:                cfg.NameLinks,
+		FsLabel:                  cfg.FsLabel,
+		FsUUID:                   cfg.FsUUID,
+		LoopSectorSize:           cfg.LoopSectorSize,
+		ReservedBlocksPercent:    cfg.ReservedBlocksPercent(),
+		FsMaxMountCount:          cfg.MaxMountCount(),
+		FsCheckIntervalDays:      cfg.CheckIntervalDays(),
+		FormatJitter:             cfg.FormatJitter,
+		HeavyCommandsNice:        cfg.MkfsNice,
+		HeavyCommandsIoniceClass: cfg.MkfsIoniceClass,
+		ImageExtension:           cfg.ImageExtension,
+		ImagePrefix:              cfg.ImagePrefix,
+		Pools:                    pools,
+		NoSyncOnCreate:           cfg.NoSyncOnCreate,
+		DetachSingle:             cfg.DetachSingle,
+		ScanBusyDeviceHolders:    cfg.ScanBusyDeviceHolders,
+		Preallocate:              cfg.Preallocate,
+		PunchHolesOnDelete:       cfg.PunchHolesOnDelete,
+		TemplatesDir:             cfg.TemplatesDir,
+		NbdExport:                cfg.EnableNbdExport,
+		NbdExportAddress:         cfg.NbdExportAddress,
+		NbdExportPort:            cfg.NbdExportPort,
+		NbdExportMaxCount:        cfg.NbdExportMaxCount,
+	}, logger)
+	mounter := volumes.NewLinuxMounter(volumes.LinuxMounterOptions{
+		FindMntTimeout: cfg.FindMntTimeout,
+		MountDirMode:   mountDirMode,
+	}, logger)
+
+	return volumeController, mounter, nil
+}
+
+// sortedPoolDirs returns images dirs of pools sorted by pool name
+func sortedPoolDirs(pools map[string]string) []string {
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dirs := make([]string, 0, len(names))
+	for _, name := range names {
+		dirs = append(dirs, pools[name])
+	}
+	return dirs
+}
@@ -0,0 +1,35 @@
+//go:build !linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"os"
+	"runtime"
+)
+
+// maintenanceSignal signal toggling maintenance mode, not every platform has SIGUSR1
+var maintenanceSignal os.Signal
+
+// newPlatform fails, because volumes rely on loop devices and linux tools. Only fake volumes can be used
+func newPlatform(_ map[string]string, _ os.FileMode, _ *zap.Logger) (volumes.VolumeController, volumes.Mounter, error) {
+	return nil, nil, fmt.Errorf("%s is not supported, volumes require linux, only fake volumes can be used", runtime.GOOS)
+}
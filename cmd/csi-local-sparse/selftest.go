@@ -0,0 +1,149 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SelfTestCommand options of selftest subcommand
+type SelfTestCommand struct {
+	// Size initial size of test volume
+	Size int64 `long:"size" description:"Initial size of test volume in bytes" default:"1073741824"`
+	// FsType filesystem of test volume
+	FsType string `long:"fs-type" description:"Filesystem of test volume" default:"ext4"`
+	// MountDir directory with shared mount propagation where test volume is mounted
+	MountDir string `long:"mount-dir" description:"Directory with shared mount propagation where test volume is mounted" default:"/var/lib/kubelet/plugins"`
+}
+
+// selfTestStep single step of selftest
+type selfTestStep struct {
+	// name step name
+	name string
+	// run step function
+	run func(ctx context.Context) error
+}
+
+// runSelfTest runs full volume lifecycle against temporary volume and writes pass/fail report of each step.
+// Volume is always cleaned up. Returns error if any step failed
+func runSelfTest(ctx context.Context, opts SelfTestCommand, volumeController volumes.VolumeController, mounter volumes.Mounter, out io.Writer) error {
+	volumeId := fmt.Sprintf("selftest-%d", time.Now().UnixNano())
+	target := filepath.Join(opts.MountDir, volumeId)
+
+	steps := []selfTestStep{
+		{"create", func(ctx context.Context) error {
+			_, err := volumeController.Create(ctx, volumeId, "", opts.Size)
+			return err
+		}},
+		{"format", func(ctx context.Context) error {
+			return volumeController.FormatIfNot(ctx, volumeId, opts.FsType)
+		}},
+		{"attach", func(ctx context.Context) error {
+			_, err := volumeController.AttachDevice(ctx, volumeId)
+			return err
+		}},
+		{"mount", func(ctx context.Context) error {
+			dev, err := volumeController.GetDeviceByVolumeId(ctx, volumeId)
+			if err != nil {
+				return err
+			}
+			return mounter.Mount(ctx, dev, target, nil)
+		}},
+		{"write", func(ctx context.Context) error {
+			return os.WriteFile(filepath.Join(target, "selftest"), []byte(volumeId), 0600)
+		}},
+		{"expand", func(ctx context.Context) error {
+			if err := volumeController.ExpandVolumeSize(ctx, volumeId, 2*opts.Size); err != nil {
+				return err
+			}
+			return volumeController.ResizeDeviceFileSystem(ctx, volumeId, "", 0)
+		}},
+		{"stats", func(ctx context.Context) error {
+			stats, err := volumeController.GetVolumeStats(ctx, target)
+			if err != nil {
+				return err
+			}
+			if stats.TotalBytes <= opts.Size/2 {
+				return fmt.Errorf("unexpected filesystem size %d after expand", stats.TotalBytes)
+			}
+			return nil
+		}},
+	}
+
+	cleanup := []selfTestStep{
+		{"unmount", func(ctx context.Context) error {
+			return mounter.Unmount(ctx, target)
+		}},
+		{"detach", func(ctx context.Context) error {
+			err := volumeController.DetachDevice(ctx, volumeId)
+			if errors.Is(err, volumes.ErrorVolumeNotFound) {
+				return nil
+			}
+			return err
+		}},
+		{"delete", func(ctx context.Context) error {
+			if err := volumeController.Delete(ctx, volumeId); err != nil {
+				return err
+			}
+			return os.RemoveAll(target)
+		}},
+	}
+
+	failed := false
+	for _, step := range steps {
+		if !runSelfTestStep(ctx, step, out) {
+			failed = true
+			break
+		}
+	}
+
+	// cleanup must run even if main steps failed or context is done
+	cleanupCtx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	for _, step := range cleanup {
+		if !runSelfTestStep(cleanupCtx, step, out) {
+			failed = true
+		}
+	}
+
+	if failed {
+		return fmt.Errorf("selftest failed")
+	}
+
+	_, _ = fmt.Fprintln(out, "selftest passed")
+	return nil
+}
+
+// runSelfTestStep runs step and reports the result. Returns true on success
+func runSelfTestStep(ctx context.Context, step selfTestStep, out io.Writer) bool {
+	started := time.Now()
+	err := step.run(ctx)
+	if err != nil {
+		_, _ = fmt.Fprintf(out, "FAIL %-8s %v: %v\n", step.name, time.Since(started).Round(time.Millisecond), err)
+		return false
+	}
+
+	_, _ = fmt.Fprintf(out, "PASS %-8s %v\n", step.name, time.Since(started).Round(time.Millisecond))
+	return true
+}
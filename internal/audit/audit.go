@@ -0,0 +1,102 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package audit
+
+import (
+	"fmt"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"time"
+)
+
+const (
+	// FormatJSON one json object per event
+	FormatJSON = "json"
+	// FormatText human-readable console format
+	FormatText = "text"
+)
+
+const (
+	// OutcomeSuccess operation succeeded
+	OutcomeSuccess = "success"
+	// OutcomeFailure operation failed
+	OutcomeFailure = "failure"
+)
+
+// Logger writes volume lifecycle events, independent of application log level and format
+type Logger struct {
+	// logger .
+	logger *zap.Logger
+}
+
+// NewLogger returns audit logger writing to the given file in the given format.
+// Returns no-op logger if path is empty
+func NewLogger(path string, format string) (*Logger, error) {
+	if path == "" {
+		return &Logger{logger: zap.NewNop()}, nil
+	}
+
+	opts := zap.NewProductionConfig()
+	opts.Level = zap.NewAtomicLevelAt(zap.InfoLevel)
+	opts.Sampling = nil
+	opts.DisableCaller = true
+	opts.DisableStacktrace = true
+	opts.OutputPaths = []string{path}
+	opts.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+	opts.EncoderConfig.LevelKey = zapcore.OmitKey
+
+	switch format {
+	case FormatJSON:
+	case FormatText:
+		opts.Encoding = "console"
+	default:
+		return nil, fmt.Errorf("unsupported audit log format %q", format)
+	}
+
+	logger, err := opts.Build()
+	if err != nil {
+		return nil, fmt.Errorf("can't build audit logger: %w", err)
+	}
+
+	return &Logger{logger: logger}, nil
+}
+
+// Record writes volume operation event
+func (l *Logger) Record(operation string, volumeId string, started time.Time, err error, fields ...zap.Field) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+
+	fields = append([]zap.Field{
+		zap.String("operation", operation),
+		zap.String("volume_id", volumeId),
+		zap.String("outcome", outcome),
+		zap.Duration("duration", time.Since(started)),
+	}, fields...)
+
+	if err != nil {
+		fields = append(fields, zap.Error(err))
+	}
+
+	l.logger.Info("volume operation", fields...)
+}
+
+// Sync flushes buffered events
+func (l *Logger) Sync() error {
+	return l.logger.Sync()
+}
@@ -0,0 +1,234 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const (
+	// namespace prefix of all plugin metrics
+	namespace = "csi_local_sparse"
+)
+
+var (
+	// Registry registry of all plugin metrics
+	Registry = prometheus.NewRegistry()
+)
+
+var (
+	// OperationErrorsTotal failed rpc calls by method, grpc code and kind of volumes error
+	OperationErrorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "operation_errors_total",
+		Help:      "Count of failed rpc calls by method, grpc code and kind of volumes error (filesystem, capacity, command or other).",
+	}, []string{"method", "code", "kind"})
+
+	// RateLimitedRequestsTotal rpc calls rejected by requests rate limit by method
+	RateLimitedRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_requests_total",
+		Help:      "Count of rpc calls rejected with RESOURCE_EXHAUSTED by requests rate limit by method.",
+	}, []string{"method"})
+
+	// UnmountsTotal unmounts of node targets by final result and rung of escalation ladder it ended on
+	UnmountsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "unmounts_total",
+		Help:      "Count of node unmounts by final result (success or failure) and rung of escalation ladder it ended on (plain or lazy).",
+	}, []string{"result", "rung"})
+
+	// CommandDurationSeconds duration of external commands by command and result
+	CommandDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "command_duration_seconds",
+		Help:      "Duration of external commands run by node plugin by command and result (success or failure).",
+		Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300},
+	}, []string{"command", "result"})
+
+	// CommandFailuresTotal failed external commands by command and exit code
+	CommandFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "command_failures_total",
+		Help:      "Count of failed external commands by command and exit code, -1 if command wasn't started or was killed.",
+	}, []string{"command", "exit_code"})
+
+	// VolumeUsageRatio used to total bytes ratio of mounted volume
+	VolumeUsageRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_usage_ratio",
+		Help:      "Used to total bytes ratio of mounted volume filesystem.",
+	}, []string{"volume_id"})
+
+	// VolumeFilesystemInfo filesystem type of mounted volume, always 1
+	VolumeFilesystemInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_filesystem_info",
+		Help:      "Filesystem type of mounted volume, always 1.",
+	}, []string{"volume_id", "fs_type"})
+
+	// VolumeUsageHighWatermarkTotal count of volume usage checks exceeding the warning threshold
+	VolumeUsageHighWatermarkTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "volume_usage_high_watermark_total",
+		Help:      "Count of volume usage checks exceeding the warning threshold.",
+	}, []string{"volume_id"})
+
+	// VolumeExpandOverProvisionedTotal count of volume expands exceeding over-provision ratio of pool
+	VolumeExpandOverProvisionedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "volume_expand_overprovisioned_total",
+		Help:      "Count of volume expands making logical sizes of pool volumes exceed the over-provision ratio of pool storage.",
+	}, []string{"volume_id"})
+
+	// VolumeCompactReclaimedBytesTotal storage space reclaimed by volume compactions
+	VolumeCompactReclaimedBytesTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "volume_compact_reclaimed_bytes_total",
+		Help:      "Storage space reclaimed by compactions of idle volumes.",
+	})
+
+	// VolumePreallocateProgressRatio allocated to total bytes ratio of volume image being preallocated on create
+	VolumePreallocateProgressRatio = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_preallocate_progress_ratio",
+		Help:      "Allocated to total bytes ratio of volume image being preallocated on create, removed once preallocation is finished.",
+	}, []string{"volume_id"})
+
+	// VolumeDeviceReadIOs completed read requests of volume loop device since attach
+	VolumeDeviceReadIOs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_device_read_ios",
+		Help:      "Completed read requests of volume loop device since it was attached.",
+	}, []string{"volume_id", "device"})
+
+	// VolumeDeviceReadBytes read bytes of volume loop device since attach
+	VolumeDeviceReadBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_device_read_bytes",
+		Help:      "Read bytes of volume loop device since it was attached.",
+	}, []string{"volume_id", "device"})
+
+	// VolumeDeviceWriteIOs completed write requests of volume loop device since attach
+	VolumeDeviceWriteIOs = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_device_write_ios",
+		Help:      "Completed write requests of volume loop device since it was attached.",
+	}, []string{"volume_id", "device"})
+
+	// VolumeDeviceWriteBytes written bytes of volume loop device since attach
+	VolumeDeviceWriteBytes = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "volume_device_write_bytes",
+		Help:      "Written bytes of volume loop device since it was attached.",
+	}, []string{"volume_id", "device"})
+
+	// PoolVolumes count of volumes of the node
+	PoolVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_volumes",
+		Help:      "Count of volumes of the node.",
+	})
+
+	// PoolAttachedVolumes count of volumes of the node attached to loop devices
+	PoolAttachedVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_attached_volumes",
+		Help:      "Count of volumes of the node attached to loop devices.",
+	})
+
+	// PoolMountedVolumes count of volumes of the node with mounted loop device
+	PoolMountedVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_mounted_volumes",
+		Help:      "Count of volumes of the node whose loop device is mounted.",
+	})
+
+	// PoolApparentBytes sum of logical sizes of volume images of the node
+	PoolApparentBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_apparent_bytes",
+		Help:      "Sum of logical (apparent) sizes of volume images of the node.",
+	})
+
+	// LoopDevicesInUse count of loop devices bound to any file
+	LoopDevicesInUse = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loop_devices_in_use",
+		Help:      "Count of loop devices of the node bound to any file.",
+	})
+
+	// LoopDevicesVolumes count of loop devices bound to volume images
+	LoopDevicesVolumes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loop_devices_volumes",
+		Help:      "Count of loop devices of the node bound to volume images.",
+	})
+
+	// LoopDevicesTotal maximum count of loop devices
+	LoopDevicesTotal = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "loop_devices_total",
+		Help:      "Maximum count of loop devices of the node: max_loop parameter of loop module or count of existing loop devices if they are created on demand.",
+	})
+
+	// OrphanedMounts mounts under kubelet dir of loop devices bound to deleted volume images, found on last reconciliation
+	OrphanedMounts = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "orphaned_mounts",
+		Help:      "Count of mounts under kubelet dir of loop devices bound to deleted volume images, found on last mounts reconciliation.",
+	})
+
+	// PoolAllocatedBytes sum of actually allocated sizes of volume images of the node
+	PoolAllocatedBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "pool_allocated_bytes",
+		Help:      "Sum of actually allocated sizes of sparse volume images of the node.",
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		OperationErrorsTotal,
+		RateLimitedRequestsTotal,
+		UnmountsTotal,
+		CommandDurationSeconds,
+		CommandFailuresTotal,
+		VolumeUsageRatio,
+		VolumeFilesystemInfo,
+		VolumeUsageHighWatermarkTotal,
+		VolumeExpandOverProvisionedTotal,
+		VolumeCompactReclaimedBytesTotal,
+		VolumePreallocateProgressRatio,
+		VolumeDeviceReadIOs,
+		VolumeDeviceReadBytes,
+		VolumeDeviceWriteIOs,
+		VolumeDeviceWriteBytes,
+		PoolVolumes,
+		PoolAttachedVolumes,
+		PoolMountedVolumes,
+		PoolApparentBytes,
+		PoolAllocatedBytes,
+		LoopDevicesInUse,
+		OrphanedMounts,
+		LoopDevicesVolumes,
+		LoopDevicesTotal,
+	)
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// Server http server of metrics endpoint
+type Server struct {
+	// listen listening address
+	listen string
+	// mux .
+	mux *http.ServeMux
+	// logger .
+	logger *zap.Logger
+}
+
+// NewServer returns new metrics server serving /metrics
+func NewServer(listen string, logger *zap.Logger) *Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(Registry, promhttp.HandlerOpts{}))
+
+	return &Server{
+		listen: listen,
+		mux:    mux,
+		logger: logger.With(zap.String("logger", "metrics_server")),
+	}
+}
+
+// Handle registers additional handler for the given pattern
+func (s *Server) Handle(pattern string, handler http.Handler) {
+	s.mux.Handle(pattern, handler)
+}
+
+// Run serves http requests until context is done
+func (s *Server) Run(ctx context.Context) error {
+	srv := &http.Server{
+		Addr:              s.listen,
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			s.logger.Error("Error shutdown metrics server", zap.Error(err))
+		}
+	}()
+
+	s.logger.Info("Metrics server is listening", zap.String("listen", s.listen))
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("error serve metrics: %w", err)
+	}
+
+	return nil
+}
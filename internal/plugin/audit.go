@@ -0,0 +1,57 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.uber.org/zap"
+	"time"
+)
+
+// recordAudit writes volume lifecycle event to audit log. Other rpc calls are ignored
+func (p *Plugin) recordAudit(req interface{}, resp interface{}, started time.Time, err error) {
+	if p.opts.AuditLogger == nil {
+		return
+	}
+
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		fields := []zap.Field{zap.Int64("required_bytes", r.GetCapacityRange().GetRequiredBytes())}
+		if v, ok := resp.(*csi.CreateVolumeResponse); ok && v != nil {
+			fields = append(fields, zap.Int64("size_bytes", v.GetVolume().GetCapacityBytes()))
+		}
+		p.opts.AuditLogger.Record("create", r.GetName(), started, err, fields...)
+	case *csi.DeleteVolumeRequest:
+		p.opts.AuditLogger.Record("delete", r.GetVolumeId(), started, err)
+	case *csi.ControllerExpandVolumeRequest:
+		fields := []zap.Field{zap.Int64("required_bytes", r.GetCapacityRange().GetRequiredBytes())}
+		if v, ok := resp.(*csi.ControllerExpandVolumeResponse); ok && v != nil {
+			fields = append(fields, zap.Int64("size_bytes", v.GetCapacityBytes()))
+		}
+		p.opts.AuditLogger.Record("controller_expand", r.GetVolumeId(), started, err, fields...)
+	case *csi.NodeExpandVolumeRequest:
+		fields := []zap.Field{zap.Int64("required_bytes", r.GetCapacityRange().GetRequiredBytes())}
+		if v, ok := resp.(*csi.NodeExpandVolumeResponse); ok && v != nil {
+			fields = append(fields, zap.Int64("size_bytes", v.GetCapacityBytes()))
+		}
+		p.opts.AuditLogger.Record("node_expand", r.GetVolumeId(), started, err, fields...)
+	case *csi.NodeStageVolumeRequest:
+		p.opts.AuditLogger.Record("stage", r.GetVolumeId(), started, err, zap.String("staging_path", r.GetStagingTargetPath()))
+	case *csi.NodeUnstageVolumeRequest:
+		p.opts.AuditLogger.Record("unstage", r.GetVolumeId(), started, err, zap.String("staging_path", r.GetStagingTargetPath()))
+	}
+}
@@ -0,0 +1,229 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// compactResult result of volume compaction
+type compactResult struct {
+	// VolumeId compacted volume
+	VolumeId string `json:"volumeId"`
+	// AllocatedBytesBefore allocated size of image before compaction
+	AllocatedBytesBefore int64 `json:"allocatedBytesBefore"`
+	// AllocatedBytesAfter allocated size of image after compaction
+	AllocatedBytesAfter int64 `json:"allocatedBytesAfter"`
+	// ReclaimedBytes storage space returned by compaction
+	ReclaimedBytes int64 `json:"reclaimedBytes"`
+}
+
+// CompactHandler returns http handler compacting idle volume on POST, see compactVolume. Volume is passed with
+// volume_id query parameter, compress=true asks for compressed image. Request must have "Authorization: Bearer <token>" header
+func (p *Plugin) CompactHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isAuthorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		volumeId := r.URL.Query().Get("volume_id")
+		if volumeId == "" {
+			http.Error(w, "volume_id is required", http.StatusBadRequest)
+			return
+		}
+
+		compress := false
+		if value := r.URL.Query().Get("compress"); value != "" {
+			var err error
+			if compress, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "compress must be boolean", http.StatusBadRequest)
+				return
+			}
+		}
+
+		result, err := p.compactVolume(r.Context(), volumeId, compress)
+		if err != nil {
+			p.logger.Error("Compact endpoint error compact volume", zap.String("volume_id", volumeId), zap.Error(err))
+			switch {
+			case errors.Is(err, volumes.ErrorVolumeNotFound):
+				http.Error(w, err.Error(), http.StatusNotFound)
+			case errors.Is(err, volumes.ErrorVolumeInUse):
+				http.Error(w, err.Error(), http.StatusConflict)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			p.logger.Error("Compact endpoint error write response", zap.Error(err))
+		}
+	})
+}
+
+// compactVolume reclaims storage space freed inside idle volume: filesystem is temporarily mounted and trimmed,
+// then image is rewritten sparse. Staged or attached volume is rejected with ErrorVolumeInUse and volume
+// can't be staged until compaction is finished
+func (p *Plugin) compactVolume(ctx context.Context, volumeId string, compress bool) (*compactResult, error) {
+	if !p.startCompaction(volumeId) {
+		return nil, fmt.Errorf("volume is staged, being deleted or already being compacted: %w", volumes.ErrorVolumeInUse)
+	}
+	defer p.finishCompaction(volumeId)
+
+	dev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume device: %w", err)
+	}
+	if dev != "" {
+		return nil, fmt.Errorf("volume is attached to %s: %w", dev, volumes.ErrorVolumeInUse)
+	}
+
+	_, before, err := p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume disk usage: %w", err)
+	}
+
+	fsType, err := p.volumeController.GetFilesystemType(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume filesystem: %w", err)
+	}
+
+	// blocks freed inside filesystem still hold old data until they are discarded
+	if fsType != "" {
+		if err := p.trimVolume(ctx, volumeId); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := p.volumeController.SparsifyImage(ctx, volumeId, compress); err != nil {
+		return nil, fmt.Errorf("error sparsify volume image: %w", err)
+	}
+
+	_, after, err := p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume disk usage: %w", err)
+	}
+
+	result := &compactResult{
+		VolumeId:             volumeId,
+		AllocatedBytesBefore: before,
+		AllocatedBytesAfter:  after,
+		ReclaimedBytes:       before - after,
+	}
+	if result.ReclaimedBytes > 0 {
+		metrics.VolumeCompactReclaimedBytesTotal.Add(float64(result.ReclaimedBytes))
+	}
+
+	p.logger.Info("Volume was compacted",
+		zap.String("volume_id", volumeId),
+		zap.Bool("compress", compress),
+		zap.Int64("allocated_bytes_before", before),
+		zap.Int64("allocated_bytes_after", after),
+		zap.Int64("reclaimed_bytes", result.ReclaimedBytes),
+	)
+	return result, nil
+}
+
+// trimVolume attaches volume, mounts it to temporary directory and trims its filesystem, then releases it
+func (p *Plugin) trimVolume(ctx context.Context, volumeId string) (err error) {
+	dev, err := p.attachDevice(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error attach volume device: %w", err)
+	}
+	defer func() {
+		if detachErr := p.detachDevice(ctx, volumeId); err == nil && detachErr != nil {
+			err = fmt.Errorf("error detach volume device: %w", detachErr)
+		}
+	}()
+
+	target, err := os.MkdirTemp("", "csi-local-sparse-compact-")
+	if err != nil {
+		return fmt.Errorf("error create mount directory: %w", err)
+	}
+	defer func() { _ = os.Remove(target) }()
+
+	if err := p.mounter.Mount(ctx, dev, target, nil); err != nil {
+		return fmt.Errorf("error mount volume: %w", err)
+	}
+	defer func() {
+		if unmountErr := p.mounter.Unmount(ctx, target); err == nil && unmountErr != nil {
+			err = fmt.Errorf("error unmount volume: %w", unmountErr)
+		}
+	}()
+
+	if err := p.volumeController.TrimFileSystem(ctx, target); err != nil {
+		return fmt.Errorf("error trim volume filesystem: %w", err)
+	}
+	return nil
+}
+
+// startCompaction marks volume as being compacted. Returns false if volume is staged or already being compacted
+func (p *Plugin) startCompaction(volumeId string) bool {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	if _, ok := p.stagedVolumes[volumeId]; ok || p.compactingVolumes[volumeId] {
+		return false
+	}
+	p.compactingVolumes[volumeId] = true
+	return true
+}
+
+// startDelete marks volume as being compacted for the time of delete, so compaction can't copy image being deleted.
+// Returns false if volume is already being compacted. Mark is removed with finishCompaction
+func (p *Plugin) startDelete(volumeId string) bool {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	if p.compactingVolumes[volumeId] {
+		return false
+	}
+	p.compactingVolumes[volumeId] = true
+	return true
+}
+
+// finishCompaction unmarks volume as being compacted
+func (p *Plugin) finishCompaction(volumeId string) {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	delete(p.compactingVolumes, volumeId)
+}
+
+// isCompacting returns true if volume is being compacted
+func (p *Plugin) isCompacting(volumeId string) bool {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	return p.compactingVolumes[volumeId]
+}
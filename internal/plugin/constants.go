@@ -33,11 +33,78 @@ const (
 )
 
 const (
-	// maxVolumesPerNode is maximum count of volumes that can be created per one node
+	// defaultFsType filesystem of volumes when neither request nor volume has one
+	defaultFsType = "ext4"
+)
+
+const (
+	// formatSpaceRatio volume size is divided by it to estimate space mkfs writes, e.g. ext4 journal and group tables
+	formatSpaceRatio = 128
+	// minimumFormatSpace estimated space mkfs writes to small volume
+	minimumFormatSpace int64 = 64 * Mb
+)
+
+const (
+	// maxVolumesPerNode is default maximum count of volumes that can be created per one node
 	maxVolumesPerNode = 200
 )
 
+const (
+	// paramDirectIO storage class parameter, overrides direct-io mode of volume loop device
+	paramDirectIO = "reinstall.ru/direct-io"
+	// paramReadIOPS storage class parameter, limits volume read operations per second
+	paramReadIOPS = "reinstall.ru/read-iops"
+	// paramWriteIOPS storage class parameter, limits volume write operations per second
+	paramWriteIOPS = "reinstall.ru/write-iops"
+	// paramReadBPS storage class parameter, limits volume read bytes per second
+	paramReadBPS = "reinstall.ru/read-bps"
+	// paramWriteBPS storage class parameter, limits volume write bytes per second
+	paramWriteBPS = "reinstall.ru/write-bps"
+	// paramReadAheadKB storage class parameter, overrides read-ahead of volume loop device in kilobytes
+	paramReadAheadKB = "reinstall.ru/read-ahead-kb"
+	// paramScheduler storage class parameter, overrides io scheduler of volume loop device
+	paramScheduler = "reinstall.ru/scheduler"
+	// paramReservedBlocksPercent storage class parameter, overrides percentage of ext4 blocks reserved for root
+	paramReservedBlocksPercent = "reinstall.ru/reserved-blocks-percent"
+	// paramPool storage class parameter, storage pool of volume images, default pool if empty
+	paramPool = "reinstall.ru/pool"
+	// paramSkipFormat storage class parameter, never format volume, workload formats it itself
+	paramSkipFormat = "reinstall.ru/skip-format"
+	// paramTemplate storage class parameter, name of template image volume is copied from
+	paramTemplate = "reinstall.ru/template"
+	// paramUID storage class parameter, owner user id of volume files
+	paramUID = "reinstall.ru/uid"
+	// paramGID storage class parameter, owner group id of volume files
+	paramGID = "reinstall.ru/gid"
+	// paramMode storage class parameter, octal permissions of volume root directory
+	paramMode = "reinstall.ru/mode"
+	// paramOwnershipChangePolicy storage class parameter, Always or OnRootMismatch like pod's fsGroupChangePolicy
+	paramOwnershipChangePolicy = "reinstall.ru/ownership-change-policy"
+)
+
+const (
+	// attributePrefix prefix of driver's own storage class parameters and volume attributes
+	attributePrefix = "reinstall.ru/"
+	// contextEphemeral volume context key set by kubelet to "true" for inline ephemeral volumes of pod
+	contextEphemeral = "csi.storage.k8s.io/ephemeral"
+	// contextSize inline ephemeral volume attribute, volume size in bytes or with Ki, Mi, Gi or Ti suffix, default size if empty
+	contextSize = "reinstall.ru/size"
+)
+
+const (
+	// contextApparentBytes volume context key of ListVolumes and ControllerGetVolume, logical size of volume image
+	contextApparentBytes = "reinstall.ru/apparent-bytes"
+	// contextAllocatedBytes volume context key of ListVolumes and ControllerGetVolume, actually allocated size of volume image
+	contextAllocatedBytes = "reinstall.ru/allocated-bytes"
+)
+
+const (
+	// paramPvcName persistent volume claim name, passed by external-provisioner with --extra-create-metadata
+	paramPvcName = "csi.storage.k8s.io/pvc/name"
+	// paramPvcNamespace persistent volume claim namespace, passed by external-provisioner with --extra-create-metadata
+	paramPvcNamespace = "csi.storage.k8s.io/pvc/namespace"
+)
+
 var (
 	_ = Kb
-	_ = Mb
 )
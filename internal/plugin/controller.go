@@ -18,6 +18,7 @@ package plugin
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/protobuf/ptypes/wrappers"
@@ -25,8 +26,19 @@ import (
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"os"
+	"strconv"
+	"strings"
 )
 
+// supportedAccessModes access modes of volumes local to node. Staged volume can be published to several targets,
+// so pods on the same node can share writable volume
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
 // CreateVolume creates a new volume from the given request
 func (p *Plugin) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	volumeId := request.Name
@@ -36,13 +48,17 @@ func (p *Plugin) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 		return nil, status.Error(codes.InvalidArgument, "CreateVolume invalid argument: name")
 	}
 
+	if p.inMaintenance() {
+		return nil, status.Errorf(codes.Unavailable, "CreateVolume (%s) node storage is in maintenance mode", volumeId)
+	}
+
 	if request.VolumeCapabilities == nil || len(request.VolumeCapabilities) == 0 {
 		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume (%s) invalid argument: volumeCapabilities", volumeId)
 	}
 
 	for _, c := range request.VolumeCapabilities {
-		// only ReadWriteOnce mode supported
-		if c.AccessMode.Mode != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		// volume is local to node, so only single node modes are supported
+		if !supportedAccessModes[c.GetAccessMode().GetMode()] {
 			return nil, status.Errorf(codes.InvalidArgument, "CreateVolume (%s) unsupported access mode: %s", volumeId, c.GetAccessMode().GetMode().String())
 		}
 
@@ -70,24 +86,59 @@ func (p *Plugin) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 
 	nodeName := segments[p.nodeNameTopologyKey]
 
-	size, err := p.calculateVolumeSize(request.CapacityRange)
+	size, err := p.calculateCreateVolumeSize(request.CapacityRange)
 	if err != nil {
 		return nil, status.Errorf(codes.OutOfRange, "CreateVolume (%s) invalid argument: capacityRange: %v", volumeId, err)
 	}
 
-	if err := p.volumeController.Create(ctx, volumeId, size); err != nil {
-		if err == volumes.ErrorVolumeAlreadyExists {
-			p.logger.Info("Volume already exists", zap.String("volume_id", volumeId))
+	metadata, err := p.parseVolumeMetadata(request.Parameters)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "CreateVolume (%s) invalid argument: parameters: %v", volumeId, err)
+	}
 
-			return &csi.CreateVolumeResponse{
-				Volume: &csi.Volume{
-					VolumeId:      volumeId,
-					CapacityBytes: size,
-				},
-			}, nil
+	metadata.VolumeContext = p.selectVolumeContext(request.Parameters)
+
+	// expand requests carry no limit, so the create one is kept to enforce it on resize
+	metadata.LimitBytes = request.CapacityRange.GetLimitBytes()
+
+	// CO isn't obliged to repeat filesystem type on stage, so it's kept with the volume
+	for _, c := range request.VolumeCapabilities {
+		if fsType := c.GetMount().GetFsType(); fsType != "" {
+			metadata.FsType = fsType
+			break
 		}
+	}
 
-		return nil, status.Errorf(codes.Internal, "CreateVolume (%s) error create volume: %v", volumeId, err)
+	reserved, err := p.reserveVolume(ctx, volumeId)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, status.Errorf(codes.ResourceExhausted, "CreateVolume (%s) %s", volumeId, status.Convert(err).Message())
+		}
+		return nil, fmt.Errorf("CreateVolume (%s) error count node volumes: %w", volumeId, err)
+	}
+
+	_, err = p.createImage(ctx, volumeId, metadata, size)
+	if err != nil {
+		if reserved {
+			p.releaseVolume(volumeId)
+		}
+
+		// volume of the same name with another size is incompatible with the request
+		if errors.Is(err, volumes.ErrorVolumeAlreadyExists) {
+			return nil, status.Errorf(codes.AlreadyExists, "CreateVolume (%s) volume already exists with incompatible size: %v", volumeId, err)
+		}
+
+		return nil, fmt.Errorf("CreateVolume (%s) error create volume: %w", volumeId, err)
+	}
+
+	if err := p.volumeController.SaveMetadata(ctx, volumeId, metadata); err != nil {
+		return nil, fmt.Errorf("CreateVolume (%s) error save volume metadata: %w", volumeId, err)
+	}
+
+	if metadata.Name != "" {
+		if err := p.volumeController.CreateNameLink(ctx, volumeId, metadata.Name); err != nil {
+			return nil, fmt.Errorf("CreateVolume (%s) error create name link: %w", volumeId, err)
+		}
 	}
 
 	p.logger.Info("Volume was created", zap.String("volume_id", volumeId))
@@ -95,6 +146,7 @@ func (p *Plugin) CreateVolume(ctx context.Context, request *csi.CreateVolumeRequ
 		Volume: &csi.Volume{
 			CapacityBytes: size,
 			VolumeId:      volumeId,
+			VolumeContext: metadata.VolumeContext,
 			AccessibleTopology: []*csi.Topology{
 				{
 					Segments: map[string]string{
@@ -115,26 +167,33 @@ func (p *Plugin) DeleteVolume(ctx context.Context, request *csi.DeleteVolumeRequ
 		return nil, status.Error(codes.InvalidArgument, "DeleteVolume invalid argument: volumeId")
 	}
 
+	if !p.startDelete(volumeId) {
+		return nil, status.Errorf(codes.Aborted, "DeleteVolume (%s) volume is being compacted", volumeId)
+	}
+	defer p.finishCompaction(volumeId)
+
 	if err := p.volumeController.Delete(ctx, volumeId); err != nil {
-		if err == volumes.ErrorVolumeNotFound {
+		if errors.Is(err, volumes.ErrorVolumeNotFound) {
+			p.releaseVolume(volumeId)
 			p.logger.Info("Assuming volume is already deleted because it does not exist", zap.String("volume_id", volumeId))
 			return &csi.DeleteVolumeResponse{}, nil
 		}
 
-		return nil, status.Errorf(codes.Internal, "DeleteVolume (%s) error delete volume: %v", volumeId, err)
+		return nil, fmt.Errorf("DeleteVolume (%s) error delete volume: %w", volumeId, err)
 	}
+	p.releaseVolume(volumeId)
 
 	p.logger.Info("Volume was deleted", zap.String("volume_id", volumeId))
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
 // GetCapacity returns the capacity of the storage pool
-func (p *Plugin) GetCapacity(ctx context.Context, _ *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+func (p *Plugin) GetCapacity(ctx context.Context, request *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	p.logger.Debug("GetCapacity called")
 
-	availableCapacity, err := p.volumeController.GetCapacity(ctx)
+	availableCapacity, err := p.volumeController.GetCapacity(ctx, request.Parameters[paramPool])
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "GetCapacity error get capacity: %v", err)
+		return nil, fmt.Errorf("GetCapacity error get capacity: %w", err)
 	}
 
 	p.logger.Info("Send available capacity", zap.Int64("available_capacity", availableCapacity))
@@ -170,38 +229,251 @@ func (p *Plugin) ControllerExpandVolume(_ context.Context, request *csi.Controll
 	}, nil
 }
 
+// checkExpandLimit returns OutOfRange if new size exceeds capacity limit requested on volume create
+func (p *Plugin) checkExpandLimit(ctx context.Context, method string, volumeId string, newSizeBytes int64) error {
+	metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("%s (%s) error get volume metadata: %w", method, volumeId, err)
+	}
+
+	if metadata.LimitBytes > 0 && newSizeBytes > metadata.LimitBytes {
+		return status.Errorf(codes.OutOfRange, "%s (%s) requested size (%d) exceeds volume limit (%d) requested on create", method, volumeId, newSizeBytes, metadata.LimitBytes)
+	}
+	return nil
+}
+
+// ControllerPublishVolume does nothing because volume is local to node, only validates the request and node. It's served
+// by controller without images dir, so volume can't be checked there, node plugin checks it on stage
+func (p *Plugin) ControllerPublishVolume(_ context.Context, request *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
+	volumeId := request.VolumeId
+	p.logger.Debug("ControllerPublishVolume called", zap.String("volume_id", volumeId), zap.String("node_id", request.NodeId))
+
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerPublishVolume invalid argument: VolumeId")
+	}
+
+	if request.NodeId == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume (%s) invalid argument: NodeId", volumeId)
+	}
+
+	if request.VolumeCapability == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "ControllerPublishVolume (%s) invalid argument: VolumeCapability", volumeId)
+	}
+
+	if request.NodeId != p.nodeId {
+		return nil, status.Errorf(codes.NotFound, "ControllerPublishVolume (%s) node (%s) not found, volume is local to node %s", volumeId, request.NodeId, p.nodeId)
+	}
+
+	p.logger.Info("ControllerPublishVolume volume was published to node", zap.String("volume_id", volumeId), zap.String("node_id", request.NodeId))
+	return &csi.ControllerPublishVolumeResponse{
+		PublishContext: map[string]string{},
+	}, nil
+}
+
+// ControllerUnpublishVolume does nothing because volume is local to node
+func (p *Plugin) ControllerUnpublishVolume(_ context.Context, request *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
+	volumeId := request.VolumeId
+	p.logger.Debug("ControllerUnpublishVolume called", zap.String("volume_id", volumeId), zap.String("node_id", request.NodeId))
+
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerUnpublishVolume invalid argument: VolumeId")
+	}
+
+	// unpublish from other nodes or of deleted volume is already done
+	p.logger.Info("ControllerUnpublishVolume volume was unpublished from node", zap.String("volume_id", volumeId), zap.String("node_id", request.NodeId))
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
+}
+
 // ControllerGetCapabilities .
 func (p *Plugin) ControllerGetCapabilities(_ context.Context, _ *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
 	p.logger.Debug("ControllerGetCapabilities called")
 
-	return &csi.ControllerGetCapabilitiesResponse{
-		Capabilities: []*csi.ControllerServiceCapability{
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-					},
+	capabilities := []*csi.ControllerServiceCapability{
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 				},
 			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-					},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_GET_CAPACITY,
 				},
 			},
-			{
-				Type: &csi.ControllerServiceCapability_Rpc{
-					Rpc: &csi.ControllerServiceCapability_RPC{
-						Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
-					},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+				},
+			},
+		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_GET_VOLUME,
 				},
 			},
 		},
+		{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+				},
+			},
+		},
+	}
+
+	if p.opts.EnableAttach {
+		capabilities = append(capabilities, &csi.ControllerServiceCapability{
+			Type: &csi.ControllerServiceCapability_Rpc{
+				Rpc: &csi.ControllerServiceCapability_RPC{
+					Type: csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME,
+				},
+			},
+		})
+	}
+
+	return &csi.ControllerGetCapabilitiesResponse{
+		Capabilities: capabilities,
 	}, nil
 }
 
+// parseVolumeMetadata returns per volume options from the given storage class parameters
+func (p *Plugin) parseVolumeMetadata(parameters map[string]string) (*volumes.VolumeMetadata, error) {
+	metadata := &volumes.VolumeMetadata{}
+
+	metadata.Pool = parameters[paramPool]
+
+	metadata.Name = volumeName(parameters)
+
+	if value, ok := parameters[paramDirectIO]; ok {
+		directIO, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be boolean, but %q given", paramDirectIO, value)
+		}
+		metadata.DirectIO = &directIO
+	}
+
+	tuning := &volumes.DeviceTuning{Scheduler: parameters[paramScheduler]}
+	if value, ok := parameters[paramReadAheadKB]; ok {
+		readAheadKB, err := strconv.ParseUint(value, 10, 64)
+		if err != nil || readAheadKB == 0 {
+			return nil, fmt.Errorf("%s must be positive integer, but %q given", paramReadAheadKB, value)
+		}
+		tuning.ReadAheadKB = readAheadKB
+	}
+
+	if err := tuning.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %w", paramScheduler, err)
+	}
+
+	if !tuning.IsEmpty() {
+		metadata.DeviceTuning = tuning
+	}
+
+	if value, ok := parameters[paramReservedBlocksPercent]; ok {
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > volumes.MaxReservedBlocksPercent {
+			return nil, fmt.Errorf("%s must be integer from 0 to %d, but %q given", paramReservedBlocksPercent, volumes.MaxReservedBlocksPercent, value)
+		}
+		metadata.ReservedBlocksPercent = &percent
+	}
+
+	if value, ok := parameters[paramSkipFormat]; ok {
+		skipFormat, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be boolean, but %q given", paramSkipFormat, value)
+		}
+		metadata.SkipFormat = skipFormat
+	}
+
+	if value, ok := parameters[paramTemplate]; ok {
+		if value == "" || strings.Contains(value, "/") || strings.HasPrefix(value, ".") {
+			return nil, fmt.Errorf("%s must be template image name without slashes, but %q given", paramTemplate, value)
+		}
+		metadata.Template = value
+		// template is formatted by admin, so its filesystem is mounted as is instead of reformat
+		metadata.SkipFormat = true
+	}
+
+	limits := &volumes.IOLimits{}
+	for key, limit := range map[string]*uint64{
+		paramReadIOPS:  &limits.ReadIOPS,
+		paramWriteIOPS: &limits.WriteIOPS,
+		paramReadBPS:   &limits.ReadBPS,
+		paramWriteBPS:  &limits.WriteBPS,
+	} {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be non-negative integer, but %q given", key, value)
+		}
+		*limit = parsed
+	}
+
+	if !limits.IsEmpty() {
+		metadata.IOLimits = limits
+	}
+
+	ownership := &volumes.Ownership{}
+	for key, id := range map[string]**int{
+		paramUID: &ownership.UID,
+		paramGID: &ownership.GID,
+	} {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+
+		parsed, err := strconv.ParseUint(value, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("%s must be non-negative integer, but %q given", key, value)
+		}
+		parsedInt := int(parsed)
+		*id = &parsedInt
+	}
+
+	if value, ok := parameters[paramMode]; ok {
+		mode, err := strconv.ParseUint(value, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return nil, fmt.Errorf("%s must be octal permissions, e.g. 0775, but %q given", paramMode, value)
+		}
+		ownership.Mode = os.FileMode(mode)
+	}
+
+	if value, ok := parameters[paramOwnershipChangePolicy]; ok {
+		if value != volumes.OwnershipChangeAlways && value != volumes.OwnershipChangeOnRootMismatch {
+			return nil, fmt.Errorf("%s must be %s or %s, but %q given", paramOwnershipChangePolicy,
+				volumes.OwnershipChangeAlways, volumes.OwnershipChangeOnRootMismatch, value)
+		}
+		ownership.ChangePolicy = value
+	}
+
+	if !ownership.IsEmpty() {
+		metadata.Ownership = ownership
+	}
+
+	return metadata, nil
+}
+
 // calculateVolumeSize returns storage size in bytes from the given capacity range.
+// Zero required or limit bytes mean unset, negative values are rejected.
+// When only limit is set, volume is provisioned at the limit, or at default size capped by the limit
+// if LimitOnlyDefaultSize option is set. Without required and limit bytes volume gets default size
 func (p *Plugin) calculateVolumeSize(capRange *csi.CapacityRange) (int64, error) {
 	if capRange == nil {
 		return defaultVolumeSize, nil
@@ -212,6 +484,14 @@ func (p *Plugin) calculateVolumeSize(capRange *csi.CapacityRange) (int64, error)
 	limit := capRange.LimitBytes
 	limitSet := 0 < limit
 
+	if required < 0 {
+		return 0, fmt.Errorf("required (%d) can't be negative", required)
+	}
+
+	if limit < 0 {
+		return 0, fmt.Errorf("limit (%d) can't be negative", limit)
+	}
+
 	if !requiredSet && !limitSet {
 		return defaultVolumeSize, nil
 	}
@@ -240,6 +520,13 @@ func (p *Plugin) calculateVolumeSize(capRange *csi.CapacityRange) (int64, error)
 		return limit, nil
 	}
 
+	if limitSet && !requiredSet && p.opts.LimitOnlyDefaultSize {
+		if defaultVolumeSize < limit {
+			return defaultVolumeSize, nil
+		}
+		return limit, nil
+	}
+
 	if limitSet {
 		return limit, nil
 	}
@@ -250,3 +537,12 @@ func (p *Plugin) calculateVolumeSize(capRange *csi.CapacityRange) (int64, error)
 
 	return defaultVolumeSize, nil
 }
+
+// calculateCreateVolumeSize returns size of created volume like calculateVolumeSize, but fails without requested size
+// if RequireExplicitSize option is set. Expand can omit capacity range, so it isn't checked there
+func (p *Plugin) calculateCreateVolumeSize(capRange *csi.CapacityRange) (int64, error) {
+	if p.opts.RequireExplicitSize && capRange.GetRequiredBytes() == 0 && capRange.GetLimitBytes() == 0 {
+		return 0, fmt.Errorf("size must be requested with required or limit bytes")
+	}
+	return p.calculateVolumeSize(capRange)
+}
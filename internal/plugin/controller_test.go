@@ -0,0 +1,172 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+)
+
+func TestCalculateVolumeSize(t *testing.T) {
+	tests := []struct {
+		name                 string
+		capRange             *csi.CapacityRange
+		limitOnlyDefaultSize bool
+		want                 int64
+		wantErr              bool
+	}{
+		{name: "nil range", capRange: nil, want: defaultVolumeSize},
+		{name: "empty range", capRange: &csi.CapacityRange{}, want: defaultVolumeSize},
+		{name: "negative required", capRange: &csi.CapacityRange{RequiredBytes: -1}, wantErr: true},
+		{name: "negative limit", capRange: &csi.CapacityRange{LimitBytes: -1}, wantErr: true},
+		{name: "required only", capRange: &csi.CapacityRange{RequiredBytes: 2 * Gb}, want: 2 * Gb},
+		{name: "required below minimum", capRange: &csi.CapacityRange{RequiredBytes: minimumVolumeSize - 1}, wantErr: true},
+		{name: "required above maximum", capRange: &csi.CapacityRange{RequiredBytes: maximumVolumeSize + 1}, wantErr: true},
+		{name: "limit only", capRange: &csi.CapacityRange{LimitBytes: 3 * Gb}, want: 3 * Gb},
+		{name: "limit below minimum", capRange: &csi.CapacityRange{LimitBytes: minimumVolumeSize - 1}, wantErr: true},
+		{name: "limit above maximum", capRange: &csi.CapacityRange{LimitBytes: maximumVolumeSize + 1}, wantErr: true},
+		{name: "limit only default size", capRange: &csi.CapacityRange{LimitBytes: 3 * Gb}, limitOnlyDefaultSize: true, want: defaultVolumeSize},
+		{name: "limit only default size capped", capRange: &csi.CapacityRange{LimitBytes: defaultVolumeSize}, limitOnlyDefaultSize: true, want: defaultVolumeSize},
+		{name: "required equals limit", capRange: &csi.CapacityRange{RequiredBytes: 2 * Gb, LimitBytes: 2 * Gb}, want: 2 * Gb},
+		{name: "required below limit provisions limit", capRange: &csi.CapacityRange{RequiredBytes: 2 * Gb, LimitBytes: 4 * Gb}, want: 4 * Gb},
+		{name: "required above limit", capRange: &csi.CapacityRange{RequiredBytes: 4 * Gb, LimitBytes: 2 * Gb}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plugin{opts: Options{LimitOnlyDefaultSize: tt.limitOnlyDefaultSize}}
+
+			got, err := p.calculateVolumeSize(tt.capRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("calculateVolumeSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("calculateVolumeSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateCreateVolumeSize(t *testing.T) {
+	tests := []struct {
+		name                string
+		capRange            *csi.CapacityRange
+		requireExplicitSize bool
+		want                int64
+		wantErr             bool
+	}{
+		{name: "nil range default size", capRange: nil, want: defaultVolumeSize},
+		{name: "nil range explicit size required", capRange: nil, requireExplicitSize: true, wantErr: true},
+		{name: "empty range explicit size required", capRange: &csi.CapacityRange{}, requireExplicitSize: true, wantErr: true},
+		{name: "required with explicit size required", capRange: &csi.CapacityRange{RequiredBytes: 2 * Gb}, requireExplicitSize: true, want: 2 * Gb},
+		{name: "limit with explicit size required", capRange: &csi.CapacityRange{LimitBytes: 2 * Gb}, requireExplicitSize: true, want: 2 * Gb},
+		{name: "invalid range with explicit size required", capRange: &csi.CapacityRange{RequiredBytes: 4 * Gb, LimitBytes: 2 * Gb}, requireExplicitSize: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plugin{opts: Options{RequireExplicitSize: tt.requireExplicitSize}}
+
+			got, err := p.calculateCreateVolumeSize(tt.capRange)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("calculateCreateVolumeSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("calculateCreateVolumeSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCalculateVolumeSizeIgnoresRequireExplicitSize(t *testing.T) {
+	// expand calls may omit capacity range
+	p := &Plugin{opts: Options{RequireExplicitSize: true}}
+
+	got, err := p.calculateVolumeSize(nil)
+	if err != nil {
+		t.Fatalf("calculateVolumeSize() error = %v", err)
+	}
+	if got != defaultVolumeSize {
+		t.Errorf("calculateVolumeSize() = %d, want %d", got, defaultVolumeSize)
+	}
+}
+
+func TestCheckExpandLimit(t *testing.T) {
+	tests := []struct {
+		name       string
+		limitBytes int64
+		newSize    int64
+		wantCode   codes.Code
+	}{
+		{name: "no limit", newSize: 10 * Gb, wantCode: codes.OK},
+		{name: "within limit", limitBytes: 4 * Gb, newSize: 2 * Gb, wantCode: codes.OK},
+		{name: "up to limit", limitBytes: 4 * Gb, newSize: 4 * Gb, wantCode: codes.OK},
+		{name: "beyond limit", limitBytes: 4 * Gb, newSize: 4*Gb + 1, wantCode: codes.OutOfRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, _ := newTestPlugin(Options{})
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.SaveMetadata(ctx, "vol1", &volumes.VolumeMetadata{LimitBytes: tt.limitBytes}); err != nil {
+				t.Fatal(err)
+			}
+
+			err := p.checkExpandLimit(ctx, "NodeExpandVolume", "vol1", tt.newSize)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("checkExpandLimit() error = %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestDeleteVolumeWhileCompacting(t *testing.T) {
+	ctx := context.Background()
+	p, vc, _ := newTestPlugin(Options{})
+
+	if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+		t.Fatal(err)
+	}
+	if !p.startCompaction("vol1") {
+		t.Fatal("startCompaction() = false, want true")
+	}
+
+	_, err := p.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol1"})
+	if code := status.Code(err); code != codes.Aborted {
+		t.Fatalf("DeleteVolume() error = %v, want code %s", err, codes.Aborted)
+	}
+	if _, err := vc.GetVolumeSize(ctx, "vol1"); err != nil {
+		t.Fatalf("volume being compacted was deleted: %v", err)
+	}
+
+	p.finishCompaction("vol1")
+
+	if _, err := p.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: "vol1"}); err != nil {
+		t.Fatalf("DeleteVolume() error = %v", err)
+	}
+	if p.isCompacting("vol1") {
+		t.Errorf("deleted volume is still marked as being compacted")
+	}
+}
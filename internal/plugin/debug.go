@@ -0,0 +1,86 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// debugVolume volume state returned by debug endpoint
+type debugVolume struct {
+	// VolumeId .
+	VolumeId string `json:"volumeId"`
+	// SizeBytes logical (apparent) size of volume image
+	SizeBytes int64 `json:"sizeBytes"`
+	// AllocatedBytes actually allocated size of volume image
+	AllocatedBytes int64 `json:"allocatedBytes"`
+	// Device attached loop device
+	Device string `json:"device,omitempty"`
+	// StagingPath staging path if volume was staged by this instance
+	StagingPath string `json:"stagingPath,omitempty"`
+	// Mounted true if staging path is mounted
+	Mounted bool `json:"mounted"`
+	// Error error of volume state collection
+	Error string `json:"error,omitempty"`
+}
+
+// VolumesHandler returns read-only http handler listing volumes with their disk usage, device and mount state
+func (p *Plugin) VolumesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		ctx := r.Context()
+		volumeIds, err := p.volumeController.ListVolumeIds(ctx)
+		if err != nil {
+			p.logger.Error("Debug endpoint error list volumes", zap.Error(err))
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		staged := p.getStagedVolumes()
+		result := make([]debugVolume, 0, len(volumeIds))
+		for _, volumeId := range volumeIds {
+			v := debugVolume{
+				VolumeId:    volumeId,
+				StagingPath: staged[volumeId],
+			}
+
+			v.SizeBytes, v.AllocatedBytes, err = p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+			if err == nil {
+				v.Device, err = p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+			}
+			if err == nil && v.StagingPath != "" {
+				v.Mounted, err = p.mounter.IsMounted(ctx, v.StagingPath)
+			}
+			if err != nil {
+				v.Error = err.Error()
+			}
+
+			result = append(result, v)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(result); err != nil {
+			p.logger.Error("Debug endpoint error write response", zap.Error(err))
+		}
+	})
+}
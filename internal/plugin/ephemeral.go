@@ -0,0 +1,250 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"strconv"
+	"strings"
+)
+
+// sizeSuffixes multipliers of ephemeral volume size suffixes
+var sizeSuffixes = map[string]int64{
+	"Ki": Kb,
+	"Mi": Mb,
+	"Gi": Gb,
+	"Ti": 1024 * Gb,
+}
+
+// isEphemeral returns true if publish request is for inline ephemeral volume of pod
+func isEphemeral(request *csi.NodePublishVolumeRequest) bool {
+	return request.VolumeContext[contextEphemeral] == "true"
+}
+
+// checkEphemeralAttributes returns error if volume attributes of pod spec have driver attributes other than size.
+// Pod authors can't be trusted with storage class parameters, e.g. pool or ownership, so they aren't supported
+func checkEphemeralAttributes(volumeContext map[string]string) error {
+	for key := range volumeContext {
+		if strings.HasPrefix(key, attributePrefix) && key != contextSize {
+			return fmt.Errorf("%s attribute isn't supported by inline ephemeral volumes, only %s is", key, contextSize)
+		}
+	}
+	return nil
+}
+
+// parseEphemeralSize returns size of inline ephemeral volume from volume attribute, default size if not set
+// unless explicit size is required
+func (p *Plugin) parseEphemeralSize(value string) (int64, error) {
+	if value == "" {
+		if p.opts.RequireExplicitSize {
+			return 0, fmt.Errorf("%s must be set, since explicit size is required", contextSize)
+		}
+		return p.calculateVolumeSize(nil)
+	}
+
+	number, multiplier := value, int64(1)
+	for suffix, m := range sizeSuffixes {
+		if strings.HasSuffix(value, suffix) {
+			number, multiplier = strings.TrimSuffix(value, suffix), m
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 || size > maximumVolumeSize/multiplier {
+		return 0, fmt.Errorf("%s must be positive integer with optional Ki, Mi, Gi or Ti suffix, but %q given", contextSize, value)
+	}
+
+	return p.calculateVolumeSize(&csi.CapacityRange{RequiredBytes: size * multiplier})
+}
+
+// publishEphemeralVolume creates inline ephemeral volume, formats and attaches it and mounts device directly to target.
+// Kubelet neither calls controller nor stages ephemeral volumes, so publish does all their work
+func (p *Plugin) publishEphemeralVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	volumeId := request.VolumeId
+	target := request.TargetPath
+
+	if p.inMaintenance() {
+		return nil, status.Errorf(codes.Unavailable, "NodePublishVolume (%s) node storage is in maintenance mode", volumeId)
+	}
+
+	mnt := request.VolumeCapability.GetMount()
+
+	size, err := p.parseEphemeralSize(request.VolumeContext[contextSize])
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: VolumeContext: %v", volumeId, err)
+	}
+
+	if err := checkEphemeralAttributes(request.VolumeContext); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: VolumeContext: %v", volumeId, err)
+	}
+
+	metadata := &volumes.VolumeMetadata{
+		Ephemeral: true,
+		FsType:    mnt.FsType,
+	}
+
+	fsType := mnt.FsType
+	if fsType == "" {
+		fsType = defaultFsType
+	}
+
+	groupOptions, err := mountGroupOptions(fsType, mnt.VolumeMountGroup)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: VolumeMountGroup: %v", volumeId, err)
+	}
+
+	mountOptions, readOnly, err := normalizeMountOptions(append(append([]string{}, mnt.MountFlags...), groupOptions...), request.Readonly)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: MountFlags: %v", volumeId, err)
+	}
+
+	reserved, err := p.reserveVolume(ctx, volumeId)
+	if err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, status.Errorf(codes.ResourceExhausted, "NodePublishVolume (%s) %s", volumeId, status.Convert(err).Message())
+		}
+		return nil, fmt.Errorf("NodePublishVolume (%s) error count node volumes: %w", volumeId, err)
+	}
+
+	created, err := p.createImage(ctx, volumeId, metadata, size)
+	if err != nil {
+		if reserved {
+			p.releaseVolume(volumeId)
+		}
+		return nil, fmt.Errorf("NodePublishVolume (%s) error create ephemeral volume: %w", volumeId, err)
+	}
+
+	if err := p.setupEphemeralVolume(ctx, volumeId, target, fsType, mountOptions, metadata); err != nil {
+		// volume created by this call is useless without mount, so retry starts from scratch. Existing one could be
+		// already published by previous call, so it's left for unpublish
+		if !created {
+			return nil, fmt.Errorf("NodePublishVolume (%s) %w", volumeId, err)
+		}
+
+		if teardownErr := p.teardownEphemeralVolume(ctx, volumeId); teardownErr != nil {
+			p.logger.Error("NodePublishVolume error delete ephemeral volume after failed publish",
+				zap.String("volume_id", volumeId),
+				zap.Error(teardownErr),
+			)
+		}
+		return nil, fmt.Errorf("NodePublishVolume (%s) %w", volumeId, err)
+	}
+
+	p.trackStagedVolume(volumeId, target, readOnly)
+
+	if !readOnly {
+		ownership, err := mountGroupOwnership(metadata.Ownership, fsType, mnt.VolumeMountGroup)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: VolumeMountGroup: %v", volumeId, err)
+		}
+
+		if err := p.volumeController.ApplyOwnership(ctx, target, ownership); err != nil {
+			return nil, fmt.Errorf("NodePublishVolume (%s) error apply volume ownership: %w", volumeId, err)
+		}
+	}
+
+	p.logger.Info("NodePublishVolume ephemeral volume was created and mounted to target path",
+		zap.String("volume_id", volumeId),
+		zap.Int64("size_bytes", size),
+	)
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// setupEphemeralVolume saves metadata of created ephemeral volume, formats, attaches and mounts it to target
+func (p *Plugin) setupEphemeralVolume(ctx context.Context, volumeId string, target string, fsType string, mountOptions []string, metadata *volumes.VolumeMetadata) error {
+	if err := p.volumeController.SaveMetadata(ctx, volumeId, metadata); err != nil {
+		return fmt.Errorf("error save volume metadata: %w", err)
+	}
+
+	if !metadata.SkipFormat {
+		if err := p.formatVolume(ctx, volumeId, metadata.Pool, fsType); err != nil {
+			return fmt.Errorf("error format volume device: %w", err)
+		}
+	}
+
+	dev, err := p.attachDevice(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error attach device: %w", err)
+	}
+
+	if !metadata.IOLimits.IsEmpty() {
+		if err := p.volumeController.ApplyIOLimits(ctx, dev, metadata.IOLimits); err != nil {
+			return fmt.Errorf("error apply io limits: %w", err)
+		}
+	}
+
+	if err := p.volumeController.TuneDevice(ctx, dev, metadata.DeviceTuning); err != nil {
+		return fmt.Errorf("error tune device: %w", err)
+	}
+
+	if err := p.mounter.Mount(ctx, dev, target, mountOptions); err != nil {
+		return fmt.Errorf("error mount target: %w", err)
+	}
+
+	return nil
+}
+
+// unpublishEphemeralVolume deletes unmounted volume if it's inline ephemeral one
+func (p *Plugin) unpublishEphemeralVolume(ctx context.Context, volumeId string) error {
+	metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+	if err != nil {
+		// ephemeral volume could be deleted by previous call already
+		if errors.Is(err, volumes.ErrorVolumeNotFound) {
+			return nil
+		}
+		return fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	if !metadata.Ephemeral {
+		return nil
+	}
+
+	if err := p.teardownEphemeralVolume(ctx, volumeId); err != nil {
+		return err
+	}
+
+	p.logger.Info("Ephemeral volume was deleted", zap.String("volume_id", volumeId))
+	return nil
+}
+
+// teardownEphemeralVolume detaches device of unmounted ephemeral volume and deletes it
+func (p *Plugin) teardownEphemeralVolume(ctx context.Context, volumeId string) error {
+	p.untrackStagedVolume(volumeId)
+
+	if err := p.removeIOLimits(ctx, volumeId); err != nil {
+		return fmt.Errorf("error remove io limits: %w", err)
+	}
+
+	if err := p.detachDevice(ctx, volumeId); err != nil {
+		return fmt.Errorf("error detach device: %w", err)
+	}
+
+	if err := p.volumeController.Delete(ctx, volumeId); err != nil && !errors.Is(err, volumes.ErrorVolumeNotFound) {
+		return fmt.Errorf("error delete volume: %w", err)
+	}
+	p.releaseVolume(volumeId)
+
+	return nil
+}
@@ -0,0 +1,205 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// ephemeralPublishRequest returns publish request of inline ephemeral volume with given attributes
+func ephemeralPublishRequest(volumeId string, target string, attributes map[string]string) *csi.NodePublishVolumeRequest {
+	volumeContext := map[string]string{
+		contextEphemeral:               "true",
+		"csi.storage.k8s.io/pod.name":  "pod1",
+		"csi.storage.k8s.io/pod.uid":   "6f0b7c1e",
+		"csi.storage.k8s.io/namespace": "default",
+	}
+	for key, value := range attributes {
+		volumeContext[key] = value
+	}
+
+	return &csi.NodePublishVolumeRequest{
+		VolumeId:   volumeId,
+		TargetPath: target,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: volumeContext,
+	}
+}
+
+func TestParseEphemeralSize(t *testing.T) {
+	tests := []struct {
+		name                string
+		value               string
+		requireExplicitSize bool
+		want                int64
+		wantErr             bool
+	}{
+		{name: "default size", value: "", want: defaultVolumeSize},
+		{name: "explicit size required", value: "", requireExplicitSize: true, wantErr: true},
+		{name: "bytes", value: "2147483648", want: 2 * Gb},
+		{name: "mebibytes", value: "3072Mi", want: 3 * Gb},
+		{name: "gibibytes", value: "5Gi", want: 5 * Gb},
+		{name: "below minimum", value: "512Mi", wantErr: true},
+		{name: "above maximum", value: "1Ti", wantErr: true},
+		{name: "zero", value: "0Gi", wantErr: true},
+		{name: "negative", value: "-1Gi", wantErr: true},
+		{name: "unknown suffix", value: "5G", wantErr: true},
+		{name: "overflow", value: "9223372036854775807Ti", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &Plugin{opts: Options{RequireExplicitSize: tt.requireExplicitSize}}
+
+			got, err := p.parseEphemeralSize(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseEphemeralSize() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseEphemeralSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEphemeralVolumePublishUnpublish(t *testing.T) {
+	tests := []struct {
+		name       string
+		attributes map[string]string
+		wantCode   codes.Code
+		wantSize   int64
+	}{
+		{name: "default size", wantCode: codes.OK, wantSize: defaultVolumeSize},
+		{name: "given size", attributes: map[string]string{contextSize: "2Gi"}, wantCode: codes.OK, wantSize: 2 * Gb},
+		{name: "invalid size", attributes: map[string]string{contextSize: "2GB"}, wantCode: codes.InvalidArgument},
+		{name: "storage class parameter", attributes: map[string]string{paramPool: "fast"}, wantCode: codes.InvalidArgument},
+		{name: "ownership parameter", attributes: map[string]string{paramUID: "0"}, wantCode: codes.InvalidArgument},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			target := filepath.Join(t.TempDir(), "target")
+
+			_, err := p.NodePublishVolume(ctx, ephemeralPublishRequest("csi-eph1", target, tt.attributes))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodePublishVolume() error = %v, want code %s", err, tt.wantCode)
+			}
+
+			if tt.wantCode != codes.OK {
+				if _, err := vc.GetVolumeSize(ctx, "csi-eph1"); err == nil {
+					t.Errorf("volume of rejected publish was created")
+				}
+				return
+			}
+
+			size, err := vc.GetVolumeSize(ctx, "csi-eph1")
+			if err != nil {
+				t.Fatalf("GetVolumeSize() error = %v", err)
+			}
+			if size != tt.wantSize {
+				t.Errorf("volume size = %d, want %d", size, tt.wantSize)
+			}
+
+			metadata, err := vc.GetMetadata(ctx, "csi-eph1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !metadata.Ephemeral {
+				t.Errorf("volume metadata isn't ephemeral")
+			}
+
+			source, err := mounter.GetMountSource(ctx, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dev, err := vc.GetDeviceByVolumeId(ctx, "csi-eph1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if source == "" || source != dev {
+				t.Errorf("target is mounted from %q, want volume device %q", source, dev)
+			}
+
+			if _, err := p.NodeUnpublishVolume(ctx, &csi.NodeUnpublishVolumeRequest{VolumeId: "csi-eph1", TargetPath: target}); err != nil {
+				t.Fatalf("NodeUnpublishVolume() error = %v", err)
+			}
+
+			mounted, err := mounter.IsMounted(ctx, target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mounted {
+				t.Errorf("target is still mounted")
+			}
+			if _, err := vc.GetVolumeSize(ctx, "csi-eph1"); err == nil {
+				t.Errorf("ephemeral volume wasn't deleted on unpublish")
+			}
+		})
+	}
+}
+
+func TestEphemeralVolumeFailedPublish(t *testing.T) {
+	tests := []struct {
+		name string
+		// existing volume is created before publish, e.g. by previous publish call
+		existing  bool
+		wantExist bool
+	}{
+		{name: "volume created by failed call is deleted"},
+		{name: "existing volume is kept", existing: true, wantExist: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, _ := newTestPlugin(Options{})
+
+			// target under regular file can't be created, so mount fails after volume is created and attached
+			file := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(file, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			target := filepath.Join(file, "target")
+
+			if tt.existing {
+				if _, err := vc.Create(ctx, "csi-eph1", "", defaultVolumeSize); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := p.NodePublishVolume(ctx, ephemeralPublishRequest("csi-eph1", target, nil)); err == nil {
+				t.Fatalf("NodePublishVolume() error = nil, want mount error")
+			}
+
+			_, err := vc.GetVolumeSize(ctx, "csi-eph1")
+			if exists := err == nil; exists != tt.wantExist {
+				t.Errorf("volume exists = %t, want %t", exists, tt.wantExist)
+			}
+		})
+	}
+}
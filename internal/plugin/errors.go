@@ -0,0 +1,83 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// errorCodes grpc codes of domain errors, checked in order
+var errorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{volumes.ErrorVolumeNotFound, codes.NotFound},
+	{volumes.ErrorVolumeAlreadyExists, codes.AlreadyExists},
+	{volumes.ErrorVolumeInUse, codes.FailedPrecondition},
+	{volumes.ErrorNoFreeLoopDevice, codes.ResourceExhausted},
+	{volumes.ErrorDeviceBusy, codes.Unavailable},
+	{volumes.ErrorInsufficientCapacity, codes.ResourceExhausted},
+	{volumes.ErrorFilesystemCorrupted, codes.FailedPrecondition},
+	{volumes.ErrorPoolNotFound, codes.InvalidArgument},
+	{volumes.ErrorTemplateNotFound, codes.InvalidArgument},
+	{volumes.ErrorTemplateTooLarge, codes.OutOfRange},
+	{volumes.ErrorTemplateFsMismatch, codes.InvalidArgument},
+	{context.DeadlineExceeded, codes.DeadlineExceeded},
+	{context.Canceled, codes.Canceled},
+}
+
+// toStatusError converts handler error to grpc status error. Status errors are returned as is,
+// wrapped domain errors get their grpc code and other errors are Internal
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	for _, e := range errorCodes {
+		if errors.Is(err, e.err) {
+			return status.Error(e.code, err.Error())
+		}
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// errorKind returns kind of volumes error for metrics: filesystem, capacity, command or other
+func errorKind(err error) string {
+	var fsErr *volumes.FilesystemError
+	var capacityErr *volumes.CapacityError
+	var cmdErr *volumes.CommandError
+
+	switch {
+	case errors.As(err, &fsErr):
+		return "filesystem"
+	case errors.As(err, &capacityErr):
+		return "capacity"
+	case errors.As(err, &cmdErr):
+		return "command"
+	default:
+		return "other"
+	}
+}
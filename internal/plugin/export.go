@@ -0,0 +1,81 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"net/http"
+)
+
+// ExportHandler returns http handler exporting volume image over nbd on POST and stopping export on DELETE.
+// Volume is passed with volume_id query parameter. Request must have admin token, since export gives full volume content
+func (p *Plugin) ExportHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isAuthorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		volumeId := r.URL.Query().Get("volume_id")
+		if volumeId == "" {
+			http.Error(w, "volume_id is required", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodPost:
+			export, err := p.volumeController.ExportVolume(r.Context(), volumeId)
+			if err != nil {
+				p.logger.Error("Export endpoint error export volume", zap.String("volume_id", volumeId), zap.Error(err))
+				http.Error(w, err.Error(), exportErrorStatus(err))
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			if err := json.NewEncoder(w).Encode(export); err != nil {
+				p.logger.Error("Export endpoint error write response", zap.Error(err))
+			}
+		case http.MethodDelete:
+			if err := p.volumeController.UnexportVolume(r.Context(), volumeId); err != nil {
+				p.logger.Error("Export endpoint error unexport volume", zap.String("volume_id", volumeId), zap.Error(err))
+				http.Error(w, err.Error(), exportErrorStatus(err))
+				return
+			}
+
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// exportErrorStatus returns http status of export error
+func exportErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, volumes.ErrorVolumeNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, volumes.ErrorExportDisabled):
+		return http.StatusForbidden
+	case errors.Is(err, volumes.ErrorNoFreeNbdPort):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"go.uber.org/zap"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// cleanupStep result of single force cleanup step
+type cleanupStep struct {
+	// Step step name
+	Step string `json:"step"`
+	// Target mount point or device step was applied to
+	Target string `json:"target,omitempty"`
+	// Error step error, empty on success
+	Error string `json:"error,omitempty"`
+}
+
+// ForceCleanupHandler returns http handler releasing stuck volume on POST: it lazily unmounts every mount of volume
+// device, detaches the device and optionally checks image filesystem with fsck=true query parameter.
+// Volume is passed with volume_id query parameter, request must have "Authorization: Bearer <token>" header
+func (p *Plugin) ForceCleanupHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !isAuthorized(r, token) {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		volumeId := r.URL.Query().Get("volume_id")
+		if volumeId == "" {
+			http.Error(w, "volume_id is required", http.StatusBadRequest)
+			return
+		}
+
+		fsck := false
+		if value := r.URL.Query().Get("fsck"); value != "" {
+			var err error
+			if fsck, err = strconv.ParseBool(value); err != nil {
+				http.Error(w, "fsck must be boolean", http.StatusBadRequest)
+				return
+			}
+		}
+
+		steps, ok := p.forceCleanup(r.Context(), volumeId, fsck)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if err := json.NewEncoder(w).Encode(steps); err != nil {
+			p.logger.Error("Force cleanup endpoint error write response", zap.Error(err))
+		}
+	})
+}
+
+// forceCleanup lazily unmounts all mounts of volume device, detaches it and optionally repairs image filesystem.
+// Every step is tried and logged. Returns results of steps and true if all of them succeeded
+func (p *Plugin) forceCleanup(ctx context.Context, volumeId string, fsck bool) ([]cleanupStep, bool) {
+	p.logger.Warn("Force cleanup of volume started", zap.String("volume_id", volumeId), zap.Bool("fsck", fsck))
+
+	steps := make([]cleanupStep, 0)
+	ok := true
+	record := func(step string, target string, err error) {
+		s := cleanupStep{Step: step, Target: target}
+		if err != nil {
+			ok = false
+			s.Error = err.Error()
+			p.logger.Error("Force cleanup step failed", zap.String("volume_id", volumeId), zap.String("step", step), zap.String("target", target), zap.Error(err))
+		} else {
+			p.logger.Warn("Force cleanup step done", zap.String("volume_id", volumeId), zap.String("step", step), zap.String("target", target))
+		}
+		steps = append(steps, s)
+	}
+
+	dev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		record("find_device", "", err)
+		return steps, false
+	}
+
+	targets := make([]string, 0)
+	if stagingPath := p.getStagedVolumes()[volumeId]; stagingPath != "" {
+		targets = append(targets, stagingPath)
+	}
+	if dev != "" {
+		refs, err := p.mounter.GetMountRefs(ctx, dev)
+		record("find_mounts", dev, err)
+		targets = append(targets, refs...)
+	}
+
+	// nested mounts go first
+	sort.Sort(sort.Reverse(sort.StringSlice(targets)))
+	seen := make(map[string]bool, len(targets))
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		record("unmount", target, p.mounter.UnmountLazy(ctx, target))
+	}
+	p.untrackStagedVolume(volumeId)
+
+	detachErr := p.detachDevice(ctx, volumeId)
+	record("detach", dev, detachErr)
+
+	if fsck && detachErr == nil {
+		record("fsck", volumeId, p.volumeController.RepairImageFileSystem(ctx, volumeId))
+	}
+
+	p.logger.Warn("Force cleanup of volume finished", zap.String("volume_id", volumeId), zap.Bool("ok", ok))
+	return steps, ok
+}
+
+// isAuthorized returns true if request has "Authorization: Bearer <token>" header with admin token
+func isAuthorized(r *http.Request, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+token)) == 1
+}
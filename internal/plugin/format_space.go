@@ -0,0 +1,76 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+)
+
+// formatSpaceEstimate returns approximate space mkfs allocates in sparse image of given size
+func formatSpaceEstimate(sizeBytes int64) int64 {
+	estimate := sizeBytes / formatSpaceRatio
+	if estimate < minimumFormatSpace {
+		estimate = minimumFormatSpace
+	}
+	if estimate > sizeBytes {
+		estimate = sizeBytes
+	}
+	return estimate
+}
+
+// checkFormatSpace returns CapacityError if storage of unformatted volume has less free space than mkfs needs,
+// so full node fails fast instead of with ENOSPC of mkfs. Space already allocated in image, e.g. preallocated, counts
+func (p *Plugin) checkFormatSpace(ctx context.Context, volumeId string, pool string) error {
+	currentFsType, err := p.volumeController.GetFilesystemType(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get volume filesystem: %w", err)
+	}
+
+	// formatted volume is mounted as is
+	if currentFsType != "" {
+		return nil
+	}
+
+	size, allocated, err := p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get volume disk usage: %w", err)
+	}
+
+	needed := formatSpaceEstimate(size) - allocated
+	if needed <= 0 {
+		return nil
+	}
+
+	available, err := p.volumeController.GetCapacity(ctx, pool)
+	if err != nil {
+		return fmt.Errorf("error get storage capacity: %w", err)
+	}
+
+	if needed > available {
+		p.logger.Warn("Node storage is out of space to format volume",
+			zap.String("volume_id", volumeId),
+			zap.Int64("needed_bytes", needed),
+			zap.Int64("available_bytes", available),
+		)
+		return fmt.Errorf("node storage is out of space to format volume: %w", &volumes.CapacityError{Requested: needed, Available: available})
+	}
+
+	return nil
+}
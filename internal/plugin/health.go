@@ -0,0 +1,46 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// healthServer grpc health service reporting storage self-check and maintenance mode
+type healthServer struct {
+	grpc_health_v1.UnimplementedHealthServer
+	// plugin .
+	plugin *Plugin
+}
+
+// Check returns SERVING if storage is accessible and plugin isn't in maintenance mode. Service name is ignored
+func (h *healthServer) Check(ctx context.Context, _ *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	h.plugin.logger.Debug("Health Check called")
+
+	if h.plugin.inMaintenance() {
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+	}
+
+	if err := h.plugin.checkStorage(ctx); err != nil {
+		h.plugin.logger.Warn("Health check failed", zap.Error(err))
+		return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_NOT_SERVING}, nil
+	}
+
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
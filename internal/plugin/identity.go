@@ -59,6 +59,13 @@ func (p *Plugin) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabi
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_VolumeExpansion_{
+					VolumeExpansion: &csi.PluginCapability_VolumeExpansion{
+						Type: csi.PluginCapability_VolumeExpansion_OFFLINE,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -67,9 +74,12 @@ func (p *Plugin) GetPluginCapabilities(_ context.Context, _ *csi.GetPluginCapabi
 func (p *Plugin) Probe(_ context.Context, _ *csi.ProbeRequest) (*csi.ProbeResponse, error) {
 	p.logger.Debug("Probe called")
 
+	// new volumes can't be staged once loop devices are exhausted
+	loopDevicesExhausted := p.opts.LoopDevicesProbeFail && p.loopDevicesExhausted.Load()
+
 	return &csi.ProbeResponse{
 		Ready: &wrappers.BoolValue{
-			Value: true,
+			Value: !p.inMaintenance() && !loopDevicesExhausted,
 		},
 	}, nil
 }
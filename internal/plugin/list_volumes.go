@@ -0,0 +1,221 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// defaultListVolumesWorkers count of parallel volume stat calls of ListVolumes when not configured
+	defaultListVolumesWorkers = 8
+)
+
+// ListVolumes returns volumes of this node sorted by id. Next token is the last returned volume id, so pages stay
+// stable when volumes are created or deleted between calls
+func (p *Plugin) ListVolumes(ctx context.Context, request *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	p.logger.Debug("ListVolumes called",
+		zap.Int32("max_entries", request.MaxEntries),
+		zap.String("starting_token", request.StartingToken),
+	)
+
+	if request.MaxEntries < 0 {
+		return nil, status.Error(codes.InvalidArgument, "ListVolumes invalid argument: MaxEntries can't be negative")
+	}
+
+	volumeIds, err := p.volumeController.ListVolumeIds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("ListVolumes error list volumes: %w", err)
+	}
+
+	start := 0
+	if request.StartingToken != "" {
+		start = sort.Search(len(volumeIds), func(i int) bool {
+			return volumeIds[i] > request.StartingToken
+		})
+	}
+
+	end := len(volumeIds)
+	if request.MaxEntries > 0 && start+int(request.MaxEntries) < end {
+		end = start + int(request.MaxEntries)
+	}
+
+	entries, err := p.gatherVolumes(ctx, volumeIds[start:end])
+	if err != nil {
+		p.logger.Error("ListVolumes volumes were gathered partially",
+			zap.Int("gathered", len(entries)),
+			zap.Int("requested", end-start),
+			zap.Error(err),
+		)
+		return nil, fmt.Errorf("ListVolumes error gather volumes: %w", err)
+	}
+
+	nextToken := ""
+	if end < len(volumeIds) {
+		nextToken = volumeIds[end-1]
+	}
+
+	return &csi.ListVolumesResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+// gatherVolumes returns entries of given volumes in the same order, stating volumes with bounded count of workers.
+// Volumes deleted meanwhile are skipped. Returns entries gathered so far and error if context is done mid-scan
+func (p *Plugin) gatherVolumes(ctx context.Context, volumeIds []string) ([]*csi.ListVolumesResponse_Entry, error) {
+	workers := p.opts.ListVolumesWorkers
+	if workers <= 0 {
+		workers = defaultListVolumesWorkers
+	}
+
+	gathered := make([]*csi.ListVolumesResponse_Entry, len(volumeIds))
+	errs := make([]error, len(volumeIds))
+
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				gathered[index], errs[index] = p.getVolumeEntry(ctx, volumeIds[index])
+			}
+		}()
+	}
+
+	var ctxErr error
+	for index := range volumeIds {
+		select {
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+		case indexes <- index:
+		}
+
+		if ctxErr != nil {
+			break
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	// entries are collected by index, so order is stable regardless of workers scheduling
+	entries := make([]*csi.ListVolumesResponse_Entry, 0, len(volumeIds))
+	for index, entry := range gathered {
+		if errs[index] != nil {
+			if errors.Is(errs[index], volumes.ErrorVolumeNotFound) {
+				continue
+			}
+			return entries, errs[index]
+		}
+
+		if entry != nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, ctxErr
+}
+
+// ControllerGetVolume returns volume of this node with its apparent and allocated sizes in volume context
+func (p *Plugin) ControllerGetVolume(ctx context.Context, request *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	volumeId := request.VolumeId
+	p.logger.Debug("ControllerGetVolume called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerGetVolume invalid argument: VolumeId")
+	}
+
+	volume, err := p.getVolume(ctx, volumeId)
+	if err != nil {
+		if errors.Is(err, volumes.ErrorVolumeNotFound) {
+			return nil, status.Errorf(codes.NotFound, "ControllerGetVolume (%s) volume not found", volumeId)
+		}
+		return nil, fmt.Errorf("ControllerGetVolume (%s) error get volume: %w", volumeId, err)
+	}
+
+	return &csi.ControllerGetVolumeResponse{
+		Volume: volume,
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{},
+	}, nil
+}
+
+// getVolumeEntry returns ListVolumes entry of volume
+func (p *Plugin) getVolumeEntry(ctx context.Context, volumeId string) (*csi.ListVolumesResponse_Entry, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	volume, err := p.getVolume(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.ListVolumesResponse_Entry{
+		Volume: volume,
+	}, nil
+}
+
+// getVolume returns volume with its logical size as capacity and both apparent and allocated sizes in volume context,
+// so it's visible how much of over-provisioned capacity is really used
+func (p *Plugin) getVolume(ctx context.Context, volumeId string) (*csi.Volume, error) {
+	apparent, allocated, err := p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume (%s) disk usage: %w", volumeId, err)
+	}
+
+	p.logger.Debug("Volume disk usage",
+		zap.String("volume_id", volumeId),
+		zap.Int64("apparent_bytes", apparent),
+		zap.Int64("allocated_bytes", allocated),
+	)
+
+	metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("error get volume (%s) metadata: %w", volumeId, err)
+	}
+
+	volumeContext := map[string]string{}
+	for key, value := range metadata.VolumeContext {
+		volumeContext[key] = value
+	}
+	volumeContext[contextApparentBytes] = strconv.FormatInt(apparent, 10)
+	volumeContext[contextAllocatedBytes] = strconv.FormatInt(allocated, 10)
+
+	return &csi.Volume{
+		VolumeId:      volumeId,
+		CapacityBytes: apparent,
+		VolumeContext: volumeContext,
+		AccessibleTopology: []*csi.Topology{
+			{
+				Segments: map[string]string{
+					p.nodeNameTopologyKey: p.nodeId,
+				},
+			},
+		},
+	}, nil
+}
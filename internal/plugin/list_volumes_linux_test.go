@@ -0,0 +1,51 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"testing"
+)
+
+func BenchmarkListVolumes(b *testing.B) {
+	ctx := context.Background()
+	vc := volumes.NewLinuxSparseFileVolumeController(b.TempDir(), volumes.SparseFileVolumeControllerOptions{}, zap.NewNop())
+	p := NewPlugin("csi-local-sparse.test", "test", "node1", "kubernetes.io/hostname", "unix:///tmp/csi-test.sock", vc, nil, Options{}, zap.NewNop())
+
+	for i := 0; i < 10000; i++ {
+		if _, err := vc.Create(ctx, fmt.Sprintf("vol%05d", i), "", Gb); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response, err := p.ListVolumes(ctx, &csi.ListVolumesRequest{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(response.Entries) != 10000 {
+			b.Fatalf("ListVolumes() returned %d entries, want 10000", len(response.Entries))
+		}
+	}
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// deletedMidScanVolumeController lists volumes which are deleted before they are stated
+type deletedMidScanVolumeController struct {
+	*volumes.FakeVolumeController
+
+	deleted []string
+}
+
+func (d *deletedMidScanVolumeController) ListVolumeIds(ctx context.Context) ([]string, error) {
+	volumeIds, err := d.FakeVolumeController.ListVolumeIds(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	volumeIds = append(volumeIds, d.deleted...)
+	sort.Strings(volumeIds)
+	return volumeIds, nil
+}
+
+// listVolumeIds returns ids of all volumes listed page by page
+func listVolumeIds(t *testing.T, p *Plugin, maxEntries int32, beforePage func(page int)) []string {
+	t.Helper()
+
+	volumeIds := make([]string, 0)
+	token := ""
+	for page := 0; ; page++ {
+		beforePage(page)
+
+		response, err := p.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: maxEntries, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes() page %d error = %v", page, err)
+		}
+
+		for _, entry := range response.Entries {
+			volumeIds = append(volumeIds, entry.Volume.VolumeId)
+		}
+
+		if response.NextToken == "" {
+			return volumeIds
+		}
+		token = response.NextToken
+	}
+}
+
+func TestListVolumesOrder(t *testing.T) {
+	ctx := context.Background()
+	p, vc, _ := newTestPlugin(Options{ListVolumesWorkers: 4})
+
+	for _, volumeId := range []string{"vol5", "vol2", "vol4", "vol1", "vol3"} {
+		if _, err := vc.Create(ctx, volumeId, "", Gb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"vol1", "vol2", "vol3", "vol4", "vol5"}
+	for _, maxEntries := range []int32{0, 1, 2, 5, 10} {
+		got := listVolumeIds(t, p, maxEntries, func(int) {})
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("ListVolumes() with max entries %d = %v, want %v", maxEntries, got, want)
+		}
+	}
+}
+
+func TestListVolumesDeletedBetweenPages(t *testing.T) {
+	ctx := context.Background()
+	p, vc, _ := newTestPlugin(Options{})
+
+	for _, volumeId := range []string{"vol1", "vol2", "vol3", "vol4", "vol5"} {
+		if _, err := vc.Create(ctx, volumeId, "", Gb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// deleting already returned volumes must not shift next pages
+	got := listVolumeIds(t, p, 2, func(page int) {
+		if page != 1 {
+			return
+		}
+		for _, volumeId := range []string{"vol1", "vol2"} {
+			if err := vc.Delete(ctx, volumeId); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+
+	want := []string{"vol1", "vol2", "vol3", "vol4", "vol5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListVolumes() = %v, want %v", got, want)
+	}
+}
+
+func TestListVolumesDeletedMidScan(t *testing.T) {
+	ctx := context.Background()
+	mounter := volumes.NewFakeMounter()
+	fake := volumes.NewFakeVolumeController(100*Gb, mounter)
+	vc := &deletedMidScanVolumeController{FakeVolumeController: fake, deleted: []string{"vol2", "vol4"}}
+	p := NewPlugin("csi-local-sparse.test", "test", "node1", "kubernetes.io/hostname", "unix:///tmp/csi-test.sock", vc, mounter, Options{}, zap.NewNop())
+
+	for _, volumeId := range []string{"vol1", "vol3", "vol5"} {
+		if _, err := vc.Create(ctx, volumeId, "", Gb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got := listVolumeIds(t, p, 2, func(int) {})
+	want := []string{"vol1", "vol3", "vol5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ListVolumes() = %v, want %v", got, want)
+	}
+}
+
+func TestListVolumesDeadlineExceeded(t *testing.T) {
+	p, vc, _ := newTestPlugin(Options{})
+
+	for i := 0; i < 100; i++ {
+		if _, err := vc.Create(context.Background(), fmt.Sprintf("vol%03d", i), "", Gb); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+
+	_, err := p.ListVolumes(ctx, &csi.ListVolumesRequest{})
+	if code := status.Code(toStatusError(err)); code != codes.DeadlineExceeded {
+		t.Fatalf("ListVolumes() error = %v, want code %s", err, codes.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,37 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"go.uber.org/zap"
+)
+
+// ToggleMaintenance switches maintenance mode and returns new state
+func (p *Plugin) ToggleMaintenance() bool {
+	for {
+		current := p.maintenance.Load()
+		if p.maintenance.CompareAndSwap(current, !current) {
+			p.logger.Warn("Maintenance mode was switched", zap.Bool("maintenance", !current))
+			return !current
+		}
+	}
+}
+
+// inMaintenance returns true if plugin rejects new volumes and stages
+func (p *Plugin) inMaintenance() bool {
+	return p.maintenance.Load()
+}
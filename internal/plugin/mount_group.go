@@ -0,0 +1,86 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"os"
+	"strconv"
+)
+
+const (
+	// mountGroupRootMode permissions of volume root when volume mount group is applied by ownership change,
+	// group members can write and new files inherit the group
+	mountGroupRootMode = os.ModeSetgid | 0775
+)
+
+// gidMountOptionFilesystems filesystems without unix ownership, which take owner group as mount option
+var gidMountOptionFilesystems = map[string]bool{
+	"vfat":  true,
+	"msdos": true,
+	"exfat": true,
+}
+
+// parseMountGroup returns group id of volume mount group
+func parseMountGroup(group string) (int, error) {
+	gid, err := strconv.ParseUint(group, 10, 31)
+	if err != nil {
+		return 0, fmt.Errorf("volume mount group must be numeric group id, but %q given", group)
+	}
+	return int(gid), nil
+}
+
+// mountGroupOptions returns mount options applying volume mount group, if filesystem takes group as mount option
+func mountGroupOptions(fsType string, group string) ([]string, error) {
+	if group == "" || !gidMountOptionFilesystems[fsType] {
+		return nil, nil
+	}
+
+	gid, err := parseMountGroup(group)
+	if err != nil {
+		return nil, err
+	}
+	return []string{fmt.Sprintf("gid=%d", gid)}, nil
+}
+
+// mountGroupOwnership returns volume ownership with volume mount group applied, if filesystem has unix ownership.
+// Group set by storage class parameters takes precedence
+func mountGroupOwnership(ownership *volumes.Ownership, fsType string, group string) (*volumes.Ownership, error) {
+	if group == "" || gidMountOptionFilesystems[fsType] {
+		return ownership, nil
+	}
+
+	if ownership != nil && ownership.GID != nil {
+		return ownership, nil
+	}
+
+	gid, err := parseMountGroup(group)
+	if err != nil {
+		return nil, err
+	}
+
+	applied := &volumes.Ownership{}
+	if ownership != nil {
+		*applied = *ownership
+	}
+	applied.GID = &gid
+	if applied.Mode == 0 {
+		applied.Mode = mountGroupRootMode
+	}
+	return applied, nil
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"fmt"
+	"strings"
+)
+
+// oppositeMountFlags pairs of mount flags negating each other, except ro/rw resolved by normalizeMountOptions
+var oppositeMountFlags = map[string]string{
+	"sync":       "async",
+	"async":      "sync",
+	"exec":       "noexec",
+	"noexec":     "exec",
+	"suid":       "nosuid",
+	"nosuid":     "suid",
+	"dev":        "nodev",
+	"nodev":      "dev",
+	"atime":      "noatime",
+	"noatime":    "atime",
+	"diratime":   "nodiratime",
+	"nodiratime": "diratime",
+}
+
+// exclusiveAtimeFlags access time update modes, only one of them can be given
+var exclusiveAtimeFlags = map[string]bool{
+	"noatime":     true,
+	"relatime":    true,
+	"strictatime": true,
+}
+
+// normalizeMountOptions de-duplicates mount options and resolves ro/rw conflict. Explicit read-only request wins,
+// otherwise the last of ro/rw given wins, like mount does. Contradicting flags and different values of the same
+// option are rejected, since mount either fails or applies them unpredictably. Order of options is kept.
+// Returns normalized options and whether they mount read-only
+func normalizeMountOptions(options []string, readOnly bool) ([]string, bool, error) {
+	normalized := make([]string, 0, len(options)+1)
+	seen := make(map[string]bool, len(options))
+	values := make(map[string]string)
+	atimeFlag := ""
+	readOnlyFlag := false
+
+	for _, option := range options {
+		option = strings.TrimSpace(option)
+		if option == "" || seen[option] {
+			continue
+		}
+
+		switch option {
+		case "ro":
+			readOnlyFlag = true
+			continue
+		case "rw":
+			readOnlyFlag = false
+			continue
+		}
+
+		if opposite, ok := oppositeMountFlags[option]; ok && seen[opposite] {
+			return nil, false, fmt.Errorf("mount options %s and %s contradict each other", opposite, option)
+		}
+
+		if exclusiveAtimeFlags[option] {
+			if atimeFlag != "" {
+				return nil, false, fmt.Errorf("mount options %s and %s contradict each other", atimeFlag, option)
+			}
+			atimeFlag = option
+		}
+
+		if key, value, ok := strings.Cut(option, "="); ok {
+			if previous, ok := values[key]; ok {
+				return nil, false, fmt.Errorf("mount option %s is given with different values %q and %q", key, previous, value)
+			}
+			values[key] = value
+		}
+
+		seen[option] = true
+		normalized = append(normalized, option)
+	}
+
+	readOnly = readOnly || readOnlyFlag
+	if readOnly {
+		normalized = append(normalized, "ro")
+	}
+
+	return normalized, readOnly, nil
+}
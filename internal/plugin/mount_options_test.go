@@ -0,0 +1,68 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestNormalizeMountOptions(t *testing.T) {
+	tests := []struct {
+		name         string
+		options      []string
+		readOnly     bool
+		want         []string
+		wantReadOnly bool
+		wantErr      bool
+	}{
+		{name: "empty", options: nil, want: []string{}},
+		{name: "order kept", options: []string{"bind", "noexec", "nosuid"}, want: []string{"bind", "noexec", "nosuid"}},
+		{name: "duplicates dropped", options: []string{"bind", "noexec", "bind", "noexec"}, want: []string{"bind", "noexec"}},
+		{name: "blank dropped", options: []string{" ", "noexec ", ""}, want: []string{"noexec"}},
+		{name: "read-only request", options: []string{"bind"}, readOnly: true, want: []string{"bind", "ro"}, wantReadOnly: true},
+		{name: "read-only request wins over rw", options: []string{"bind", "rw"}, readOnly: true, want: []string{"bind", "ro"}, wantReadOnly: true},
+		{name: "last ro wins", options: []string{"rw", "ro"}, want: []string{"ro"}, wantReadOnly: true},
+		{name: "last rw wins", options: []string{"ro", "rw"}, want: []string{}},
+		{name: "duplicate ro", options: []string{"ro", "ro"}, want: []string{"ro"}, wantReadOnly: true},
+		{name: "same value", options: []string{"gid=1", "gid=1"}, want: []string{"gid=1"}},
+		{name: "different keys", options: []string{"gid=1", "uid=1"}, want: []string{"gid=1", "uid=1"}},
+		{name: "different values", options: []string{"gid=1", "gid=2"}, wantErr: true},
+		{name: "opposite flags", options: []string{"exec", "noexec"}, wantErr: true},
+		{name: "opposite flags reversed", options: []string{"nodev", "dev"}, wantErr: true},
+		{name: "exclusive atime flags", options: []string{"noatime", "relatime"}, wantErr: true},
+		{name: "atime and nodiratime", options: []string{"relatime", "nodiratime"}, want: []string{"relatime", "nodiratime"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, gotReadOnly, err := normalizeMountOptions(tt.options, tt.readOnly)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeMountOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeMountOptions() = %q, want %q", got, tt.want)
+			}
+			if gotReadOnly != tt.wantReadOnly {
+				t.Errorf("normalizeMountOptions() readOnly = %t, want %t", gotReadOnly, tt.wantReadOnly)
+			}
+		})
+	}
+}
@@ -18,17 +18,20 @@ package plugin
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/reinstall/csi-local-sparse/internal/volumes"
 	"go.uber.org/zap"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"strings"
 )
 
 // NodeStageVolume mounts the volume to a staging path
 func (p *Plugin) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	volumeId := request.VolumeId
-	p.logger.Debug("NodeStageVolume called", zap.String("volume_id", volumeId))
+	p.logger.Debug("NodeStageVolume called", zap.String("volume_id", volumeId), zap.Any("volume_context", request.VolumeContext))
 
 	if volumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume invalid argument: volumeId")
@@ -38,6 +41,14 @@ func (p *Plugin) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolu
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume (%s) invalid argument: StagingTargetPath", volumeId)
 	}
 
+	if p.inMaintenance() {
+		return nil, status.Errorf(codes.Unavailable, "NodeStageVolume (%s) node storage is in maintenance mode", volumeId)
+	}
+
+	if p.isCompacting(volumeId) {
+		return nil, status.Errorf(codes.Aborted, "NodeStageVolume (%s) volume is being compacted", volumeId)
+	}
+
 	if request.VolumeCapability == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume (%s) invalid argument: VolumeCapability", volumeId)
 	}
@@ -50,28 +61,139 @@ func (p *Plugin) NodeStageVolume(ctx context.Context, request *csi.NodeStageVolu
 	}
 
 	mnt := request.VolumeCapability.GetMount()
-	mntOptions := mnt.MountFlags
 
-	fsType := "ext4"
-	if mnt.FsType != "" {
-		fsType = mnt.FsType
+	stagingTargetPath := request.StagingTargetPath
+
+	if err := p.checkMountPropagation(ctx, volumeId, stagingTargetPath); err != nil {
+		return nil, err
 	}
 
-	stagingTargetPath := request.StagingTargetPath
+	metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return nil, fmt.Errorf("NodeStageVolume (%s) error get volume metadata: %w", volumeId, err)
+	}
 
-	if err := p.volumeController.FormatIfNot(ctx, volumeId, fsType); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeStageVolume (%s) error format volume device", volumeId)
+	if metadata.Name == "" {
+		p.ensureNameLink(ctx, volumeId, request.VolumeContext)
 	}
 
-	dev, err := p.volumeController.AttachDevice(ctx, volumeId)
+	fsType, err := p.resolveFsType(ctx, volumeId, mnt.FsType, metadata)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeStageVolume (%s) error attach device: %v", volumeId, err)
+		return nil, fmt.Errorf("NodeStageVolume (%s) error get volume filesystem: %w", volumeId, err)
 	}
 
-	if err := p.mounter.Mount(ctx, dev, stagingTargetPath, mntOptions); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeStageVolume (%s) error mount target: %v", volumeId, err.Error())
+	groupOptions, err := mountGroupOptions(fsType, mnt.VolumeMountGroup)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume (%s) invalid argument: VolumeMountGroup: %v", volumeId, err)
+	}
+	mntOptions, readOnly, err := normalizeMountOptions(append(append([]string{}, mnt.MountFlags...), groupOptions...), false)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodeStageVolume (%s) invalid argument: MountFlags: %v", volumeId, err)
 	}
 
+	// volume formatted by its workload is mounted with whatever filesystem it has
+	if metadata.SkipFormat {
+		currentFsType, err := p.volumeController.GetFilesystemType(ctx, volumeId)
+		if err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error get volume filesystem: %w", volumeId, err)
+		}
+
+		if currentFsType == "" {
+			return nil, status.Errorf(codes.FailedPrecondition, "NodeStageVolume (%s) volume has skip-format set, but it's not formatted", volumeId)
+		}
+	} else if err := p.formatVolume(ctx, volumeId, metadata.Pool, fsType); err != nil {
+		return nil, fmt.Errorf("NodeStageVolume (%s) error format volume device: %w", volumeId, err)
+	}
+
+	var dev string
+	if p.opts.MountLoop {
+		// kernel allocates loop device itself, so look it up from the mount afterwards
+		imagePath, err := p.volumeController.GetImagePath(ctx, volumeId)
+		if err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error get image path: %w", volumeId, err)
+		}
+
+		loopOptions := append(append([]string{}, mntOptions...), "loop")
+		if err := p.mounter.Mount(ctx, imagePath, stagingTargetPath, loopOptions); err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error mount target: %w", volumeId, err)
+		}
+
+		dev, err = p.mounter.GetMountSource(ctx, stagingTargetPath)
+		if err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error get mounted loop device: %w", volumeId, err)
+		}
+	} else {
+		attachedDev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+		if err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error get device by volumeId: %w", volumeId, err)
+		}
+
+		dev, err = p.attachDevice(ctx, volumeId)
+		if err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error attach device: %w", volumeId, err)
+		}
+
+		// mounter keeps already mounted staging path, so mount of another device must be gone before mount
+		if staleErr := p.unmountStaleStage(ctx, volumeId, stagingTargetPath, dev); staleErr != nil {
+			err = fmt.Errorf("NodeStageVolume (%s) error unmount stale staging path: %w", volumeId, staleErr)
+		}
+
+		// device found by image could be stale, so its filesystem must be the volume one before mount
+		if err == nil {
+			if verifyErr := p.volumeController.VerifyDeviceFilesystem(ctx, volumeId, dev); verifyErr != nil {
+				err = fmt.Errorf("NodeStageVolume (%s) error verify device filesystem: %w", volumeId, verifyErr)
+			}
+		}
+
+		if err == nil && p.opts.FsckOnStage {
+			if repairErr := p.volumeController.RepairFileSystem(ctx, volumeId); repairErr != nil {
+				err = fmt.Errorf("NodeStageVolume (%s) error repair filesystem: %w", volumeId, repairErr)
+			}
+		}
+
+		if err == nil {
+			if mountErr := p.mounter.Mount(ctx, dev, stagingTargetPath, mntOptions); mountErr != nil {
+				err = fmt.Errorf("NodeStageVolume (%s) error mount target: %w", volumeId, mountErr)
+			}
+		}
+
+		if err != nil {
+			// release device attached by this call, so retry starts clean
+			if attachedDev == "" {
+				if detachErr := p.detachDevice(ctx, volumeId); detachErr != nil {
+					p.logger.Error("NodeStageVolume error detach device after failed mount",
+						zap.String("volume_id", volumeId),
+						zap.String("device", dev),
+						zap.Error(detachErr),
+					)
+				}
+			}
+
+			return nil, err
+		}
+
+		// device is held by the mount now, so it's released by kernel once staging path is unmounted
+		if p.opts.LoopAutoclear {
+			if err := p.volumeController.SetAutoclear(ctx, dev); err != nil {
+				return nil, fmt.Errorf("NodeStageVolume (%s) error set device autoclear: %w", volumeId, err)
+			}
+		}
+	}
+
+	if !metadata.IOLimits.IsEmpty() && dev != "" {
+		if err := p.volumeController.ApplyIOLimits(ctx, dev, metadata.IOLimits); err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error apply io limits: %w", volumeId, err)
+		}
+	}
+
+	if dev != "" {
+		if err := p.volumeController.TuneDevice(ctx, dev, metadata.DeviceTuning); err != nil {
+			return nil, fmt.Errorf("NodeStageVolume (%s) error tune device: %w", volumeId, err)
+		}
+	}
+
+	p.trackStagedVolume(volumeId, stagingTargetPath, readOnly)
+
 	p.logger.Info("NodeStageVolume volume was formatted, attached and mounted to staging path", zap.String("volume_id", volumeId))
 	return &csi.NodeStageVolumeResponse{}, nil
 }
@@ -89,18 +211,96 @@ func (p *Plugin) NodeUnstageVolume(ctx context.Context, request *csi.NodeUnstage
 		return nil, status.Errorf(codes.InvalidArgument, "NodeUnstageVolume (%s) invalid argument: StagingTargetPath", volumeId)
 	}
 
-	if err := p.mounter.Unmount(ctx, request.StagingTargetPath); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume (%s) error unmount staging target: %v", volumeId, err)
+	// image deleted under mounted staging path has no device, but staging path still has to be unmounted
+	dev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil && !errors.Is(err, volumes.ErrorVolumeNotFound) {
+		return nil, fmt.Errorf("NodeUnstageVolume (%s) error get device by volumeId: %w", volumeId, err)
 	}
 
-	if err := p.volumeController.DetachDevice(ctx, volumeId); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeUnstageVolume (%s) error detach device: %v", volumeId, err)
+	// device still mounted elsewhere, e.g. by published pod, must not be detached from under it
+	if dev != "" {
+		refs, err := p.mounter.GetMountRefs(ctx, dev)
+		if err != nil {
+			return nil, fmt.Errorf("NodeUnstageVolume (%s) error get device mount refs: %w", volumeId, err)
+		}
+
+		for _, ref := range refs {
+			if ref != request.StagingTargetPath {
+				return nil, status.Errorf(codes.FailedPrecondition, "NodeUnstageVolume (%s) device %s is still mounted to %s", volumeId, dev, ref)
+			}
+		}
+	}
+
+	if err := p.unmount(ctx, request.StagingTargetPath); err != nil {
+		return nil, fmt.Errorf("NodeUnstageVolume (%s) error unmount staging target: %w", volumeId, err)
+	}
+
+	p.untrackStagedVolume(volumeId)
+
+	if err := p.removeIOLimits(ctx, volumeId); err != nil {
+		return nil, fmt.Errorf("NodeUnstageVolume (%s) error remove io limits: %w", volumeId, err)
+	}
+
+	if err := p.detachDevice(ctx, volumeId); err != nil && !errors.Is(err, volumes.ErrorVolumeNotFound) {
+		return nil, fmt.Errorf("NodeUnstageVolume (%s) error detach device: %w", volumeId, err)
 	}
 
 	p.logger.Info("NodeUnstageVolume volume was unmounted and detached", zap.String("volume_id", volumeId))
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// resolveFsType returns filesystem type of volume: requested one, otherwise the one volume is already formatted with,
+// the one requested on create or default
+func (p *Plugin) resolveFsType(ctx context.Context, volumeId string, requested string, metadata *volumes.VolumeMetadata) (string, error) {
+	if requested != "" {
+		return requested, nil
+	}
+
+	current, err := p.volumeController.GetFilesystemType(ctx, volumeId)
+	if err != nil {
+		return "", err
+	}
+
+	if current != "" {
+		return current, nil
+	}
+
+	if metadata.FsType != "" {
+		return metadata.FsType, nil
+	}
+
+	return defaultFsType, nil
+}
+
+// removeIOLimits removes io limits of attached volume device, if volume has them. Missing volume has no device to remove them from
+func (p *Plugin) removeIOLimits(ctx context.Context, volumeId string) error {
+	metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+	if err != nil {
+		if errors.Is(err, volumes.ErrorVolumeNotFound) {
+			return nil
+		}
+		return fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	if metadata.IOLimits.IsEmpty() {
+		return nil
+	}
+
+	dev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		if errors.Is(err, volumes.ErrorVolumeNotFound) {
+			return nil
+		}
+		return fmt.Errorf("error get device by volumeId: %w", err)
+	}
+
+	if dev == "" {
+		return nil
+	}
+
+	return p.volumeController.ApplyIOLimits(ctx, dev, nil)
+}
+
 // NodePublishVolume mounts staging path to target path
 func (p *Plugin) NodePublishVolume(ctx context.Context, request *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeId := request.VolumeId
@@ -110,10 +310,6 @@ func (p *Plugin) NodePublishVolume(ctx context.Context, request *csi.NodePublish
 		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume invalid argument: VolumeId")
 	}
 
-	if request.StagingTargetPath == "" {
-		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: StagingTargetPath", volumeId)
-	}
-
 	if request.TargetPath == "" {
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: TargetPath", volumeId)
 	}
@@ -129,26 +325,205 @@ func (p *Plugin) NodePublishVolume(ctx context.Context, request *csi.NodePublish
 		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) unsupported access type", volumeId)
 	}
 
+	if isEphemeral(request) {
+		return p.publishEphemeralVolume(ctx, request)
+	}
+
+	if request.StagingTargetPath == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: StagingTargetPath", volumeId)
+	}
+
 	source := request.StagingTargetPath
 	target := request.TargetPath
-	mountOptions := []string{"bind"}
-	if request.Readonly {
-		mountOptions = append(mountOptions, "ro")
+	mnt := request.VolumeCapability.GetMount()
+
+	// storage class flags may repeat or contradict pod settings, explicit read-only request wins
+	mountOptions, readOnly, err := normalizeMountOptions(append([]string{"bind"}, mnt.MountFlags...), request.Readonly)
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: MountFlags: %v", volumeId, err)
 	}
 
-	mnt := request.VolumeCapability.GetMount()
-	for _, flag := range mnt.MountFlags {
-		mountOptions = append(mountOptions, flag)
+	// mounter skips already mounted target, so republish with other settings must be caught before
+	if err := p.checkRepublish(ctx, source, target, readOnly, mountOptions); err != nil {
+		if _, ok := status.FromError(err); ok {
+			return nil, status.Errorf(codes.AlreadyExists, "NodePublishVolume (%s) %s", volumeId, status.Convert(err).Message())
+		}
+		return nil, fmt.Errorf("NodePublishVolume (%s) error check already published target: %w", volumeId, err)
+	}
+
+	if request.VolumeCapability.GetAccessMode().GetMode() == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		if err := p.checkSingleWriter(ctx, volumeId, source, target); err != nil {
+			return nil, err
+		}
 	}
 
 	if err := p.mounter.Mount(ctx, source, target, mountOptions); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodePublishVolume (%s) error mount volume: %v", volumeId, err)
+		return nil, fmt.Errorf("NodePublishVolume (%s) error mount volume: %w", volumeId, err)
+	}
+
+	if !readOnly {
+		metadata, err := p.volumeController.GetMetadata(ctx, volumeId)
+		if err != nil {
+			return nil, fmt.Errorf("NodePublishVolume (%s) error get volume metadata: %w", volumeId, err)
+		}
+
+		fsType, err := p.resolveFsType(ctx, volumeId, mnt.FsType, metadata)
+		if err != nil {
+			return nil, fmt.Errorf("NodePublishVolume (%s) error get volume filesystem: %w", volumeId, err)
+		}
+
+		// kubelet delegates pod's fsGroup to the driver with volume mount group
+		ownership, err := mountGroupOwnership(metadata.Ownership, fsType, mnt.VolumeMountGroup)
+		if err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "NodePublishVolume (%s) invalid argument: VolumeMountGroup: %v", volumeId, err)
+		}
+
+		if err := p.volumeController.ApplyOwnership(ctx, target, ownership); err != nil {
+			return nil, fmt.Errorf("NodePublishVolume (%s) error apply volume ownership: %w", volumeId, err)
+		}
 	}
 
 	p.logger.Info("NodePublishVolume volume was mounted to target path", zap.String("volume_id", volumeId))
 	return &csi.NodePublishVolumeResponse{}, nil
 }
 
+// republishCheckedFlags mount flags reported by kernel in mount table, so they can be compared with requested ones
+var republishCheckedFlags = map[string]bool{
+	"nosuid":      true,
+	"nodev":       true,
+	"noexec":      true,
+	"noatime":     true,
+	"nodiratime":  true,
+	"relatime":    true,
+	"strictatime": true,
+	"sync":        true,
+	"dirsync":     true,
+}
+
+// checkMountPropagation returns FailedPrecondition if staging path isn't on shared mount. Without shared propagation
+// staged and published mounts of node plugin container aren't visible to kubelet and pods
+func (p *Plugin) checkMountPropagation(ctx context.Context, volumeId string, stagingTargetPath string) error {
+	propagation, err := p.mounter.GetMountPropagation(ctx, stagingTargetPath)
+	if err != nil {
+		return fmt.Errorf("NodeStageVolume (%s) error get mount propagation: %w", volumeId, err)
+	}
+
+	for _, flag := range propagation {
+		if flag == "shared" {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.FailedPrecondition,
+		"NodeStageVolume (%s) staging path %s is on mount with %s propagation, but shared is required: set mountPropagation: Bidirectional on kubelet dir volumeMount of node plugin container",
+		volumeId, stagingTargetPath, strings.Join(propagation, ","),
+	)
+}
+
+// unmountStaleStage unmounts staging path mounted from another device than the given volume one, e.g. left
+// by past stage before loop devices were renumbered, so it doesn't serve data of another volume
+func (p *Plugin) unmountStaleStage(ctx context.Context, volumeId string, stagingTargetPath string, dev string) error {
+	source, err := p.mounter.GetMountSource(ctx, stagingTargetPath)
+	if err != nil {
+		return fmt.Errorf("error get staging path mount source: %w", err)
+	}
+
+	if source == "" || source == dev {
+		return nil
+	}
+
+	p.logger.Warn("Staging path is mounted from another device than volume one, unmount it",
+		zap.String("volume_id", volumeId),
+		zap.String("staging_target_path", stagingTargetPath),
+		zap.String("mounted_device", source),
+		zap.String("device", dev),
+	)
+
+	if err := p.mounter.Unmount(ctx, stagingTargetPath); err != nil {
+		return fmt.Errorf("error unmount staging path: %w", err)
+	}
+
+	// mounts stacked on staging path are unmounted one by one, so don't mount over the next stale one
+	source, err = p.mounter.GetMountSource(ctx, stagingTargetPath)
+	if err != nil {
+		return fmt.Errorf("error get staging path mount source: %w", err)
+	}
+
+	if source != "" && source != dev {
+		return fmt.Errorf("staging path is still mounted from %s", source)
+	}
+	return nil
+}
+
+// checkSingleWriter returns FailedPrecondition if volume staged to staging path is already published
+// to another target than the given one
+func (p *Plugin) checkSingleWriter(ctx context.Context, volumeId string, stagingTargetPath string, target string) error {
+	dev, err := p.mounter.GetMountSource(ctx, stagingTargetPath)
+	if err != nil {
+		return fmt.Errorf("NodePublishVolume (%s) error get staging path mount source: %w", volumeId, err)
+	}
+
+	if dev == "" {
+		return nil
+	}
+
+	refs, err := p.mounter.GetMountRefs(ctx, dev)
+	if err != nil {
+		return fmt.Errorf("NodePublishVolume (%s) error get device mount refs: %w", volumeId, err)
+	}
+
+	for _, ref := range refs {
+		if ref != stagingTargetPath && ref != target {
+			return status.Errorf(codes.FailedPrecondition, "NodePublishVolume (%s) volume with single writer access mode is already published to %s", volumeId, ref)
+		}
+	}
+	return nil
+}
+
+// checkRepublish returns status error if target is already mounted from other source or with other readonly
+// or mount flags. Returns nil if target isn't mounted or mounted the same way
+func (p *Plugin) checkRepublish(ctx context.Context, source string, target string, readOnly bool, flags []string) error {
+	mountedSource, err := p.mounter.GetMountSource(ctx, target)
+	if err != nil {
+		return fmt.Errorf("error get target mount source: %w", err)
+	}
+
+	if mountedSource == "" {
+		return nil
+	}
+
+	stagedSource, err := p.mounter.GetMountSource(ctx, source)
+	if err != nil {
+		return fmt.Errorf("error get staging path mount source: %w", err)
+	}
+
+	if stagedSource != "" && stagedSource != mountedSource {
+		return status.Errorf(codes.AlreadyExists, "target is already mounted from %s", mountedSource)
+	}
+
+	options, err := p.mounter.GetMountOptions(ctx, target)
+	if err != nil {
+		return fmt.Errorf("error get target mount options: %w", err)
+	}
+
+	mountedOptions := make(map[string]bool, len(options))
+	for _, option := range options {
+		mountedOptions[option] = true
+	}
+
+	if mountedOptions["ro"] != readOnly {
+		return status.Errorf(codes.AlreadyExists, "target is already mounted with readonly %t", mountedOptions["ro"])
+	}
+
+	for _, flag := range flags {
+		if republishCheckedFlags[flag] && !mountedOptions[flag] {
+			return status.Errorf(codes.AlreadyExists, "target is already mounted without %s", flag)
+		}
+	}
+
+	return nil
+}
+
 // NodeUnpublishVolume unmounts target path
 func (p *Plugin) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
 	volumeId := request.VolumeId
@@ -163,8 +538,12 @@ func (p *Plugin) NodeUnpublishVolume(ctx context.Context, request *csi.NodeUnpub
 	}
 
 	target := request.TargetPath
-	if err := p.mounter.Unmount(ctx, target); err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeUnpublishVolume (%s) error unmount volume: %v", volumeId, err)
+	if err := p.unmount(ctx, target); err != nil {
+		return nil, fmt.Errorf("NodeUnpublishVolume (%s) error unmount volume: %w", volumeId, err)
+	}
+
+	if err := p.unpublishEphemeralVolume(ctx, volumeId); err != nil {
+		return nil, fmt.Errorf("NodeUnpublishVolume (%s) error delete ephemeral volume: %w", volumeId, err)
 	}
 
 	p.logger.Info("NodeUnpublishVolume target path was unmounted", zap.String("volume_id", request.VolumeId))
@@ -196,17 +575,36 @@ func (p *Plugin) NodeExpandVolume(ctx context.Context, request *csi.NodeExpandVo
 		return nil, status.Errorf(codes.OutOfRange, "NodeExpandVolume (%s) invalid argument: capacityRange: %v", volumeId, err)
 	}
 
-	if err := p.volumeController.ExpandVolumeSize(ctx, volumeId, size); err != nil {
-		if err == volumes.ErrorVolumeNotFound {
-			return nil, status.Errorf(codes.NotFound, "NodeExpandVolume error expand volume size: volume (%s) not found", volumeId)
+	if err := p.checkExpandLimit(ctx, "NodeExpandVolume", volumeId, size); err != nil {
+		return nil, err
+	}
+
+	if p.opts.ExpandOverProvisionRatio > 0 {
+		if err := p.checkExpandOverProvision(ctx, volumeId, size); err != nil {
+			return nil, err
+		}
+	}
+
+	// device is taken from the mount kubelet resizes, since loop device found by image could be another one,
+	// e.g. stale device left after crash or the one kernel allocated for mount with loop option
+	device := ""
+	if request.VolumePath != "" {
+		device, err = p.mounter.GetMountSource(ctx, request.VolumePath)
+		if err != nil {
+			return nil, fmt.Errorf("NodeExpandVolume (%s) error get volume path mount source: %w", volumeId, err)
 		}
 
-		return nil, status.Errorf(codes.Internal, "NodeExpandVolume (%s) error expand volume size: %v", volumeId, err)
+		if device == "" {
+			p.logger.Warn("NodeExpandVolume volume path isn't mounted, look device up by volume",
+				zap.String("volume_id", volumeId),
+				zap.String("volume_path", request.VolumePath),
+			)
+		}
 	}
 
-	err = p.volumeController.ResizeDeviceFileSystem(ctx, volumeId)
-	if err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeExpandVolume (%s) error resize filesystem: %v", volumeId, err)
+	// controller expand doesn't touch image, so it's grown here before device and filesystem
+	if err := p.expandVolume(ctx, volumeId, device, size); err != nil {
+		return nil, fmt.Errorf("NodeExpandVolume (%s) %w", volumeId, err)
 	}
 
 	p.logger.Info("NodeExpandVolume volume was expanded", zap.String("volume_id", volumeId))
@@ -229,7 +627,7 @@ func (p *Plugin) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVol
 
 	isMounted, err := p.mounter.IsMounted(ctx, path)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats (%s) error check if volume is mounted: %v", volumeId, err)
+		return nil, fmt.Errorf("NodeGetVolumeStats (%s) error check if volume is mounted: %w", volumeId, err)
 	}
 
 	if !isMounted {
@@ -238,10 +636,20 @@ func (p *Plugin) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVol
 
 	stats, err := p.volumeController.GetVolumeStats(ctx, path)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "NodeGetVolumeStats (%s) error get volume stats: %v", volumeId, err)
+		return nil, fmt.Errorf("NodeGetVolumeStats (%s) error get volume stats: %w", volumeId, err)
 	}
 
-	p.logger.Info("NodeGetVolumeStats send volume statistics", zap.String("volume_id", volumeId))
+	p.checkUsageWatermark(volumeId, path, stats)
+	p.reportDeviceIOStats(ctx, volumeId)
+	fsType := p.reportFilesystemType(ctx, volumeId, path)
+	condition := p.getVolumeCondition(ctx, volumeId, path)
+
+	p.logger.Info("NodeGetVolumeStats send volume statistics",
+		zap.String("volume_id", volumeId),
+		zap.String("fs_type", fsType),
+		zap.Int64("used_bytes", stats.UsedBytes),
+		zap.Int64("total_bytes", stats.TotalBytes),
+	)
 	return &csi.NodeGetVolumeStatsResponse{
 		Usage: []*csi.VolumeUsage{
 			{
@@ -257,6 +665,7 @@ func (p *Plugin) NodeGetVolumeStats(ctx context.Context, request *csi.NodeGetVol
 				Unit:      csi.VolumeUsage_INODES,
 			},
 		},
+		VolumeCondition: condition,
 	}, nil
 }
 
@@ -287,6 +696,27 @@ func (p *Plugin) NodeGetCapabilities(_ context.Context, _ *csi.NodeGetCapabiliti
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -298,7 +728,7 @@ func (p *Plugin) NodeGetInfo(_ context.Context, _ *csi.NodeGetInfoRequest) (*csi
 
 	return &csi.NodeGetInfoResponse{
 		NodeId:            p.nodeId,
-		MaxVolumesPerNode: maxVolumesPerNode,
+		MaxVolumesPerNode: int64(p.maxVolumes()),
 		AccessibleTopology: &csi.Topology{
 			Segments: map[string]string{
 				p.nodeNameTopologyKey: p.nodeId,
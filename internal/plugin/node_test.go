@@ -0,0 +1,610 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPlugin returns plugin over fake volume controller and mounter
+func newTestPlugin(opts Options) (*Plugin, *volumes.FakeVolumeController, *volumes.FakeMounter) {
+	mounter := volumes.NewFakeMounter()
+	vc := volumes.NewFakeVolumeController(100*Gb, mounter)
+	p := NewPlugin("csi-local-sparse.test", "test", "node1", "kubernetes.io/hostname", "unix:///tmp/csi-test.sock", vc, mounter, opts, zap.NewNop())
+	return p, vc, mounter
+}
+
+// stageRequest returns stage request of mount volume with given filesystem
+func stageRequest(volumeId string, stagingPath string, fsType string) *csi.NodeStageVolumeRequest {
+	return &csi.NodeStageVolumeRequest{
+		VolumeId:          volumeId,
+		StagingTargetPath: stagingPath,
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+	}
+}
+
+func TestNodeStageVolumeAttachedUnformatted(t *testing.T) {
+	ctx := context.Background()
+	p, vc, mounter := newTestPlugin(Options{})
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+
+	if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+		t.Fatal(err)
+	}
+
+	// device left attached by stale stage attempt, which didn't get to format
+	if _, err := vc.AttachDevice(ctx, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "ext4"))
+	if code := status.Code(toStatusError(err)); code != codes.FailedPrecondition {
+		t.Fatalf("NodeStageVolume() error = %v, want code %s", err, codes.FailedPrecondition)
+	}
+
+	mounted, err := mounter.IsMounted(ctx, stagingPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mounted {
+		t.Errorf("volume in use was mounted to %s", stagingPath)
+	}
+}
+
+func TestNodeStageVolumeMountFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		// attached device is attached before stage, e.g. by previous stage
+		attached     bool
+		wantAttached bool
+	}{
+		{name: "device attached by failed call is detached"},
+		{name: "device attached before is kept", attached: true, wantAttached: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, _ := newTestPlugin(Options{})
+
+			// staging path under regular file can't be created, so mount fails after attach
+			file := filepath.Join(t.TempDir(), "file")
+			if err := os.WriteFile(file, nil, 0600); err != nil {
+				t.Fatal(err)
+			}
+			stagingPath := filepath.Join(file, "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.attached {
+				if _, err := vc.AttachDevice(ctx, "vol1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "ext4")); err == nil {
+				t.Fatalf("NodeStageVolume() error = nil, want mount error")
+			}
+
+			dev, err := vc.GetDeviceByVolumeId(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if attached := dev != ""; attached != tt.wantAttached {
+				t.Errorf("volume attached = %t, want %t", attached, tt.wantAttached)
+			}
+
+			// retry starts clean and succeeds once staging path can be created
+			stagingPath = filepath.Join(t.TempDir(), "staging")
+			if _, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "ext4")); err != nil {
+				t.Fatalf("NodeStageVolume() retry error = %v", err)
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolumeTwice(t *testing.T) {
+	ctx := context.Background()
+	p, vc, _ := newTestPlugin(Options{})
+	stagingPath := filepath.Join(t.TempDir(), "staging")
+
+	if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "ext4")); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := p.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath}); err != nil {
+			t.Fatalf("NodeUnstageVolume() call %d error = %v", i+1, err)
+		}
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	tests := []struct {
+		name string
+		// deleted image is deleted from under staged volume
+		deleted bool
+	}{
+		{name: "attached volume"},
+		{name: "deleted volume", deleted: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.SaveMetadata(ctx, "vol1", &volumes.VolumeMetadata{IOLimits: &volumes.IOLimits{ReadIOPS: 100}}); err != nil {
+				t.Fatal(err)
+			}
+			dev, err := vc.AttachDevice(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mounter.Mount(ctx, dev, stagingPath, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.deleted {
+				if err := vc.DetachDevice(ctx, "vol1"); err != nil {
+					t.Fatal(err)
+				}
+				if err := vc.Delete(ctx, "vol1"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = p.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{VolumeId: "vol1", StagingTargetPath: stagingPath})
+			if err != nil {
+				t.Fatalf("NodeUnstageVolume() error = %v", err)
+			}
+
+			mounted, err := mounter.IsMounted(ctx, stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if mounted {
+				t.Errorf("staging path %s is still mounted", stagingPath)
+			}
+
+			if !tt.deleted {
+				dev, err := vc.GetDeviceByVolumeId(ctx, "vol1")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if dev != "" {
+					t.Errorf("volume is still attached to %s", dev)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckRepublish(t *testing.T) {
+	tests := []struct {
+		name string
+		// mounted target is published before check
+		mounted        bool
+		mountedSource  string
+		mountedOptions []string
+		readOnly       bool
+		flags          []string
+		wantCode       codes.Code
+	}{
+		{name: "not mounted", wantCode: codes.OK},
+		{name: "identical", mounted: true, mountedOptions: []string{"bind"}, wantCode: codes.OK},
+		{name: "identical readonly", mounted: true, mountedOptions: []string{"bind", "ro"}, readOnly: true, wantCode: codes.OK},
+		{name: "identical flags", mounted: true, mountedOptions: []string{"bind", "noexec"}, flags: []string{"noexec"}, wantCode: codes.OK},
+		{name: "unchecked flag", mounted: true, mountedOptions: []string{"bind"}, flags: []string{"discard"}, wantCode: codes.OK},
+		{name: "readonly over readwrite", mounted: true, mountedOptions: []string{"bind"}, readOnly: true, wantCode: codes.AlreadyExists},
+		{name: "readwrite over readonly", mounted: true, mountedOptions: []string{"bind", "ro"}, wantCode: codes.AlreadyExists},
+		{name: "missing flag", mounted: true, mountedOptions: []string{"bind"}, flags: []string{"noexec"}, wantCode: codes.AlreadyExists},
+		{name: "other source", mounted: true, mountedSource: "/dev/other", mountedOptions: []string{"bind"}, wantCode: codes.AlreadyExists},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, _, mounter := newTestPlugin(Options{})
+			dir := t.TempDir()
+			stagingPath := filepath.Join(dir, "staging")
+			targetPath := filepath.Join(dir, "target")
+
+			if err := mounter.Mount(ctx, "/dev/fakeloop0", stagingPath, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if tt.mounted {
+				// fake bind mount inherits readonly of its source, so target is mounted from the staged device itself
+				source := "/dev/fakeloop0"
+				if tt.mountedSource != "" {
+					source = tt.mountedSource
+				}
+				if err := mounter.Mount(ctx, source, targetPath, tt.mountedOptions); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := p.checkRepublish(ctx, stagingPath, targetPath, tt.readOnly, tt.flags)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("checkRepublish() error = %v, want code %s", err, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestResolveFsType(t *testing.T) {
+	tests := []struct {
+		name string
+		// current filesystem volume is formatted with, unformatted if empty
+		current   string
+		requested string
+		metadata  *volumes.VolumeMetadata
+		want      string
+	}{
+		{name: "requested wins", current: "xfs", requested: "ext4", metadata: &volumes.VolumeMetadata{FsType: "xfs"}, want: "ext4"},
+		{name: "current filesystem", current: "xfs", metadata: &volumes.VolumeMetadata{}, want: "xfs"},
+		{name: "current over created with", current: "xfs", metadata: &volumes.VolumeMetadata{FsType: "ext3"}, want: "xfs"},
+		{name: "created with", metadata: &volumes.VolumeMetadata{FsType: "xfs"}, want: "xfs"},
+		{name: "default", metadata: &volumes.VolumeMetadata{}, want: defaultFsType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, _ := newTestPlugin(Options{})
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if tt.current != "" {
+				if err := vc.FormatIfNot(ctx, "vol1", tt.current); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := p.resolveFsType(ctx, "vol1", tt.requested, tt.metadata)
+			if err != nil {
+				t.Fatalf("resolveFsType() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("resolveFsType() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeWithoutFsType(t *testing.T) {
+	tests := []struct {
+		name string
+		// createFsType filesystem requested on create
+		createFsType string
+		// current filesystem volume is formatted with before stage, unformatted if empty
+		current string
+		want    string
+	}{
+		{name: "xfs volume", current: "xfs", want: "xfs"},
+		{name: "unformatted xfs volume", createFsType: "xfs", want: "xfs"},
+		{name: "unformatted volume", want: defaultFsType},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.SaveMetadata(ctx, "vol1", &volumes.VolumeMetadata{FsType: tt.createFsType}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.current != "" {
+				if err := vc.FormatIfNot(ctx, "vol1", tt.current); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if _, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "")); err != nil {
+				t.Fatalf("NodeStageVolume() error = %v", err)
+			}
+
+			fsType, err := vc.GetFilesystemType(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fsType != tt.want {
+				t.Errorf("volume filesystem = %q, want %q", fsType, tt.want)
+			}
+
+			mounted, err := mounter.IsMounted(ctx, stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !mounted {
+				t.Errorf("staging path isn't mounted")
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeMountPropagation(t *testing.T) {
+	tests := []struct {
+		name        string
+		propagation []string
+		wantCode    codes.Code
+	}{
+		{name: "shared", propagation: []string{"shared"}, wantCode: codes.OK},
+		{name: "shared and slave", propagation: []string{"shared", "master"}, wantCode: codes.OK},
+		{name: "private", propagation: []string{"private"}, wantCode: codes.FailedPrecondition},
+		{name: "slave", propagation: []string{"master"}, wantCode: codes.FailedPrecondition},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			mounter.SetPropagation(tt.propagation...)
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := p.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+				VolumeId:          "vol1",
+				StagingTargetPath: stagingPath,
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+				},
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodeStageVolume() error = %v, want code %s", err, tt.wantCode)
+			}
+
+			if tt.wantCode == codes.OK {
+				return
+			}
+
+			if !strings.Contains(err.Error(), "mountPropagation: Bidirectional") {
+				t.Errorf("NodeStageVolume() error = %v, want it to name mountPropagation: Bidirectional", err)
+			}
+
+			// nothing is done before the check
+			dev, err := vc.GetDeviceByVolumeId(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != "" {
+				t.Errorf("volume is attached to %s", dev)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumeLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		newSize  int64
+		wantCode codes.Code
+		wantSize int64
+	}{
+		{name: "expand within limit", newSize: 3 * Gb, wantCode: codes.OK, wantSize: 3 * Gb},
+		{name: "expand beyond limit", newSize: 5 * Gb, wantCode: codes.OutOfRange, wantSize: Gb},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			volumePath := filepath.Join(t.TempDir(), "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.SaveMetadata(ctx, "vol1", &volumes.VolumeMetadata{LimitBytes: 4 * Gb}); err != nil {
+				t.Fatal(err)
+			}
+			dev, err := vc.AttachDevice(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := mounter.Mount(ctx, dev, volumePath, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = p.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+				VolumeId:      "vol1",
+				VolumePath:    volumePath,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: tt.newSize},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				},
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodeExpandVolume() error = %v, want code %s", err, tt.wantCode)
+			}
+
+			size, err := vc.GetVolumeSize(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != tt.wantSize {
+				t.Errorf("volume size = %d, want %d", size, tt.wantSize)
+			}
+		})
+	}
+}
+
+func TestNodeStageVolumeStaleMount(t *testing.T) {
+	tests := []struct {
+		name string
+		// mountedSource device staging path is mounted from before stage, volume device if empty
+		mountedSource string
+	}{
+		{name: "staged with volume device"},
+		{name: "stale mount of renumbered device", mountedSource: "/dev/fakeloop7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			stagingPath := filepath.Join(t.TempDir(), "staging")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+				t.Fatal(err)
+			}
+			dev, err := vc.AttachDevice(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			source := dev
+			if tt.mountedSource != "" {
+				source = tt.mountedSource
+			}
+			if err := mounter.Mount(ctx, source, stagingPath, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := p.NodeStageVolume(ctx, stageRequest("vol1", stagingPath, "ext4")); err != nil {
+				t.Fatalf("NodeStageVolume() error = %v", err)
+			}
+
+			got, err := mounter.GetMountSource(ctx, stagingPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != dev {
+				t.Errorf("staging path is mounted from %q, want volume device %q", got, dev)
+			}
+		})
+	}
+}
+
+func TestNodeExpandVolumeGrowOnNode(t *testing.T) {
+	tests := []struct {
+		name string
+		// mounted volume path is mounted before expand
+		mounted bool
+		// mountedSource device volume path is mounted from, volume device if empty
+		mountedSource string
+		wantErr       bool
+	}{
+		{name: "device of mounted volume path", mounted: true},
+		{name: "device looked up by volume", mounted: false},
+		// resize of device volume path is mounted from fails, since it isn't the volume one
+		{name: "volume path mounted from another device", mounted: true, mountedSource: "/dev/fakeloop7", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			p, vc, mounter := newTestPlugin(Options{})
+			dir := t.TempDir()
+			volumePath := filepath.Join(dir, "volume")
+
+			if _, err := vc.Create(ctx, "vol1", "", Gb); err != nil {
+				t.Fatal(err)
+			}
+			if err := vc.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+				t.Fatal(err)
+			}
+			dev, err := vc.AttachDevice(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.mounted {
+				source := dev
+				if tt.mountedSource != "" {
+					source = tt.mountedSource
+				}
+				if err := mounter.Mount(ctx, source, volumePath, nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// controller expand doesn't touch image, so node grows it
+			resp, err := p.NodeExpandVolume(ctx, &csi.NodeExpandVolumeRequest{
+				VolumeId:      "vol1",
+				VolumePath:    volumePath,
+				CapacityRange: &csi.CapacityRange{RequiredBytes: 3 * Gb},
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				},
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NodeExpandVolume() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if resp.CapacityBytes != 3*Gb {
+				t.Errorf("NodeExpandVolume() capacity = %d, want %d", resp.CapacityBytes, 3*Gb)
+			}
+
+			size, err := vc.GetVolumeSize(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != 3*Gb {
+				t.Errorf("volume size = %d, want %d", size, 3*Gb)
+			}
+
+			statsPath := filepath.Join(dir, "stats")
+			if err := mounter.Mount(ctx, dev, statsPath, nil); err != nil {
+				t.Fatal(err)
+			}
+			stats, err := vc.GetVolumeStats(ctx, statsPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.TotalBytes != 3*Gb {
+				t.Errorf("filesystem size = %d, want %d", stats.TotalBytes, 3*Gb)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"time"
+)
+
+// withTimeout runs volume operation with context bounded by timeout of its class, if set. Earlier rpc deadline
+// still applies. Expired operation timeout is returned as deadline exceeded with operation name
+func withTimeout(ctx context.Context, operation string, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	opCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(opCtx)
+	// killed external command reports its signal instead of the deadline
+	if err != nil && ctx.Err() == nil && opCtx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s: %v: %w", operation, timeout, err, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// createImage creates empty volume image or copy of template within format timeout. Returns true if image was created
+// by this call
+func (p *Plugin) createImage(ctx context.Context, volumeId string, metadata *volumes.VolumeMetadata, sizeBytes int64) (bool, error) {
+	created := false
+	err := withTimeout(ctx, "create", p.opts.FormatTimeout, func(ctx context.Context) error {
+		var err error
+		if metadata.Template != "" {
+			fsType := metadata.FsType
+			if fsType == "" {
+				fsType = defaultFsType
+			}
+			created, err = p.volumeController.CreateFromTemplate(ctx, volumeId, metadata.Pool, metadata.Template, fsType, sizeBytes)
+			return err
+		}
+		created, err = p.volumeController.Create(ctx, volumeId, metadata.Pool, sizeBytes)
+		return err
+	})
+	return created, err
+}
+
+// formatVolume formats volume if it has no given filesystem within format timeout. Storage space is checked first,
+// so full node fails with ResourceExhausted instead of mkfs error
+func (p *Plugin) formatVolume(ctx context.Context, volumeId string, pool string, fsType string) error {
+	if err := p.checkFormatSpace(ctx, volumeId, pool); err != nil {
+		return err
+	}
+
+	return withTimeout(ctx, "format", p.opts.FormatTimeout, func(ctx context.Context) error {
+		return p.volumeController.FormatIfNot(ctx, volumeId, fsType)
+	})
+}
+
+// attachDevice attaches volume to loop device within attach timeout
+func (p *Plugin) attachDevice(ctx context.Context, volumeId string) (string, error) {
+	var dev string
+	err := withTimeout(ctx, "attach", p.opts.AttachTimeout, func(ctx context.Context) error {
+		var err error
+		dev, err = p.volumeController.AttachDevice(ctx, volumeId)
+		return err
+	})
+	return dev, err
+}
+
+// detachDevice detaches volume from loop device within attach timeout
+func (p *Plugin) detachDevice(ctx context.Context, volumeId string) error {
+	return withTimeout(ctx, "detach", p.opts.AttachTimeout, func(ctx context.Context) error {
+		return p.volumeController.DetachDevice(ctx, volumeId)
+	})
+}
+
+// expandVolume grows volume image and then filesystem of its device within resize timeout
+func (p *Plugin) expandVolume(ctx context.Context, volumeId string, device string, sizeBytes int64) error {
+	return withTimeout(ctx, "resize", p.opts.ResizeTimeout, func(ctx context.Context) error {
+		if err := p.volumeController.ExpandVolumeSize(ctx, volumeId, sizeBytes); err != nil {
+			return fmt.Errorf("error expand volume size: %w", err)
+		}
+
+		if err := p.volumeController.ResizeDeviceFileSystem(ctx, volumeId, device, 0); err != nil {
+			return fmt.Errorf("error resize filesystem: %w", err)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,140 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+	"time"
+)
+
+// runOrphanGC periodically looks for volume images unknown to CO and logs or removes them
+func (p *Plugin) runOrphanGC(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.OrphanGCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if err := p.collectOrphans(ctx); err != nil {
+			p.logger.Error("Orphan gc error", zap.Error(err))
+		}
+	}
+}
+
+// collectOrphans finds volumes absent from known volumes file. Volume is orphan only if it is neither staged,
+// attached nor being compacted, and its image is older than min age and wasn't modified since known volumes file
+// was written, so volumes created after CO wrote the file are never collected
+func (p *Plugin) collectOrphans(ctx context.Context) error {
+	known, knownAt, err := readKnownVolumes(p.opts.OrphanGCKnownVolumesFile)
+	if err != nil {
+		return err
+	}
+
+	volumeIds, err := p.volumeController.ListVolumeIds(ctx)
+	if err != nil {
+		return fmt.Errorf("error list volumes: %w", err)
+	}
+
+	staged := p.getStagedVolumes()
+	for _, volumeId := range volumeIds {
+		// image being compacted is replaced with its copy, so its age and device aren't reliable meanwhile
+		if known[volumeId] || staged[volumeId] != "" || p.isCompacting(volumeId) {
+			continue
+		}
+
+		modTime, err := p.volumeController.GetVolumeModTime(ctx, volumeId)
+		if err != nil {
+			// volume could be deleted since listing
+			if errors.Is(err, volumes.ErrorVolumeNotFound) {
+				continue
+			}
+			return fmt.Errorf("error get volume (%s) modification time: %w", volumeId, err)
+		}
+
+		if time.Since(modTime) < p.opts.OrphanGCMinAge || !modTime.Before(knownAt) {
+			continue
+		}
+
+		device, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+		if err != nil {
+			return fmt.Errorf("error get volume (%s) device: %w", volumeId, err)
+		}
+
+		if device != "" {
+			p.logger.Warn("Orphan volume is attached to device, skip it",
+				zap.String("volume_id", volumeId),
+				zap.String("device", device),
+			)
+			continue
+		}
+
+		if !p.opts.OrphanGCDelete {
+			p.logger.Warn("Found orphan volume", zap.String("volume_id", volumeId), zap.Time("mod_time", modTime))
+			continue
+		}
+
+		if !p.startDelete(volumeId) {
+			p.logger.Warn("Orphan volume is being compacted, skip it", zap.String("volume_id", volumeId))
+			continue
+		}
+
+		err = p.volumeController.Delete(ctx, volumeId)
+		p.finishCompaction(volumeId)
+		if err != nil {
+			return fmt.Errorf("error delete orphan volume (%s): %w", volumeId, err)
+		}
+		p.releaseVolume(volumeId)
+		p.logger.Warn("Orphan volume was deleted", zap.String("volume_id", volumeId), zap.Time("mod_time", modTime))
+	}
+
+	return nil
+}
+
+// readKnownVolumes reads volume ids, one per line, and modification time of known volumes file.
+// Empty lines and lines starting with # are ignored
+func readKnownVolumes(filename string) (map[string]bool, time.Time, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error stat known volumes file: %w", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("error read known volumes file: %w", err)
+	}
+
+	known := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		known[line] = true
+	}
+
+	return known, info.ModTime(), nil
+}
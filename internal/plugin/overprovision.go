@@ -0,0 +1,70 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkExpandOverProvision warns when sum of logical sizes of pool volumes after expanding volume to new size
+// exceeds pool storage size multiplied by over-provision ratio. Sparse images don't allocate added space, so
+// writes fail with ENOSPC inside volume filesystem later. Returns OutOfRange if expand should be rejected
+func (p *Plugin) checkExpandOverProvision(ctx context.Context, volumeId string, newSizeBytes int64) error {
+	currentSize, err := p.volumeController.GetVolumeSize(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("NodeExpandVolume (%s) error get volume size: %w", volumeId, err)
+	}
+
+	// shrinking or no-op expand can't make over-provisioning worse
+	if newSizeBytes <= currentSize {
+		return nil
+	}
+
+	provisioned, total, err := p.volumeController.GetVolumePoolUsage(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("NodeExpandVolume (%s) error get volume pool usage: %w", volumeId, err)
+	}
+
+	expanded := provisioned - currentSize + newSizeBytes
+	limit := float64(total) * p.opts.ExpandOverProvisionRatio
+	if float64(expanded) <= limit {
+		return nil
+	}
+
+	metrics.VolumeExpandOverProvisionedTotal.WithLabelValues(volumeId).Inc()
+	p.logger.Warn("Volume expand exceeds pool over-provision ratio",
+		zap.String("volume_id", volumeId),
+		zap.Int64("new_size_bytes", newSizeBytes),
+		zap.Int64("provisioned_bytes", expanded),
+		zap.Int64("total_bytes", total),
+		zap.Float64("ratio", p.opts.ExpandOverProvisionRatio),
+		zap.Bool("rejected", p.opts.ExpandOverProvisionFail),
+	)
+
+	if p.opts.ExpandOverProvisionFail {
+		return status.Errorf(codes.OutOfRange,
+			"NodeExpandVolume (%s) pool volumes would take %d bytes after expand, exceeding over-provision ratio %.2f of %d bytes pool storage",
+			volumeId, expanded, p.opts.ExpandOverProvisionRatio, total,
+		)
+	}
+	return nil
+}
@@ -20,16 +20,122 @@ import (
 	"context"
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/reinstall/csi-local-sparse/internal/audit"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
 	"github.com/reinstall/csi-local-sparse/internal/volumes"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
 	"net"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Options optional plugin settings
+type Options struct {
+	// EnableAttach advertise PUBLISH_UNPUBLISH_VOLUME controller capability
+	EnableAttach bool
+	// MountLoop mount volume images with "mount -o loop" instead of explicit losetup
+	MountLoop bool
+	// UsageWarningThreshold used to total bytes ratio of volume to warn about, disabled if 0
+	UsageWarningThreshold float64
+	// UsageCheckInterval interval of staged volumes usage sampling, disabled if 0
+	UsageCheckInterval time.Duration
+	// AuditLogger volume lifecycle events log, disabled if nil
+	AuditLogger *audit.Logger
+	// GrpcMaxRecvMsgSize maximum size of received grpc message, grpc default if 0
+	GrpcMaxRecvMsgSize int
+	// GrpcMaxSendMsgSize maximum size of sent grpc message, grpc default if 0
+	GrpcMaxSendMsgSize int
+	// GrpcKeepaliveTime interval of server pings of idle connections, grpc default if 0
+	GrpcKeepaliveTime time.Duration
+	// GrpcKeepaliveTimeout wait time for ping ack before closing connection, grpc default if 0
+	GrpcKeepaliveTimeout time.Duration
+	// GrpcKeepaliveMinTime minimum interval of client pings, grpc default if 0
+	GrpcKeepaliveMinTime time.Duration
+	// GrpcKeepalivePermitWithoutStream allow client pings without active streams
+	GrpcKeepalivePermitWithoutStream bool
+	// LimitOnlyDefaultSize provision default size capped by limit instead of the limit when only limit bytes requested
+	LimitOnlyDefaultSize bool
+	// RequireExplicitSize fail volume create instead of provision default size when no size requested
+	RequireExplicitSize bool
+	// LoopAutoclear make staged loop devices detached by kernel when staging path is unmounted
+	LoopAutoclear bool
+	// FsckOnStage check and repair filesystem which wasn't cleanly unmounted before mount on stage
+	FsckOnStage bool
+	// UnmountRetries count of plain unmount attempts of unpublish and unstage, single attempt if 0
+	UnmountRetries int
+	// UnmountRetryBackoff delay before second plain unmount attempt, doubled after each next failure
+	UnmountRetryBackoff time.Duration
+	// LazyUnmount lazily unmount target once plain unmount attempts are exhausted
+	LazyUnmount bool
+	// RemountReadOnlyRecovery remount read-write volume filesystem which became read-only, if its check is clean
+	RemountReadOnlyRecovery bool
+	// ExpandOverProvisionRatio maximum ratio of logical sizes sum of pool volumes after expand to pool storage size, disabled if 0
+	ExpandOverProvisionRatio float64
+	// ExpandOverProvisionFail reject expand exceeding over-provision ratio instead of only warning about it
+	ExpandOverProvisionFail bool
+	// MaxVolumesPerNode maximum count of volumes on node advertised to CO and enforced on create, default if 0
+	MaxVolumesPerNode int
+	// LoopDevicesWarningThreshold used to total loop devices ratio to warn about on pool accounting, disabled if 0
+	LoopDevicesWarningThreshold float64
+	// LoopDevicesProbeFail report plugin not ready in Probe while loop devices usage exceeds warning threshold
+	LoopDevicesProbeFail bool
+	// VolumeContextKeys create parameters returned in volume context of created volume
+	VolumeContextKeys []string
+	// ListVolumesWorkers count of parallel volume stat calls of ListVolumes, default if 0
+	ListVolumesWorkers int
+	// OrphanGCInterval interval of orphan volumes lookup, disabled if 0
+	OrphanGCInterval time.Duration
+	// OrphanGCKnownVolumesFile file with volume ids known to CO, one per line
+	OrphanGCKnownVolumesFile string
+	// OrphanGCMinAge minimum age of orphan volume image
+	OrphanGCMinAge time.Duration
+	// OrphanGCDelete delete orphan volumes instead of only logging them
+	OrphanGCDelete bool
+	// ReconcileMountsInterval interval of mounts reconciliation against volume images, disabled if 0
+	ReconcileMountsInterval time.Duration
+	// ReconcileMountsCleanup unmount orphaned mounts and detach their devices instead of only logging them
+	ReconcileMountsCleanup bool
+	// KubeletDir kubelet root dir, where mounts are reconciled
+	KubeletDir string
+	// PoolAccountingInterval interval of volumes disk usage accounting, disabled if 0
+	PoolAccountingInterval time.Duration
+	// Maintenance start in maintenance mode, rejecting new volumes and stages but allowing teardown
+	Maintenance bool
+	// EnableReflection register grpc server reflection and health services
+	EnableReflection bool
+	// RateLimit maximum rate of mutating rpc calls per second, disabled if 0
+	RateLimit float64
+	// RateLimitBurst maximum count of mutating rpc calls above rate limit at once
+	RateLimitBurst int
+	// OperationTimeout maximum duration of rpc call, applied when CO deadline is later or absent, disabled if 0
+	OperationTimeout time.Duration
+	// FormatTimeout maximum duration of volume image creation and format, disabled if 0
+	FormatTimeout time.Duration
+	// ResizeTimeout maximum duration of volume image and filesystem expand, disabled if 0
+	ResizeTimeout time.Duration
+	// AttachTimeout maximum duration of loop device attach and detach, disabled if 0
+	AttachTimeout time.Duration
+	// ReadyFile file created when plugin is serving and removed on shutdown, disabled if empty
+	ReadyFile string
+	// SocketMode permissions set on grpc unix socket after listen, umask default if nil
+	SocketMode *os.FileMode
+	// SocketUID owner set on grpc unix socket after listen, unchanged if nil
+	SocketUID *int
+	// SocketGID group set on grpc unix socket after listen, unchanged if nil
+	SocketGID *int
+}
+
 // Plugin implements csi plugin spec
 type Plugin struct {
 	csi.UnimplementedIdentityServer
@@ -54,6 +160,35 @@ type Plugin struct {
 	// mounter volume mounter
 	mounter volumes.Mounter
 
+	// opts optional settings
+	opts Options
+
+	// stagedVolumes staging paths by volume id of volumes staged by this instance
+	stagedVolumes map[string]string
+	// stagedReadOnlyVolumes volumes staged read-only by this instance
+	stagedReadOnlyVolumes map[string]bool
+	// compactingVolumes volumes being compacted, which can't be staged
+	compactingVolumes map[string]bool
+	// stagedVolumesMu guards stagedVolumes, stagedReadOnlyVolumes and compactingVolumes
+	stagedVolumesMu sync.Mutex
+
+	// volumeIds ids of existing volumes counted against volumes per node limit, nil if not listed yet
+	volumeIds map[string]bool
+	// volumeIdsMu guards volumeIds
+	volumeIdsMu sync.Mutex
+
+	// maintenance plugin rejects new volumes and stages
+	maintenance atomic.Bool
+
+	// rateLimiter mutating rpc calls limiter, nil if rate limit is disabled
+	rateLimiter *tokenBucket
+
+	// loopDevicesExhausted loop devices usage exceeded warning threshold on last pool accounting
+	loopDevicesExhausted atomic.Bool
+
+	// poolUsage last accounted disk usage of all volumes, nil if not accounted yet
+	poolUsage atomic.Pointer[poolUsage]
+
 	// logger .
 	logger *zap.Logger
 }
@@ -67,27 +202,56 @@ func NewPlugin(
 	socket string,
 	volumeManager volumes.VolumeController,
 	mounter volumes.Mounter,
+	opts Options,
 	logger *zap.Logger,
 ) *Plugin {
-	return &Plugin{
-		name:                name,
-		version:             version,
-		nodeId:              nodeId,
-		nodeNameTopologyKey: nodeNameTopologyKey,
-		socket:              socket,
-		volumeController:    volumeManager,
-		mounter:             mounter,
-		logger:              logger.With(zap.String("logger", "plugin")),
+	p := &Plugin{
+		name:                  name,
+		version:               version,
+		nodeId:                nodeId,
+		nodeNameTopologyKey:   nodeNameTopologyKey,
+		socket:                socket,
+		volumeController:      volumeManager,
+		mounter:               mounter,
+		opts:                  opts,
+		stagedVolumes:         map[string]string{},
+		stagedReadOnlyVolumes: map[string]bool{},
+		compactingVolumes:     map[string]bool{},
+		logger:                logger.With(zap.String("logger", "plugin")),
 	}
+	p.maintenance.Store(opts.Maintenance)
+	if opts.RateLimit > 0 {
+		p.rateLimiter = newTokenBucket(opts.RateLimit, opts.RateLimitBurst)
+	}
+	return p
 }
 
 // Run runs grpc server and socket listening
 func (p *Plugin) Run(ctx context.Context) error {
 	errHandler := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-		resp, err := handler(ctx, req)
+		started := time.Now()
+		ctx, cancel := p.withOperationTimeout(ctx)
+		defer cancel()
+
+		var resp interface{}
+		var err error
+		if p.isRateLimited(info.FullMethod) {
+			metrics.RateLimitedRequestsTotal.WithLabelValues(info.FullMethod).Inc()
+			err = status.Errorf(codes.ResourceExhausted, "%s rate limit exceeded, retry later", info.FullMethod)
+		} else {
+			resp, err = handler(ctx, req)
+		}
+		// killed external command reports its signal instead of the deadline
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			err = status.Errorf(codes.DeadlineExceeded, "%s deadline exceeded: %v", info.FullMethod, err)
+		}
+		kind := errorKind(err)
+		err = toStatusError(err)
 		if err != nil {
+			metrics.OperationErrorsTotal.WithLabelValues(info.FullMethod, status.Code(err).String(), kind).Inc()
 			p.logger.Error("method failed", zap.Error(err))
 		}
+		p.recordAudit(req, resp, started, err)
 		return resp, err
 	}
 
@@ -105,6 +269,9 @@ func (p *Plugin) Run(ctx context.Context) error {
 		return fmt.Errorf("only unix domains are supported, but %s given", u.Scheme)
 	}
 
+	// stale ready file of past run must not report readiness before the server is listening
+	p.unmarkReady()
+
 	// remove socket when it was already created by past run
 	err = os.Remove(grpcAddr)
 	if err != nil && !os.IsNotExist(err) {
@@ -116,15 +283,117 @@ func (p *Plugin) Run(ctx context.Context) error {
 		return fmt.Errorf("failed to listen socket: %w", err)
 	}
 
-	srv := grpc.NewServer(grpc.UnaryInterceptor(errHandler))
+	if err := p.applySocketPermissions(grpcAddr); err != nil {
+		_ = grpcListener.Close()
+		return err
+	}
+
+	srv := grpc.NewServer(append(p.grpcServerOptions(), grpc.UnaryInterceptor(errHandler))...)
 	csi.RegisterIdentityServer(srv, p)
 	csi.RegisterControllerServer(srv, p)
 	csi.RegisterNodeServer(srv, p)
+	if p.opts.EnableReflection {
+		grpc_health_v1.RegisterHealthServer(srv, &healthServer{plugin: p})
+		reflection.Register(srv)
+	}
 
 	go func() {
 		<-ctx.Done()
+		p.unmarkReady()
 		srv.GracefulStop()
 	}()
 
+	// listener already accepts connections, so clients are served as soon as Serve is called
+	if err := p.markReady(ctx); err != nil {
+		_ = grpcListener.Close()
+		return err
+	}
+	defer p.unmarkReady()
+
+	if p.opts.UsageCheckInterval > 0 && p.opts.UsageWarningThreshold > 0 {
+		go p.runUsageSampler(ctx)
+	}
+
+	if p.opts.PoolAccountingInterval > 0 {
+		go p.runPoolAccounting(ctx)
+	}
+
+	if p.opts.OrphanGCInterval > 0 {
+		go p.runOrphanGC(ctx)
+	}
+
+	if p.opts.ReconcileMountsInterval > 0 {
+		go p.runMountsReconciler(ctx)
+	}
+
 	return srv.Serve(grpcListener)
 }
+
+// withOperationTimeout bounds request context with operation timeout, unless it already has an earlier deadline,
+// so external commands can't hang handler forever when CO sends no deadline
+func (p *Plugin) withOperationTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.opts.OperationTimeout <= 0 {
+		return ctx, func() {}
+	}
+
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) <= p.opts.OperationTimeout {
+		return ctx, func() {}
+	}
+
+	return context.WithTimeout(ctx, p.opts.OperationTimeout)
+}
+
+// applySocketPermissions sets configured ownership and permissions of grpc unix socket, so only allowed users,
+// e.g. kubelet, can connect
+func (p *Plugin) applySocketPermissions(socketPath string) error {
+	if p.opts.SocketUID != nil || p.opts.SocketGID != nil {
+		uid, gid := -1, -1
+		if p.opts.SocketUID != nil {
+			uid = *p.opts.SocketUID
+		}
+		if p.opts.SocketGID != nil {
+			gid = *p.opts.SocketGID
+		}
+
+		if err := os.Chown(socketPath, uid, gid); err != nil {
+			return fmt.Errorf("failed to change owner of unix socket (%s): %w", socketPath, err)
+		}
+	}
+
+	if p.opts.SocketMode != nil {
+		if err := os.Chmod(socketPath, *p.opts.SocketMode); err != nil {
+			return fmt.Errorf("failed to change mode of unix socket (%s): %w", socketPath, err)
+		}
+	}
+
+	return nil
+}
+
+// grpcServerOptions returns grpc server options from plugin settings. Unset settings keep grpc defaults
+func (p *Plugin) grpcServerOptions() []grpc.ServerOption {
+	opts := make([]grpc.ServerOption, 0)
+
+	if p.opts.GrpcMaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(p.opts.GrpcMaxRecvMsgSize))
+	}
+
+	if p.opts.GrpcMaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(p.opts.GrpcMaxSendMsgSize))
+	}
+
+	if p.opts.GrpcKeepaliveTime > 0 || p.opts.GrpcKeepaliveTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    p.opts.GrpcKeepaliveTime,
+			Timeout: p.opts.GrpcKeepaliveTimeout,
+		}))
+	}
+
+	if p.opts.GrpcKeepaliveMinTime > 0 || p.opts.GrpcKeepalivePermitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             p.opts.GrpcKeepaliveMinTime,
+			PermitWithoutStream: p.opts.GrpcKeepalivePermitWithoutStream,
+		}))
+	}
+
+	return opts
+}
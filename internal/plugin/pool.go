@@ -0,0 +1,193 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"net/http"
+	"time"
+)
+
+// poolUsage logical and physical space consumed by all volumes of the node
+type poolUsage struct {
+	// Volumes count of volumes
+	Volumes int `json:"volumes"`
+	// AttachedVolumes count of volumes attached to loop devices
+	AttachedVolumes int `json:"attachedVolumes"`
+	// MountedVolumes count of volumes whose loop device is mounted
+	MountedVolumes int `json:"mountedVolumes"`
+	// ApparentBytes sum of logical (apparent) sizes of volume images
+	ApparentBytes int64 `json:"apparentBytes"`
+	// AllocatedBytes sum of actually allocated sizes of volume images
+	AllocatedBytes int64 `json:"allocatedBytes"`
+	// LoopDevicesInUse count of loop devices bound to any file
+	LoopDevicesInUse int `json:"loopDevicesInUse"`
+	// LoopDevicesVolumes count of loop devices bound to volume images
+	LoopDevicesVolumes int `json:"loopDevicesVolumes"`
+	// LoopDevicesTotal maximum count of loop devices, unknown if 0
+	LoopDevicesTotal int `json:"loopDevicesTotal"`
+	// UpdatedAt time of accounting
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// runPoolAccounting periodically sums disk usage of all volumes and reports it to metrics
+func (p *Plugin) runPoolAccounting(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.PoolAccountingInterval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := p.updatePoolUsage(ctx); err != nil {
+			p.logger.Error("Pool accounting error", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updatePoolUsage sums disk usage of all volumes, stores and reports it to metrics
+func (p *Plugin) updatePoolUsage(ctx context.Context) (*poolUsage, error) {
+	volumeIds, err := p.volumeController.ListVolumeIds(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error list volumes: %w", err)
+	}
+
+	devices, err := p.volumeController.GetAttachedDevices(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get attached devices: %w", err)
+	}
+
+	usage := &poolUsage{}
+	for _, volumeId := range volumeIds {
+		apparent, allocated, err := p.volumeController.GetVolumeDiskUsage(ctx, volumeId)
+		if err != nil {
+			// volume could be deleted since listing
+			if err == volumes.ErrorVolumeNotFound {
+				continue
+			}
+			return nil, fmt.Errorf("error get volume (%s) disk usage: %w", volumeId, err)
+		}
+
+		usage.Volumes++
+		usage.ApparentBytes += apparent
+		usage.AllocatedBytes += allocated
+
+		// idle volumes consume disk space, but not loop devices
+		dev, ok := devices[volumeId]
+		if !ok {
+			continue
+		}
+		usage.AttachedVolumes++
+
+		refs, err := p.mounter.GetMountRefs(ctx, dev)
+		if err != nil {
+			return nil, fmt.Errorf("error get volume (%s) device mount refs: %w", volumeId, err)
+		}
+		if len(refs) > 0 {
+			usage.MountedVolumes++
+		}
+	}
+
+	loopDevices, err := p.volumeController.GetLoopDevicesUsage(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error get loop devices usage: %w", err)
+	}
+	usage.LoopDevicesInUse = loopDevices.InUse
+	usage.LoopDevicesVolumes = loopDevices.Volumes
+	usage.LoopDevicesTotal = loopDevices.Total
+	p.checkLoopDevicesUsage(loopDevices)
+
+	usage.UpdatedAt = time.Now()
+
+	p.poolUsage.Store(usage)
+	metrics.PoolVolumes.Set(float64(usage.Volumes))
+	metrics.PoolAttachedVolumes.Set(float64(usage.AttachedVolumes))
+	metrics.PoolMountedVolumes.Set(float64(usage.MountedVolumes))
+	metrics.PoolApparentBytes.Set(float64(usage.ApparentBytes))
+	metrics.PoolAllocatedBytes.Set(float64(usage.AllocatedBytes))
+	metrics.LoopDevicesInUse.Set(float64(usage.LoopDevicesInUse))
+	metrics.LoopDevicesVolumes.Set(float64(usage.LoopDevicesVolumes))
+	metrics.LoopDevicesTotal.Set(float64(usage.LoopDevicesTotal))
+
+	p.logger.Debug("Pool usage was updated",
+		zap.Int("volumes", usage.Volumes),
+		zap.Int("attached_volumes", usage.AttachedVolumes),
+		zap.Int("mounted_volumes", usage.MountedVolumes),
+		zap.Int64("apparent_bytes", usage.ApparentBytes),
+		zap.Int64("allocated_bytes", usage.AllocatedBytes),
+		zap.Int("loop_devices_in_use", usage.LoopDevicesInUse),
+		zap.Int("loop_devices_total", usage.LoopDevicesTotal),
+	)
+	return usage, nil
+}
+
+// checkLoopDevicesUsage warns when used to total loop devices ratio exceeds threshold and marks
+// loop devices as nearly exhausted for Probe
+func (p *Plugin) checkLoopDevicesUsage(usage *volumes.LoopDevicesUsage) {
+	if p.opts.LoopDevicesWarningThreshold <= 0 || usage.Total <= 0 {
+		p.loopDevicesExhausted.Store(false)
+		return
+	}
+
+	ratio := float64(usage.InUse) / float64(usage.Total)
+	exhausted := ratio >= p.opts.LoopDevicesWarningThreshold
+	p.loopDevicesExhausted.Store(exhausted)
+
+	if exhausted {
+		p.logger.Warn("Loop devices are nearly exhausted, raise max_loop parameter of loop module",
+			zap.Int("loop_devices_in_use", usage.InUse),
+			zap.Int("loop_devices_volumes", usage.Volumes),
+			zap.Int("loop_devices_total", usage.Total),
+			zap.Float64("threshold", p.opts.LoopDevicesWarningThreshold),
+		)
+	}
+}
+
+// PoolHandler returns read-only http handler reporting logical and physical space consumed by all volumes
+func (p *Plugin) PoolHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// accounting could be disabled or not done yet
+		usage := p.poolUsage.Load()
+		if usage == nil {
+			var err error
+			usage, err = p.updatePoolUsage(r.Context())
+			if err != nil {
+				p.logger.Error("Debug endpoint error get pool usage", zap.Error(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(usage); err != nil {
+			p.logger.Error("Debug endpoint error write response", zap.Error(err))
+		}
+	})
+}
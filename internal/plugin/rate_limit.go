@@ -0,0 +1,90 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimitExemptMethods read-only rpc methods, which are never rate limited,
+// so CO keeps probing and discovering plugin while mutating calls are throttled
+var rateLimitExemptMethods = map[string]bool{
+	"/csi.v1.Identity/GetPluginInfo":               true,
+	"/csi.v1.Identity/GetPluginCapabilities":       true,
+	"/csi.v1.Identity/Probe":                       true,
+	"/csi.v1.Controller/ControllerGetCapabilities": true,
+	"/csi.v1.Controller/ControllerGetVolume":       true,
+	"/csi.v1.Controller/ListVolumes":               true,
+	"/csi.v1.Controller/GetCapacity":               true,
+	"/csi.v1.Node/NodeGetCapabilities":             true,
+	"/csi.v1.Node/NodeGetInfo":                     true,
+	"/csi.v1.Node/NodeGetVolumeStats":              true,
+	"/grpc.health.v1.Health/Check":                 true,
+}
+
+// tokenBucket requests rate limiter, refilled with rate tokens per second up to burst tokens
+type tokenBucket struct {
+	// rate tokens added per second
+	rate float64
+	// burst maximum count of tokens
+	burst float64
+	// mu guards fields below
+	mu sync.Mutex
+	// tokens currently available tokens
+	tokens float64
+	// last time of last refill
+	last time.Time
+}
+
+// newTokenBucket returns full token bucket
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// allow takes token and returns true if bucket isn't empty
+func (b *tokenBucket) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+		b.last = now
+	}
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// isRateLimited returns true if rpc call of given method exceeds requests rate limit
+func (p *Plugin) isRateLimited(method string) bool {
+	if p.rateLimiter == nil || rateLimitExemptMethods[method] {
+		return false
+	}
+	return !p.rateLimiter.allow(time.Now())
+}
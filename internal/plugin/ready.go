@@ -0,0 +1,61 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+)
+
+// markReady checks storage is accessible and creates ready file. Does nothing if ready file is not configured
+func (p *Plugin) markReady(ctx context.Context) error {
+	if p.opts.ReadyFile == "" {
+		return nil
+	}
+
+	if err := p.checkStorage(ctx); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(p.opts.ReadyFile, nil, 0644); err != nil {
+		return fmt.Errorf("error create ready file: %w", err)
+	}
+
+	p.logger.Info("Plugin is ready", zap.String("ready_file", p.opts.ReadyFile))
+	return nil
+}
+
+// checkStorage checks storage is accessible
+func (p *Plugin) checkStorage(ctx context.Context) error {
+	if _, err := p.volumeController.GetCapacity(ctx, ""); err != nil {
+		return fmt.Errorf("storage self-check failed: %w", err)
+	}
+	return nil
+}
+
+// unmarkReady removes ready file. Does nothing if ready file is not configured
+func (p *Plugin) unmarkReady() {
+	if p.opts.ReadyFile == "" {
+		return
+	}
+
+	if err := os.Remove(p.opts.ReadyFile); err != nil && !os.IsNotExist(err) {
+		p.logger.Error("Error remove ready file", zap.String("ready_file", p.opts.ReadyFile), zap.Error(err))
+	}
+}
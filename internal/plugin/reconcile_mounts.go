@@ -0,0 +1,150 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"go.uber.org/zap"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runMountsReconciler reconciles mounts on start, e.g. after node or kubelet restart, and then periodically
+func (p *Plugin) runMountsReconciler(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.ReconcileMountsInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := p.ReconcileMounts(ctx); err != nil {
+			p.logger.Error("Mounts reconciliation error", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ReconcileMounts cross-references mounts under kubelet dir with volume images and their loop devices.
+// Mounts of devices bound to deleted images are orphaned: they are logged, and unmounted with their devices detached
+// if cleanup is enabled. Attached volumes without any mount are only logged, since they could be in the middle of stage
+func (p *Plugin) ReconcileMounts(ctx context.Context) error {
+	orphanedDevices, err := p.volumeController.GetOrphanedDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("error get orphaned devices: %w", err)
+	}
+
+	orphanedMounts := 0
+	for device, image := range orphanedDevices {
+		refs, err := p.mounter.GetMountRefs(ctx, device)
+		if err != nil {
+			return fmt.Errorf("error get device %s mount refs: %w", device, err)
+		}
+
+		kubeletRefs := make([]string, 0, len(refs))
+		for _, ref := range refs {
+			if p.isUnderKubeletDir(ref) {
+				kubeletRefs = append(kubeletRefs, ref)
+			}
+		}
+		orphanedMounts += len(kubeletRefs)
+
+		p.logger.Warn("Loop device is bound to deleted volume image",
+			zap.String("device", device),
+			zap.String("image", image),
+			zap.Strings("mounts", refs),
+		)
+
+		if !p.opts.ReconcileMountsCleanup {
+			continue
+		}
+
+		if err := p.cleanupOrphanedDevice(ctx, device, refs, kubeletRefs); err != nil {
+			p.logger.Error("Error clean orphaned device up",
+				zap.String("device", device),
+				zap.String("image", image),
+				zap.Error(err),
+			)
+		}
+	}
+	metrics.OrphanedMounts.Set(float64(orphanedMounts))
+
+	attached, err := p.volumeController.GetAttachedDevices(ctx)
+	if err != nil {
+		return fmt.Errorf("error get attached devices: %w", err)
+	}
+
+	staged := p.getStagedVolumes()
+	for volumeId, device := range attached {
+		if staged[volumeId] != "" || p.isCompacting(volumeId) {
+			continue
+		}
+
+		refs, err := p.mounter.GetMountRefs(ctx, device)
+		if err != nil {
+			return fmt.Errorf("error get device %s mount refs: %w", device, err)
+		}
+
+		if len(refs) == 0 {
+			p.logger.Warn("Volume is attached to loop device, but isn't mounted",
+				zap.String("volume_id", volumeId),
+				zap.String("device", device),
+			)
+		}
+	}
+
+	p.logger.Debug("Mounts were reconciled",
+		zap.Int("orphaned_devices", len(orphanedDevices)),
+		zap.Int("orphaned_mounts", orphanedMounts),
+		zap.Int("attached_volumes", len(attached)),
+	)
+	return nil
+}
+
+// cleanupOrphanedDevice unmounts kubelet mounts of device bound to deleted image and detaches it,
+// unless device is still mounted out of kubelet dir
+func (p *Plugin) cleanupOrphanedDevice(ctx context.Context, device string, refs []string, kubeletRefs []string) error {
+	for _, ref := range kubeletRefs {
+		if err := p.unmount(ctx, ref); err != nil {
+			return fmt.Errorf("error unmount %s: %w", ref, err)
+		}
+		p.logger.Warn("Orphaned mount was unmounted", zap.String("device", device), zap.String("target", ref))
+	}
+
+	if len(refs) > len(kubeletRefs) {
+		p.logger.Warn("Orphaned device is mounted out of kubelet dir, so it's kept attached", zap.String("device", device))
+		return nil
+	}
+
+	if err := p.volumeController.DetachOrphanedDevice(ctx, device); err != nil {
+		return fmt.Errorf("error detach device: %w", err)
+	}
+	p.logger.Warn("Orphaned device was detached", zap.String("device", device))
+
+	return nil
+}
+
+// isUnderKubeletDir returns true if path is inside kubelet dir, e.g. staging or pod volume path
+func (p *Plugin) isUnderKubeletDir(path string) bool {
+	dir := filepath.Clean(p.opts.KubeletDir)
+	return strings.HasPrefix(filepath.Clean(path), dir+string(filepath.Separator))
+}
@@ -0,0 +1,112 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"go.uber.org/zap"
+	"time"
+)
+
+const (
+	// unmountRungPlain plain unmount rung of unmount escalation ladder
+	unmountRungPlain = "plain"
+	// unmountRungLazy lazy unmount rung of unmount escalation ladder
+	unmountRungLazy = "lazy"
+)
+
+// unmount unmounts target climbing escalation ladder: plain unmount attempts with exponential backoff,
+// then lazy unmount if enabled. Busy target is usually released in a moment, so it's retried before giving up.
+// Context deadline stops the ladder, the last error is returned
+func (p *Plugin) unmount(ctx context.Context, target string) error {
+	attempts := p.opts.UnmountRetries
+	if attempts < 1 {
+		attempts = 1
+	}
+	backoff := p.opts.UnmountRetryBackoff
+
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		if attempt > 1 {
+			if waitErr := waitBackoff(ctx, backoff); waitErr != nil {
+				p.logger.Warn("Unmount retries stopped by context",
+					zap.String("target", target),
+					zap.Int("attempt", attempt),
+					zap.Error(waitErr),
+				)
+				break
+			}
+			backoff *= 2
+		}
+
+		if err = p.mounter.Unmount(ctx, target); err == nil {
+			if attempt > 1 {
+				p.logger.Info("Target was unmounted after retries",
+					zap.String("target", target),
+					zap.Int("attempt", attempt),
+				)
+			}
+			metrics.UnmountsTotal.WithLabelValues("success", unmountRungPlain).Inc()
+			return nil
+		}
+
+		p.logger.Warn("Unmount attempt failed",
+			zap.String("target", target),
+			zap.String("rung", unmountRungPlain),
+			zap.Int("attempt", attempt),
+			zap.Int("attempts", attempts),
+			zap.Error(err),
+		)
+	}
+
+	if !p.opts.LazyUnmount || ctx.Err() != nil {
+		metrics.UnmountsTotal.WithLabelValues("failure", unmountRungPlain).Inc()
+		return err
+	}
+
+	p.logger.Warn("Plain unmount attempts exhausted, unmount lazily",
+		zap.String("target", target),
+		zap.String("rung", unmountRungLazy),
+	)
+
+	if lazyErr := p.mounter.UnmountLazy(ctx, target); lazyErr != nil {
+		p.logger.Error("Lazy unmount failed",
+			zap.String("target", target),
+			zap.String("rung", unmountRungLazy),
+			zap.Error(lazyErr),
+		)
+		metrics.UnmountsTotal.WithLabelValues("failure", unmountRungLazy).Inc()
+		return lazyErr
+	}
+
+	metrics.UnmountsTotal.WithLabelValues("success", unmountRungLazy).Inc()
+	return nil
+}
+
+// waitBackoff waits for given delay or context done
+func waitBackoff(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
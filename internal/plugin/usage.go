@@ -0,0 +1,177 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"github.com/reinstall/csi-local-sparse/internal/volumes"
+	"go.uber.org/zap"
+	"time"
+)
+
+// trackStagedVolume remembers staging path of volume, so usage sampler can check it
+func (p *Plugin) trackStagedVolume(volumeId string, stagingPath string, readOnly bool) {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	p.stagedVolumes[volumeId] = stagingPath
+	if readOnly {
+		p.stagedReadOnlyVolumes[volumeId] = true
+	} else {
+		delete(p.stagedReadOnlyVolumes, volumeId)
+	}
+}
+
+// isStagedReadOnly returns true if volume was staged read-only by this instance
+func (p *Plugin) isStagedReadOnly(volumeId string) bool {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	return p.stagedReadOnlyVolumes[volumeId]
+}
+
+// untrackStagedVolume forgets staging path of volume
+func (p *Plugin) untrackStagedVolume(volumeId string) {
+	p.stagedVolumesMu.Lock()
+	delete(p.stagedVolumes, volumeId)
+	delete(p.stagedReadOnlyVolumes, volumeId)
+	p.stagedVolumesMu.Unlock()
+
+	metrics.VolumeUsageRatio.DeleteLabelValues(volumeId)
+	metrics.VolumeUsageHighWatermarkTotal.DeleteLabelValues(volumeId)
+	for _, m := range []*prometheus.GaugeVec{
+		metrics.VolumeFilesystemInfo,
+		metrics.VolumeDeviceReadIOs,
+		metrics.VolumeDeviceReadBytes,
+		metrics.VolumeDeviceWriteIOs,
+		metrics.VolumeDeviceWriteBytes,
+	} {
+		m.DeletePartialMatch(prometheus.Labels{"volume_id": volumeId})
+	}
+}
+
+// getStagedVolumes returns copy of tracked staging paths by volume id
+func (p *Plugin) getStagedVolumes() map[string]string {
+	p.stagedVolumesMu.Lock()
+	defer p.stagedVolumesMu.Unlock()
+
+	staged := make(map[string]string, len(p.stagedVolumes))
+	for volumeId, stagingPath := range p.stagedVolumes {
+		staged[volumeId] = stagingPath
+	}
+	return staged
+}
+
+// runUsageSampler periodically checks usage of staged volumes until context is done
+func (p *Plugin) runUsageSampler(ctx context.Context) {
+	ticker := time.NewTicker(p.opts.UsageCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for volumeId, stagingPath := range p.getStagedVolumes() {
+			stats, err := p.volumeController.GetVolumeStats(ctx, stagingPath)
+			if err != nil {
+				p.logger.Debug("Usage sampler can't get volume stats",
+					zap.String("volume_id", volumeId),
+					zap.String("path", stagingPath),
+					zap.Error(err),
+				)
+				continue
+			}
+
+			p.checkUsageWatermark(volumeId, stagingPath, stats)
+		}
+	}
+}
+
+// checkUsageWatermark updates usage metric and warns when volume usage exceeds configured threshold
+func (p *Plugin) checkUsageWatermark(volumeId string, path string, stats *volumes.VolumeStatistics) {
+	if stats.TotalBytes <= 0 {
+		return
+	}
+
+	ratio := float64(stats.UsedBytes) / float64(stats.TotalBytes)
+	metrics.VolumeUsageRatio.WithLabelValues(volumeId).Set(ratio)
+
+	if p.opts.UsageWarningThreshold <= 0 || ratio < p.opts.UsageWarningThreshold {
+		return
+	}
+
+	metrics.VolumeUsageHighWatermarkTotal.WithLabelValues(volumeId).Inc()
+	p.logger.Warn("Volume usage exceeds warning threshold",
+		zap.String("volume_id", volumeId),
+		zap.String("path", path),
+		zap.Float64("usage_ratio", ratio),
+		zap.Float64("threshold", p.opts.UsageWarningThreshold),
+		zap.Int64("used_bytes", stats.UsedBytes),
+		zap.Int64("total_bytes", stats.TotalBytes),
+	)
+}
+
+// reportFilesystemType exports filesystem type of volume mounted to path and returns it.
+// Failures are only logged, because filesystem type is informational
+func (p *Plugin) reportFilesystemType(ctx context.Context, volumeId string, path string) string {
+	fsType, err := p.mounter.GetMountFsType(ctx, path)
+	if err != nil || fsType == "" {
+		p.logger.Debug("Can't find volume filesystem type", zap.String("volume_id", volumeId), zap.String("path", path), zap.Error(err))
+		return ""
+	}
+
+	// filesystem type of volume could change only with reformat, but keep single series anyway
+	metrics.VolumeFilesystemInfo.DeletePartialMatch(prometheus.Labels{"volume_id": volumeId})
+	metrics.VolumeFilesystemInfo.WithLabelValues(volumeId, fsType).Set(1)
+	return fsType
+}
+
+// reportDeviceIOStats logs and exports io statistics of volume loop device. Failures are only logged,
+// because io statistics are informational
+func (p *Plugin) reportDeviceIOStats(ctx context.Context, volumeId string) {
+	dev, err := p.volumeController.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil || dev == "" {
+		p.logger.Debug("Can't find volume device to report io stats", zap.String("volume_id", volumeId), zap.Error(err))
+		return
+	}
+
+	stats, err := p.volumeController.GetDeviceIOStats(ctx, dev)
+	if err != nil {
+		p.logger.Warn("Error get volume device io stats", zap.String("volume_id", volumeId), zap.String("device", dev), zap.Error(err))
+		return
+	}
+
+	metrics.VolumeDeviceReadIOs.WithLabelValues(volumeId, dev).Set(float64(stats.ReadIOs))
+	metrics.VolumeDeviceReadBytes.WithLabelValues(volumeId, dev).Set(float64(stats.ReadBytes))
+	metrics.VolumeDeviceWriteIOs.WithLabelValues(volumeId, dev).Set(float64(stats.WriteIOs))
+	metrics.VolumeDeviceWriteBytes.WithLabelValues(volumeId, dev).Set(float64(stats.WriteBytes))
+
+	p.logger.Info("Volume device io statistics",
+		zap.String("volume_id", volumeId),
+		zap.String("device", dev),
+		zap.Uint64("read_ios", stats.ReadIOs),
+		zap.Uint64("read_bytes", stats.ReadBytes),
+		zap.Uint64("write_ios", stats.WriteIOs),
+		zap.Uint64("write_bytes", stats.WriteBytes),
+		zap.Uint64("in_flight", stats.InFlight),
+	)
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.uber.org/zap"
+)
+
+// getVolumeCondition returns abnormal condition if filesystem of volume mounted to path became read-only,
+// while volume was staged read-write. Recovers filesystem when RemountReadOnlyRecovery option is set
+func (p *Plugin) getVolumeCondition(ctx context.Context, volumeId string, path string) *csi.VolumeCondition {
+	readOnly, err := p.mounter.IsFilesystemReadOnly(ctx, path)
+	if err != nil {
+		p.logger.Error("Error check if volume filesystem is read-only", zap.String("volume_id", volumeId), zap.Error(err))
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("error check volume filesystem: %v", err)}
+	}
+
+	if !readOnly || p.isStagedReadOnly(volumeId) {
+		return &csi.VolumeCondition{Abnormal: false, Message: "volume is healthy"}
+	}
+
+	p.logger.Error("Volume filesystem was remounted read-only, probably because of io errors",
+		zap.String("volume_id", volumeId),
+		zap.String("path", path),
+	)
+
+	if !p.opts.RemountReadOnlyRecovery {
+		return &csi.VolumeCondition{Abnormal: true, Message: "volume filesystem is read-only, probably because of io errors"}
+	}
+
+	if err := p.recoverReadOnlyVolume(ctx, volumeId); err != nil {
+		p.logger.Error("Error recover read-only volume filesystem", zap.String("volume_id", volumeId), zap.Error(err))
+		return &csi.VolumeCondition{Abnormal: true, Message: fmt.Sprintf("volume filesystem is read-only, recovery failed: %v", err)}
+	}
+
+	p.logger.Warn("Volume filesystem was remounted read-write", zap.String("volume_id", volumeId))
+	return &csi.VolumeCondition{Abnormal: false, Message: "volume filesystem was remounted read-write after check"}
+}
+
+// recoverReadOnlyVolume remounts staging path of volume read-write if device filesystem check is clean
+func (p *Plugin) recoverReadOnlyVolume(ctx context.Context, volumeId string) error {
+	stagingPath, ok := p.getStagedVolumes()[volumeId]
+	if !ok {
+		return fmt.Errorf("volume wasn't staged by this instance")
+	}
+
+	if err := p.volumeController.CheckFileSystem(ctx, volumeId); err != nil {
+		return fmt.Errorf("error check filesystem: %w", err)
+	}
+
+	if err := p.mounter.Remount(ctx, stagingPath, []string{"rw"}); err != nil {
+		return fmt.Errorf("error remount staging path: %w", err)
+	}
+
+	return nil
+}
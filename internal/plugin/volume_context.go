@@ -0,0 +1,64 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+)
+
+// selectVolumeContext returns create parameters of configured keys, which are returned in volume context, so they
+// reach node calls. Nil if no key is configured or given
+func (p *Plugin) selectVolumeContext(parameters map[string]string) map[string]string {
+	var volumeContext map[string]string
+	for _, key := range p.opts.VolumeContextKeys {
+		value, ok := parameters[key]
+		if !ok {
+			continue
+		}
+
+		if volumeContext == nil {
+			volumeContext = map[string]string{}
+		}
+		volumeContext[key] = value
+	}
+	return volumeContext
+}
+
+// volumeName returns human-friendly volume name <pvc-namespace>-<pvc-name> from create parameters or volume context,
+// empty if pvc isn't known
+func volumeName(values map[string]string) string {
+	pvcName, pvcNamespace := values[paramPvcName], values[paramPvcNamespace]
+	if pvcName == "" || pvcNamespace == "" {
+		return ""
+	}
+	return fmt.Sprintf("%s-%s", pvcNamespace, pvcName)
+}
+
+// ensureNameLink creates name link of volume created without pvc name known, once it's propagated in volume context.
+// Failure is only logged, because the link is a convenience for humans
+func (p *Plugin) ensureNameLink(ctx context.Context, volumeId string, volumeContext map[string]string) {
+	name := volumeName(volumeContext)
+	if name == "" {
+		return
+	}
+
+	if err := p.volumeController.CreateNameLink(ctx, volumeId, name); err != nil {
+		p.logger.Warn("Error create name link from volume context", zap.String("volume_id", volumeId), zap.String("name", name), zap.Error(err))
+	}
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// maxVolumes returns maximum count of volumes on node
+func (p *Plugin) maxVolumes() int {
+	if p.opts.MaxVolumesPerNode > 0 {
+		return p.opts.MaxVolumesPerNode
+	}
+	return maxVolumesPerNode
+}
+
+// reserveVolume counts volume as existing one, so concurrent creates can't exceed volumes per node limit together.
+// Returns ResourceExhausted if node already has maximum count of volumes. Existing volume is always reserved,
+// so repeated create stays idempotent. Returns true if volume wasn't counted before and must be released on failure
+func (p *Plugin) reserveVolume(ctx context.Context, volumeId string) (bool, error) {
+	p.volumeIdsMu.Lock()
+	defer p.volumeIdsMu.Unlock()
+
+	// images are listed once, then kept up to date on create and delete
+	if p.volumeIds == nil {
+		volumeIds, err := p.volumeController.ListVolumeIds(ctx)
+		if err != nil {
+			return false, fmt.Errorf("error list volumes: %w", err)
+		}
+
+		p.volumeIds = make(map[string]bool, len(volumeIds))
+		for _, id := range volumeIds {
+			p.volumeIds[id] = true
+		}
+	}
+
+	if p.volumeIds[volumeId] {
+		return false, nil
+	}
+
+	if len(p.volumeIds) >= p.maxVolumes() {
+		return false, status.Errorf(codes.ResourceExhausted, "node already has maximum count of volumes %d", p.maxVolumes())
+	}
+
+	p.volumeIds[volumeId] = true
+	return true, nil
+}
+
+// releaseVolume stops counting volume, e.g. deleted one or the one which failed to be created
+func (p *Plugin) releaseVolume(volumeId string) {
+	p.volumeIdsMu.Lock()
+	defer p.volumeIdsMu.Unlock()
+
+	delete(p.volumeIds, volumeId)
+}
@@ -0,0 +1,59 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// SetAutoclear sets autoclear flag of attached loop device, so kernel detaches it when its last user closes it.
+// Device must be held open, e.g. mounted, otherwise it is detached right away when this call closes it
+func (s *SparseFileVolumeController) SetAutoclear(_ context.Context, device string) error {
+	s.logger.Debug("SetAutoclear called", zap.String("device", device))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	fd, err := unix.Open(device, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("error open device: %w", err)
+	}
+	defer func() { _ = unix.Close(fd) }()
+
+	info, err := unix.IoctlLoopGetStatus64(fd)
+	if err != nil {
+		return fmt.Errorf("error get loop device status: %w", err)
+	}
+
+	if info.Flags&unix.LO_FLAGS_AUTOCLEAR != 0 {
+		return nil
+	}
+
+	info.Flags |= unix.LO_FLAGS_AUTOCLEAR
+	if err := unix.IoctlLoopSetStatus64(fd, info); err != nil {
+		return fmt.Errorf("error set loop device status: %w", err)
+	}
+
+	s.logger.Debug("Loop device autoclear was set", zap.String("device", device))
+	return nil
+}
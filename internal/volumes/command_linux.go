@@ -0,0 +1,147 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"go.uber.org/zap"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// executablePaths cache of executables found in $PATH, missing ones aren't cached, so they are found once installed
+var executablePaths sync.Map
+
+// versionBannerRegexp version line e2fsprogs tools print to stderr on every run, e.g. "mke2fs 1.47.0 (5-Feb-2023)"
+var versionBannerRegexp = regexp.MustCompile(`(?m)^\S+ \d+\.\d+(\.\d+)? \(\d+-\w+-\d+\)\n?`)
+
+// commandOptions optional settings of external command run
+type commandOptions struct {
+	// wrapper command with arguments running the command, e.g. nice, it isn't shown in logs and errors
+	wrapper []string
+	// handledExitCodes non-zero exit codes handled by caller, e.g. corrected errors of e2fsck, so they aren't logged as error
+	handledExitCodes []int
+}
+
+// runCommand runs external command and returns its stdout. Stdout and stderr are captured separately:
+// stderr of successful command is logged as warning, since tools like mkfs and resize2fs warn there,
+// failed command is logged with both and returned as CommandError. Duration and failures are exported as metrics,
+// command exited with handled exit code is counted as succeeded
+func runCommand(ctx context.Context, logger *zap.Logger, opts *commandOptions, name string, args ...string) ([]byte, error) {
+	if opts == nil {
+		opts = &commandOptions{}
+	}
+
+	execCmd, execArgs := name, args
+	if len(opts.wrapper) > 0 {
+		execCmd, execArgs = opts.wrapper[0], append(append(append([]string{}, opts.wrapper[1:]...), name), args...)
+	}
+
+	for _, executable := range []string{name, execCmd} {
+		if _, err := lookupExecutable(executable); err != nil {
+			return nil, err
+		}
+	}
+
+	logger.Debug("Exec command", zap.String("cmd", execCmd), zap.Strings("args", execArgs))
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, execCmd, execArgs...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	err := cmd.Run()
+	duration := time.Since(start)
+
+	if err != nil {
+		cmdErr := newCommandError(name, args, stdout.Bytes(), stderr.Bytes(), err)
+		if isHandledExitCode(cmdErr.ExitCode, opts.handledExitCodes) {
+			metrics.CommandDurationSeconds.WithLabelValues(name, "success").Observe(duration.Seconds())
+		} else {
+			metrics.CommandDurationSeconds.WithLabelValues(name, "failure").Observe(duration.Seconds())
+			metrics.CommandFailuresTotal.WithLabelValues(name, strconv.Itoa(cmdErr.ExitCode)).Inc()
+			logger.Error("Error exec command",
+				zap.String("cmd", name),
+				zap.Strings("args", args),
+				zap.ByteString("stdout", stdout.Bytes()),
+				zap.ByteString("stderr", stderr.Bytes()),
+				zap.Duration("duration", duration),
+				zap.Error(err),
+			)
+		}
+		return stdout.Bytes(), cmdErr
+	}
+
+	metrics.CommandDurationSeconds.WithLabelValues(name, "success").Observe(duration.Seconds())
+
+	if warnings := bytes.TrimSpace(versionBannerRegexp.ReplaceAll(stderr.Bytes(), nil)); len(warnings) > 0 {
+		logger.Warn("Command succeeded with stderr output",
+			zap.String("cmd", name),
+			zap.Strings("args", args),
+			zap.ByteString("stderr", warnings),
+		)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// lookupExecutable returns path of executable found in $PATH, lookup result is cached
+func lookupExecutable(name string) (string, error) {
+	if path, ok := executablePaths.Load(name); ok {
+		return path.(string), nil
+	}
+
+	path, err := exec.LookPath(name)
+	if err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return "", fmt.Errorf("%q executable not found in $PATH", name)
+		}
+		return "", fmt.Errorf("error on check executable: %w", err)
+	}
+
+	executablePaths.Store(name, path)
+	return path, nil
+}
+
+// isHandledExitCode returns true if exit code is one of handled by caller
+func isHandledExitCode(exitCode int, handled []int) bool {
+	for _, code := range handled {
+		if code == exitCode {
+			return true
+		}
+	}
+	return false
+}
+
+// asCommandError returns CommandError of failed command run, nil if command wasn't run
+func asCommandError(err error) *CommandError {
+	var cmdErr *CommandError
+	if errors.As(err, &cmdErr) {
+		return cmdErr
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+)
+
+// TrimFileSystem discards unused blocks of filesystem mounted to target. Loop device punches holes in volume image
+// on discard, so space freed inside volume is returned to images dir filesystem
+func (s *SparseFileVolumeController) TrimFileSystem(ctx context.Context, target string) error {
+	s.logger.Debug("TrimFileSystem called", zap.String("target", target))
+
+	if target == "" {
+		return fmt.Errorf("target can't be empty")
+	}
+
+	fstrimCmd := "fstrim"
+	args := []string{"-v", target}
+
+	out, err := runCommand(ctx, s.logger, nil, fstrimCmd, args...)
+	if err != nil {
+		return err
+	}
+
+	s.logger.Debug("Filesystem was trimmed successfully", zap.String("target", target), zap.ByteString("output", out))
+	return nil
+}
+
+// SparsifyImage rewrites image of detached volume with "cp --sparse=always", so zeroed blocks become holes, and
+// atomically replaces the image with the copy. With compress the copy gets compression attribute first, it's ignored
+// with a warning by filesystems without transparent compression
+func (s *SparseFileVolumeController) SparsifyImage(ctx context.Context, volumeId string, compress bool) error {
+	s.logger.Debug("SparsifyImage called", zap.String("volume_id", volumeId), zap.Bool("compress", compress))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	info, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrorVolumeNotFound
+		}
+		return fmt.Errorf("error stat image: %w", err)
+	}
+
+	if err := s.checkDetached(ctx, volumeId); err != nil {
+		return err
+	}
+
+	// stale copy of interrupted compaction is never used. Suffix differs from one of create, so compaction never
+	// removes or replaces image being created
+	tmpFilename := filename + ".compact"
+	if err := os.Remove(tmpFilename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error remove stale image copy: %w", err)
+	}
+	defer func() { _ = os.Remove(tmpFilename) }()
+
+	if compress {
+		s.setCompression(ctx, tmpFilename)
+	}
+
+	cpCmd := "cp"
+	// timestamps are kept, so orphan gc still sees the real age of volume
+	args := []string{"--sparse=always", "--preserve=mode,ownership,timestamps", filename, tmpFilename}
+	if _, err := runCommand(ctx, s.logger, s.heavyCommandOptions(), cpCmd, args...); err != nil {
+		return err
+	}
+
+	if err := syncPath(tmpFilename); err != nil {
+		return fmt.Errorf("error sync image copy: %w", err)
+	}
+
+	// volume could be attached while copying, its writes would be lost with replaced image
+	if err := s.checkDetached(ctx, volumeId); err != nil {
+		return err
+	}
+
+	// image could be deleted or recreated while copying, copy of the old one must neither resurrect nor replace it
+	current, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return ErrorVolumeNotFound
+		}
+		return fmt.Errorf("error stat image: %w", err)
+	}
+
+	if !os.SameFile(info, current) {
+		return fmt.Errorf("image was replaced while copying: %w", ErrorVolumeInUse)
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return fmt.Errorf("error replace image: %w", err)
+	}
+
+	if err := syncFileAndDir(filename); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Volume image was sparsified successfully", zap.String("volume_id", volumeId))
+	return nil
+}
+
+// checkDetached returns ErrorVolumeInUse if volume image is attached to loop device
+func (s *SparseFileVolumeController) checkDetached(ctx context.Context, volumeId string) error {
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get loop device: %w", err)
+	}
+
+	if dev != "" {
+		return fmt.Errorf("image is attached to %s: %w", dev, ErrorVolumeInUse)
+	}
+	return nil
+}
+
+// setCompression creates empty file with compression attribute, so data copied into it is compressed.
+// Failure is only logged, because most filesystems don't support compression
+func (s *SparseFileVolumeController) setCompression(ctx context.Context, filename string) {
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		s.logger.Warn("Error create image copy, skip compression", zap.String("filename", filename), zap.Error(err))
+		return
+	}
+	_ = file.Close()
+
+	chattrCmd := "chattr"
+	args := []string{"+c", filename}
+
+	// chattr exits with 1 when filesystem doesn't support the attribute
+	if _, err := runCommand(ctx, s.logger, &commandOptions{handledExitCodes: []int{1}}, chattrCmd, args...); err != nil {
+		s.logger.Warn("Filesystem doesn't support compression, image copy is not compressed",
+			zap.String("filename", filename),
+			zap.Error(err),
+		)
+	}
+}
@@ -0,0 +1,77 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// errorSeekDataUnsupported filesystem can't report data extents with SEEK_DATA and SEEK_HOLE
+var errorSeekDataUnsupported = errors.New("SEEK_DATA is not supported")
+
+// dataExtentsSize returns sum of data extent sizes of file found with SEEK_DATA and SEEK_HOLE, so holes aren't
+// counted. Unlike st_blocks it doesn't include filesystem metadata blocks of file. Note that ext4 and xfs report
+// allocated but never written extents, e.g. made by fallocate, as holes
+func dataExtentsSize(ctx context.Context, filename string) (int64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = file.Close() }()
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, fmt.Errorf("error stat file: %w", err)
+	}
+
+	size := info.Size()
+	total := int64(0)
+	offset := int64(0)
+	for offset < size {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+
+		dataStart, err := unix.Seek(int(file.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data after offset, the rest of file is a hole
+			break
+		}
+		if errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return 0, errorSeekDataUnsupported
+		}
+		if err != nil {
+			return 0, fmt.Errorf("error seek data: %w", err)
+		}
+
+		dataEnd, err := unix.Seek(int(file.Fd()), dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return 0, fmt.Errorf("error seek hole: %w", err)
+		}
+
+		total += dataEnd - dataStart
+		offset = dataEnd
+	}
+
+	return total, nil
+}
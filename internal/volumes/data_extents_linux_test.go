@@ -0,0 +1,104 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDataExtentsSize(t *testing.T) {
+	const block = 1 << 20
+
+	tests := []struct {
+		name string
+		// size logical file size
+		size int64
+		// data offsets of written blocks
+		data []int64
+		want int64
+	}{
+		{name: "empty file", size: 0, want: 0},
+		{name: "only hole", size: 8 * block, want: 0},
+		{name: "data at start", size: 8 * block, data: []int64{0}, want: block},
+		{name: "data at end", size: 8 * block, data: []int64{7 * block}, want: block},
+		{name: "data between holes", size: 8 * block, data: []int64{2 * block, 5 * block}, want: 2 * block},
+		{name: "adjacent data", size: 8 * block, data: []int64{3 * block, 4 * block}, want: 2 * block},
+		{name: "no holes", size: 2 * block, data: []int64{0, block}, want: 2 * block},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "image")
+			file, err := os.Create(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := file.Truncate(tt.size); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, block)
+			for i := range buf {
+				buf[i] = 1
+			}
+			for _, offset := range tt.data {
+				if _, err := file.WriteAt(buf, offset); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := file.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := dataExtentsSize(context.Background(), filename)
+			if errors.Is(err, errorSeekDataUnsupported) {
+				t.Skip("filesystem of temp dir doesn't support SEEK_DATA")
+			}
+			if err != nil {
+				t.Fatalf("dataExtentsSize() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("dataExtentsSize() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDataExtentsSizeCancelled(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "image")
+	if err := os.WriteFile(filename, []byte("data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := dataExtentsSize(ctx, filename); !errors.Is(err, context.Canceled) {
+		t.Errorf("dataExtentsSize() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDataExtentsSizeNotExist(t *testing.T) {
+	if _, err := dataExtentsSize(context.Background(), filepath.Join(t.TempDir(), "image")); !os.IsNotExist(err) {
+		t.Errorf("dataExtentsSize() error = %v, want not exist error", err)
+	}
+}
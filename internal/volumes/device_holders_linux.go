@@ -0,0 +1,62 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// isDeviceBusyOutput returns true if losetup output reports device still open by some process
+func isDeviceBusyOutput(out []byte) bool {
+	return strings.Contains(strings.ToLower(string(out)), "device or resource busy")
+}
+
+// findDeviceHolders returns processes holding device open as "<pid> (<command>)", found by scanning /proc/*/fd.
+// Processes which fds can't be read, e.g. exited during scan, are skipped
+func findDeviceHolders(device string) ([]string, error) {
+	fdLinks, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, fmt.Errorf("error list process fds: %w", err)
+	}
+
+	var holders []string
+	seen := map[string]bool{}
+	for _, fdLink := range fdLinks {
+		target, err := os.Readlink(fdLink)
+		if err != nil || target != device {
+			continue
+		}
+
+		// /proc/<pid>/fd/<fd>
+		procDir := filepath.Dir(filepath.Dir(fdLink))
+		pid := filepath.Base(procDir)
+		if seen[pid] {
+			continue
+		}
+		seen[pid] = true
+
+		comm, _ := os.ReadFile(filepath.Join(procDir, "comm"))
+		holders = append(holders, fmt.Sprintf("%s (%s)", pid, strings.TrimSpace(string(comm))))
+	}
+
+	return holders, nil
+}
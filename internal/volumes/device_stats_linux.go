@@ -0,0 +1,140 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// sectorBytes size of sector in /sys/block/<dev>/stat, independent of device logical sector size
+	sectorBytes = 512
+)
+
+// GetDeviceIOStats returns io statistics of block device from /sys/block/<dev>/stat
+func (s *SparseFileVolumeController) GetDeviceIOStats(_ context.Context, device string) (*DeviceIOStats, error) {
+	s.logger.Debug("GetDeviceIOStats called", zap.String("device", device))
+
+	if device == "" {
+		return nil, fmt.Errorf("device can't be empty")
+	}
+
+	statFile := filepath.Join("/sys/block", filepath.Base(device), "stat")
+	data, err := os.ReadFile(statFile)
+	if err != nil {
+		return nil, fmt.Errorf("error read device stat file: %w", err)
+	}
+
+	// https://www.kernel.org/doc/html/latest/block/stat.html
+	fields := strings.Fields(string(data))
+	if len(fields) < 9 {
+		return nil, fmt.Errorf("unexpected format of %s: %q", statFile, string(data))
+	}
+
+	values := make([]uint64, 9)
+	for i := range values {
+		values[i], err = strconv.ParseUint(fields[i], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("error parse %s field %d: %w", statFile, i, err)
+		}
+	}
+
+	stats := &DeviceIOStats{
+		ReadIOs:    values[0],
+		ReadBytes:  values[2] * sectorBytes,
+		WriteIOs:   values[4],
+		WriteBytes: values[6] * sectorBytes,
+		InFlight:   values[8],
+	}
+
+	s.logger.Debug("Finish read device io stats",
+		zap.String("device", device),
+		zap.Uint64("read_ios", stats.ReadIOs),
+		zap.Uint64("read_bytes", stats.ReadBytes),
+		zap.Uint64("write_ios", stats.WriteIOs),
+		zap.Uint64("write_bytes", stats.WriteBytes),
+		zap.Uint64("in_flight", stats.InFlight),
+	)
+	return stats, nil
+}
+
+// isNoFreeLoopDeviceOutput returns true if losetup output reports exhausted loop devices pool
+func isNoFreeLoopDeviceOutput(out []byte) bool {
+	output := strings.ToLower(string(out))
+	return strings.Contains(output, "could not find any free loop device") ||
+		strings.Contains(output, "no free loop device")
+}
+
+// GetAttachedDevices returns loop devices of all attached volumes by volume id from sysfs backing files,
+// so it doesn't run losetup for each volume. Devices of deleted images are skipped
+func (s *SparseFileVolumeController) GetAttachedDevices(_ context.Context) (map[string]string, error) {
+	s.logger.Debug("GetAttachedDevices called")
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, fmt.Errorf("error list loop devices: %w", err)
+	}
+
+	poolDirs := make(map[string]bool)
+	for _, dir := range s.getPoolDirs() {
+		poolDirs[filepath.Clean(dir)] = true
+	}
+
+	devices := make(map[string]string)
+	for _, backingFile := range backingFiles {
+		data, err := os.ReadFile(backingFile)
+		if err != nil {
+			// device could be detached since listing
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error read loop device backing file: %w", err)
+		}
+
+		backing := strings.TrimSpace(string(data))
+		if strings.HasSuffix(backing, deletedBackingFileSuffix) || !poolDirs[filepath.Dir(backing)] {
+			continue
+		}
+
+		volumeId, ok := s.parseImageFileName(filepath.Base(backing))
+		if !ok {
+			continue
+		}
+
+		// /sys/block/<dev>/loop/backing_file
+		devices[volumeId] = "/dev/" + filepath.Base(filepath.Dir(filepath.Dir(backingFile)))
+	}
+
+	return devices, nil
+}
+
+// countLoopDevicesInUse returns count of loop devices with backing file, -1 if it can't be counted
+func countLoopDevicesInUse() int {
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return -1
+	}
+	return len(backingFiles)
+}
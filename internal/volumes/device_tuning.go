@@ -0,0 +1,62 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// schedulerNameRegexp valid name of block device io scheduler, e.g. "mq-deadline"
+var schedulerNameRegexp = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+// DeviceTuning loop device queue settings. Zero value keeps kernel defaults
+type DeviceTuning struct {
+	// ReadAheadKB read-ahead of device queue in kilobytes
+	ReadAheadKB uint64 `json:"readAheadKb,omitempty"`
+	// Scheduler io scheduler of device queue, e.g. "none" or "mq-deadline"
+	Scheduler string `json:"scheduler,omitempty"`
+}
+
+// IsEmpty returns true if no setting is set
+func (t *DeviceTuning) IsEmpty() bool {
+	return t == nil || (t.ReadAheadKB == 0 && t.Scheduler == "")
+}
+
+// Validate returns error if scheduler name is invalid
+func (t *DeviceTuning) Validate() error {
+	if t != nil && t.Scheduler != "" && !schedulerNameRegexp.MatchString(t.Scheduler) {
+		return fmt.Errorf("invalid io scheduler name %q", t.Scheduler)
+	}
+	return nil
+}
+
+// withDefaults returns settings with unset ones taken from defaults
+func (t *DeviceTuning) withDefaults(defaults DeviceTuning) DeviceTuning {
+	if t == nil {
+		return defaults
+	}
+
+	result := *t
+	if result.ReadAheadKB == 0 {
+		result.ReadAheadKB = defaults.ReadAheadKB
+	}
+	if result.Scheduler == "" {
+		result.Scheduler = defaults.Scheduler
+	}
+	return result
+}
@@ -0,0 +1,91 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// TuneDevice writes read-ahead and io scheduler of attached device to /sys/block/<dev>/queue. Settings of volume
+// override controller's defaults, nothing is written if neither is set. Settings which aren't writable are skipped
+// with a warning
+func (s *SparseFileVolumeController) TuneDevice(_ context.Context, device string, tuning *DeviceTuning) error {
+	s.logger.Debug("TuneDevice called", zap.String("device", device), zap.Any("tuning", tuning))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	settings := tuning.withDefaults(s.opts.DeviceTuning)
+	if settings.IsEmpty() {
+		return nil
+	}
+
+	if err := settings.Validate(); err != nil {
+		return err
+	}
+
+	queueDir := filepath.Join("/sys/block", filepath.Base(device), "queue")
+
+	if settings.ReadAheadKB > 0 {
+		if err := s.writeQueueSetting(device, filepath.Join(queueDir, "read_ahead_kb"), strconv.FormatUint(settings.ReadAheadKB, 10)); err != nil {
+			return err
+		}
+	}
+
+	if settings.Scheduler != "" {
+		if err := s.writeQueueSetting(device, filepath.Join(queueDir, "scheduler"), settings.Scheduler); err != nil {
+			return err
+		}
+	}
+
+	s.logger.Debug("Device was tuned successfully",
+		zap.String("device", device),
+		zap.Uint64("read_ahead_kb", settings.ReadAheadKB),
+		zap.String("scheduler", settings.Scheduler),
+	)
+	return nil
+}
+
+// writeQueueSetting writes value to device queue file. Missing, read-only or not permitted file is skipped with a warning
+func (s *SparseFileVolumeController) writeQueueSetting(device string, filename string, value string) error {
+	err := os.WriteFile(filename, []byte(value), 0)
+	if err == nil {
+		return nil
+	}
+
+	if os.IsNotExist(err) || os.IsPermission(err) || errors.Is(err, syscall.EROFS) {
+		s.logger.Warn("Device queue setting is not writable. Skip tuning",
+			zap.String("device", device),
+			zap.String("filename", filename),
+			zap.Error(err),
+		)
+		return nil
+	}
+
+	// kernel rejects unknown scheduler or out of range value with EINVAL
+	return fmt.Errorf("error write %s of device %s: %w", filepath.Base(filename), device, err)
+}
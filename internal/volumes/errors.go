@@ -0,0 +1,131 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	// commandOutputLimit maximum bytes of command stdout and stderr each included in error message
+	commandOutputLimit = 512
+)
+
+// CommandError failed external command. Err is the error of command run or a domain error recognized from its output
+type CommandError struct {
+	// Cmd command name
+	Cmd string
+	// Args command arguments
+	Args []string
+	// Stdout standard output of command
+	Stdout string
+	// Stderr standard error of command
+	Stderr string
+	// ExitCode exit code of command, -1 if it wasn't started or was killed by signal
+	ExitCode int
+	// Err cause
+	Err error
+}
+
+// newCommandError returns error of failed command with exit code taken from its run error
+func newCommandError(cmd string, args []string, stdout []byte, stderr []byte, err error) *CommandError {
+	exitCode := -1
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	}
+
+	return &CommandError{
+		Cmd:      cmd,
+		Args:     args,
+		Stdout:   string(stdout),
+		Stderr:   string(stderr),
+		ExitCode: exitCode,
+		Err:      err,
+	}
+}
+
+// withCause replaces run error with domain error recognized from command output or exit code
+func (e *CommandError) withCause(cause error) *CommandError {
+	e.Err = cause
+	return e
+}
+
+// Error returns command name, cause and truncated stderr and stdout of command
+func (e *CommandError) Error() string {
+	msg := fmt.Sprintf("error exec command (%s): %v", e.Cmd, e.Err)
+	if stderr := truncateOutput(e.Stderr); stderr != "" {
+		msg += fmt.Sprintf(", stderr: %s", stderr)
+	}
+	if stdout := truncateOutput(e.Stdout); stdout != "" {
+		msg += fmt.Sprintf(", stdout: %s", stdout)
+	}
+	return msg
+}
+
+// Unwrap returns cause
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// truncateOutput returns trimmed command output cut to commandOutputLimit bytes
+func truncateOutput(output string) string {
+	output = strings.TrimSpace(output)
+	if len(output) > commandOutputLimit {
+		return output[:commandOutputLimit] + "..."
+	}
+	return output
+}
+
+// CapacityError storage doesn't have space requested by volume operation. Unwraps to ErrorInsufficientCapacity
+type CapacityError struct {
+	// Requested requested bytes
+	Requested int64
+	// Available available bytes on storage
+	Available int64
+}
+
+// Error returns requested and available space
+func (e *CapacityError) Error() string {
+	return fmt.Sprintf("additional space (%d) is not available, %d bytes is available on storage", e.Requested, e.Available)
+}
+
+// Unwrap returns ErrorInsufficientCapacity
+func (e *CapacityError) Unwrap() error {
+	return ErrorInsufficientCapacity
+}
+
+// FilesystemError filesystem of volume device or image can't be used as is, e.g. it's corrupted or must be checked first
+type FilesystemError struct {
+	// Device device or image file of filesystem
+	Device string
+	// Err cause, usually CommandError wrapping a filesystem error
+	Err error
+}
+
+// Error returns device and cause
+func (e *FilesystemError) Error() string {
+	return fmt.Sprintf("filesystem of %s: %v", e.Device, e.Err)
+}
+
+// Unwrap returns cause
+func (e *FilesystemError) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,783 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	_ VolumeController = (*FakeVolumeController)(nil)
+	_ Mounter          = (*FakeMounter)(nil)
+)
+
+// fakeVolume in-memory volume state
+type fakeVolume struct {
+	// sizeBytes logical volume size
+	sizeBytes int64
+	// fsType current filesystem, empty if not formatted
+	fsType string
+	// fsSizeBytes filesystem size, lags behind sizeBytes until resize
+	fsSizeBytes int64
+	// device attached fake device, empty if not attached
+	device string
+	// metadata persisted volume options
+	metadata VolumeMetadata
+	// modTime time of last volume change
+	modTime time.Time
+}
+
+// FakeVolumeController in-memory VolumeController for tests and csi-sanity runs without root and loop devices
+type FakeVolumeController struct {
+	// capacity total storage pool capacity
+	capacity int64
+	// mu guards fields below
+	mu sync.Mutex
+	// volumes volumes by id
+	volumes map[string]*fakeVolume
+	// nextDevice number of next fake device
+	nextDevice int
+	// mounter fake mounter, used to resolve mounted paths to volumes
+	mounter *FakeMounter
+}
+
+// NewFakeVolumeController returns in-memory volume controller with given pool capacity.
+// Mounter is used to resolve mounted paths in GetVolumeStats
+func NewFakeVolumeController(capacity int64, mounter *FakeMounter) *FakeVolumeController {
+	return &FakeVolumeController{
+		capacity: capacity,
+		volumes:  map[string]*fakeVolume{},
+		mounter:  mounter,
+	}
+}
+
+// Create creates volume if it's not already exists. Fails with ErrorVolumeAlreadyExists if existing volume size differs
+func (f *FakeVolumeController) Create(_ context.Context, volumeId string, _ string, sizeBytes int64) (bool, error) {
+	if volumeId == "" {
+		return false, fmt.Errorf("volumeId can't be empty")
+	}
+
+	if sizeBytes == 0 {
+		return false, fmt.Errorf("size can't be equal 0")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.volumes[volumeId]
+	if !ok {
+		f.volumes[volumeId] = &fakeVolume{sizeBytes: sizeBytes, modTime: time.Now()}
+		return true, nil
+	}
+
+	if v.sizeBytes != sizeBytes {
+		return false, fmt.Errorf("volume size %d differs from requested %d: %w", v.sizeBytes, sizeBytes, ErrorVolumeAlreadyExists)
+	}
+	return false, nil
+}
+
+// CreateFromTemplate fails, because fake controller has no templates
+func (f *FakeVolumeController) CreateFromTemplate(_ context.Context, volumeId string, _ string, template string, _ string, _ int64) (bool, error) {
+	if volumeId == "" {
+		return false, fmt.Errorf("volumeId can't be empty")
+	}
+	return false, fmt.Errorf("template %q: %w", template, ErrorTemplateNotFound)
+}
+
+// Delete deletes volume. Returns nil if volume is not exists
+func (f *FakeVolumeController) Delete(_ context.Context, volumeId string) error {
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.volumes, volumeId)
+	return nil
+}
+
+// GetVolumeStats returns stats of volume mounted to path
+func (f *FakeVolumeController) GetVolumeStats(_ context.Context, path string) (*VolumeStatistics, error) {
+	if path == "" {
+		return nil, fmt.Errorf("path can't be empty")
+	}
+
+	source, _ := f.mounter.GetMountSource(context.Background(), path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, v := range f.volumes {
+		if v.device != "" && v.device == source {
+			return &VolumeStatistics{
+				AvailableBytes:  v.fsSizeBytes,
+				TotalBytes:      v.fsSizeBytes,
+				AvailableInodes: 1024,
+				TotalInodes:     1024,
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no volume mounted to %s", path)
+}
+
+// GetCapacity returns pool capacity minus logical sizes of all volumes. All pools share the same capacity
+func (f *FakeVolumeController) GetCapacity(_ context.Context, _ string) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	available := f.capacity
+	for _, v := range f.volumes {
+		available -= v.sizeBytes
+	}
+
+	if available < 0 {
+		available = 0
+	}
+	return available, nil
+}
+
+// GetVolumeSize returns logical volume size
+func (f *FakeVolumeController) GetVolumeSize(_ context.Context, volumeId string) (int64, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return v.sizeBytes, nil
+}
+
+// ExpandVolumeSize grows logical volume size. Does nothing if newSize <= currentSize
+func (f *FakeVolumeController) ExpandVolumeSize(_ context.Context, volumeId string, newSizeBytes int64) error {
+	if newSizeBytes <= 0 {
+		return fmt.Errorf("size can't be less or equal 0")
+	}
+
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if newSizeBytes > v.sizeBytes {
+		v.sizeBytes = newSizeBytes
+	}
+	return nil
+}
+
+// ResizeDeviceFileSystem resizes filesystem to the given size or to volume size if 0
+func (f *FakeVolumeController) ResizeDeviceFileSystem(_ context.Context, volumeId string, device string, sizeBytes int64) error {
+	if sizeBytes < 0 {
+		return fmt.Errorf("size can't be less than 0")
+	}
+
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if device != "" && device != v.device {
+		return fmt.Errorf("device %s is not attached to volume %s", device, volumeId)
+	}
+
+	if sizeBytes > v.sizeBytes {
+		return fmt.Errorf("filesystem size %d exceeds volume size %d", sizeBytes, v.sizeBytes)
+	}
+
+	v.fsSizeBytes = v.sizeBytes
+	if sizeBytes > 0 {
+		v.fsSizeBytes = sizeBytes
+	}
+	return nil
+}
+
+// AttachDevice attaches volume to fake device and returns device name
+func (f *FakeVolumeController) AttachDevice(_ context.Context, volumeId string) (string, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if v.device == "" {
+		v.device = fmt.Sprintf("/dev/fakeloop%d", f.nextDevice)
+		f.nextDevice++
+	}
+	return v.device, nil
+}
+
+// DetachDevice detaches volume from fake device
+func (f *FakeVolumeController) DetachDevice(_ context.Context, volumeId string) error {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v.device = ""
+	return nil
+}
+
+// GetDeviceByVolumeId returns attached fake device or empty string
+func (f *FakeVolumeController) GetDeviceByVolumeId(_ context.Context, volumeId string) (string, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return v.device, nil
+}
+
+// FormatIfNot records filesystem type if volume has another one
+func (f *FakeVolumeController) FormatIfNot(_ context.Context, volumeId string, fsType string) error {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if v.fsType == fsType {
+		return nil
+	}
+
+	if v.device != "" {
+		return fmt.Errorf("image is attached to %s: %w", v.device, ErrorVolumeInUse)
+	}
+
+	v.fsType = fsType
+	v.fsSizeBytes = v.sizeBytes
+	return nil
+}
+
+// SetAutoclear does nothing
+func (f *FakeVolumeController) SetAutoclear(_ context.Context, device string) error {
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+	return nil
+}
+
+// VerifyDeviceFilesystem returns error if device isn't the one volume is attached to
+func (f *FakeVolumeController) VerifyDeviceFilesystem(_ context.Context, volumeId string, device string) error {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if device == "" || v.device != device {
+		return &FilesystemError{Device: device, Err: fmt.Errorf("device isn't attached to volume %s", volumeId)}
+	}
+	return nil
+}
+
+// SetDirectIO does nothing
+func (f *FakeVolumeController) SetDirectIO(_ context.Context, device string, _ bool) error {
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+	return nil
+}
+
+// ApplyIOLimits does nothing
+func (f *FakeVolumeController) ApplyIOLimits(_ context.Context, device string, _ *IOLimits) error {
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+	return nil
+}
+
+// TuneDevice does nothing
+func (f *FakeVolumeController) TuneDevice(_ context.Context, device string, tuning *DeviceTuning) error {
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+	return tuning.Validate()
+}
+
+// SaveMetadata stores copy of volume metadata
+func (f *FakeVolumeController) SaveMetadata(_ context.Context, volumeId string, metadata *VolumeMetadata) error {
+	if metadata == nil {
+		return fmt.Errorf("metadata can't be nil")
+	}
+
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v.metadata = *metadata
+	return nil
+}
+
+// GetMetadata returns copy of volume metadata
+func (f *FakeVolumeController) GetMetadata(_ context.Context, volumeId string) (*VolumeMetadata, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	metadata := v.metadata
+	return &metadata, nil
+}
+
+// GetFilesystemType returns recorded filesystem type
+func (f *FakeVolumeController) GetFilesystemType(_ context.Context, volumeId string) (string, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return "", err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return v.fsType, nil
+}
+
+// CheckFileSystem does nothing
+func (f *FakeVolumeController) CheckFileSystem(_ context.Context, volumeId string) error {
+	_, err := f.getVolume(volumeId)
+	return err
+}
+
+// RepairFileSystem does nothing, fake filesystems are always clean
+func (f *FakeVolumeController) RepairFileSystem(_ context.Context, volumeId string) error {
+	_, err := f.getVolume(volumeId)
+	return err
+}
+
+// RepairImageFileSystem does nothing, fake filesystems are always clean
+func (f *FakeVolumeController) RepairImageFileSystem(_ context.Context, volumeId string) error {
+	_, err := f.getVolume(volumeId)
+	return err
+}
+
+// TrimFileSystem does nothing, fake volumes don't take storage space
+func (f *FakeVolumeController) TrimFileSystem(_ context.Context, target string) error {
+	if target == "" {
+		return fmt.Errorf("target can't be empty")
+	}
+	return nil
+}
+
+// SparsifyImage does nothing, but fails for attached volume like real controller
+func (f *FakeVolumeController) SparsifyImage(_ context.Context, volumeId string, _ bool) error {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if v.device != "" {
+		return fmt.Errorf("volume is attached to %s: %w", v.device, ErrorVolumeInUse)
+	}
+	return nil
+}
+
+// GetAttachedDevices returns fake devices of attached volumes
+func (f *FakeVolumeController) GetAttachedDevices(_ context.Context) (map[string]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	devices := make(map[string]string)
+	for volumeId, v := range f.volumes {
+		if v.device != "" {
+			devices[volumeId] = v.device
+		}
+	}
+	return devices, nil
+}
+
+// GetOrphanedDevices returns no devices, since fake volume device is gone with the volume
+func (f *FakeVolumeController) GetOrphanedDevices(_ context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+// DetachOrphanedDevice does nothing
+func (f *FakeVolumeController) DetachOrphanedDevice(_ context.Context, device string) error {
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+	return nil
+}
+
+// GetLoopDevicesUsage returns count of attached volumes as loop devices in use of unknown limit
+func (f *FakeVolumeController) GetLoopDevicesUsage(_ context.Context) (*LoopDevicesUsage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	usage := &LoopDevicesUsage{}
+	for _, v := range f.volumes {
+		if v.device != "" {
+			usage.InUse++
+			usage.Volumes++
+		}
+	}
+	return usage, nil
+}
+
+// GetDeviceIOStats returns zero statistics
+func (f *FakeVolumeController) GetDeviceIOStats(_ context.Context, device string) (*DeviceIOStats, error) {
+	if device == "" {
+		return nil, fmt.Errorf("device can't be empty")
+	}
+	return &DeviceIOStats{}, nil
+}
+
+// ListVolumeIds returns sorted ids of all volumes
+func (f *FakeVolumeController) ListVolumeIds(_ context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	volumeIds := make([]string, 0, len(f.volumes))
+	for volumeId := range f.volumes {
+		volumeIds = append(volumeIds, volumeId)
+	}
+	sort.Strings(volumeIds)
+	return volumeIds, nil
+}
+
+// GetVolumeDiskUsage returns logical size as apparent size and nothing allocated
+func (f *FakeVolumeController) GetVolumeDiskUsage(ctx context.Context, volumeId string) (int64, int64, error) {
+	size, err := f.GetVolumeSize(ctx, volumeId)
+	return size, 0, err
+}
+
+// GetVolumePoolUsage returns sum of logical sizes of all volumes and capacity, all pools share the same capacity
+func (f *FakeVolumeController) GetVolumePoolUsage(_ context.Context, volumeId string) (int64, int64, error) {
+	if _, err := f.getVolume(volumeId); err != nil {
+		return 0, 0, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	provisioned := int64(0)
+	for _, v := range f.volumes {
+		provisioned += v.sizeBytes
+	}
+	return provisioned, f.capacity, nil
+}
+
+// GetImagePath returns fake image path
+func (f *FakeVolumeController) GetImagePath(_ context.Context, volumeId string) (string, error) {
+	if _, err := f.getVolume(volumeId); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("/fake/%s.%s", volumeId, defaultImageExtension), nil
+}
+
+// GetVolumeModTime returns volume creation time
+func (f *FakeVolumeController) GetVolumeModTime(_ context.Context, volumeId string) (time.Time, error) {
+	v, err := f.getVolume(volumeId)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return v.modTime, nil
+}
+
+// CreateNameLink does nothing
+func (f *FakeVolumeController) CreateNameLink(_ context.Context, volumeId string, _ string) error {
+	_, err := f.getVolume(volumeId)
+	return err
+}
+
+// ApplyOwnership does nothing
+func (f *FakeVolumeController) ApplyOwnership(_ context.Context, path string, _ *Ownership) error {
+	if path == "" {
+		return fmt.Errorf("path can't be empty")
+	}
+	return nil
+}
+
+// ExportVolume returns fake export of volume
+func (f *FakeVolumeController) ExportVolume(_ context.Context, volumeId string) (*NbdExport, error) {
+	if _, err := f.getVolume(volumeId); err != nil {
+		return nil, err
+	}
+	return &NbdExport{Address: "127.0.0.1:10809", Name: volumeId}, nil
+}
+
+// UnexportVolume does nothing
+func (f *FakeVolumeController) UnexportVolume(_ context.Context, volumeId string) error {
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+	return nil
+}
+
+// getVolume returns volume by id or ErrorVolumeNotFound
+func (f *FakeVolumeController) getVolume(volumeId string) (*fakeVolume, error) {
+	if volumeId == "" {
+		return nil, fmt.Errorf("volumeId can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	v, ok := f.volumes[volumeId]
+	if !ok {
+		return nil, ErrorVolumeNotFound
+	}
+	return v, nil
+}
+
+// FakeMounter Mounter recording mounts in memory. Targets are created as directories, like real mounter does
+type FakeMounter struct {
+	// mu guards mounts
+	mu sync.Mutex
+	// mounts sources by target
+	mounts map[string]string
+	// readOnly targets mounted with ro option
+	readOnly map[string]bool
+	// options mount options by target
+	options map[string][]string
+	// propagation propagation flags of all paths
+	propagation []string
+}
+
+// NewFakeMounter returns new fake mounter
+func NewFakeMounter() *FakeMounter {
+	return &FakeMounter{
+		mounts:   map[string]string{},
+		readOnly: map[string]bool{},
+		options:  map[string][]string{},
+		// kubelet dir of node plugin is mounted with bidirectional propagation
+		propagation: []string{"shared"},
+	}
+}
+
+// SetPropagation changes propagation flags reported for all paths, e.g. to simulate missing bidirectional propagation
+func (f *FakeMounter) SetPropagation(propagation ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.propagation = propagation
+}
+
+// Mount records source mounted to target. Returns nil if target already mounted
+func (f *FakeMounter) Mount(_ context.Context, source string, target string, options []string) error {
+	if source == "" {
+		return fmt.Errorf("mount source can't be empty")
+	}
+
+	if target == "" {
+		return fmt.Errorf("mount target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.mounts[target]; ok {
+		return nil
+	}
+
+	if err := os.MkdirAll(target, 0750); err != nil {
+		return fmt.Errorf("error create directory: %w", err)
+	}
+
+	// bind mounts of mounted paths resolve to the original source and share its filesystem
+	readOnly := hasOption(options, "ro")
+	if s, ok := f.mounts[source]; ok {
+		readOnly = f.readOnly[source]
+		source = s
+	}
+
+	f.mounts[target] = source
+	f.readOnly[target] = readOnly
+	f.options[target] = options
+	return nil
+}
+
+// Unmount forgets target mount. Returns nil if target is not mounted
+func (f *FakeMounter) Unmount(_ context.Context, target string) error {
+	if target == "" {
+		return fmt.Errorf("unmount target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.mounts, target)
+	delete(f.readOnly, target)
+	delete(f.options, target)
+	return nil
+}
+
+// UnmountLazy forgets target mount like Unmount
+func (f *FakeMounter) UnmountLazy(ctx context.Context, target string) error {
+	return f.Unmount(ctx, target)
+}
+
+// IsMounted returns true if target is mounted
+func (f *FakeMounter) IsMounted(_ context.Context, target string) (bool, error) {
+	if target == "" {
+		return false, fmt.Errorf("isMounted target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, ok := f.mounts[target]
+	return ok, nil
+}
+
+// GetMountSource returns source mounted to target or empty string
+func (f *FakeMounter) GetMountSource(_ context.Context, target string) (string, error) {
+	if target == "" {
+		return "", fmt.Errorf("getMountSource target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.mounts[target], nil
+}
+
+// GetMountOptions returns options target was mounted with, ro or rw first like in mount table
+func (f *FakeMounter) GetMountOptions(_ context.Context, target string) ([]string, error) {
+	if target == "" {
+		return nil, fmt.Errorf("getMountOptions target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.mounts[target]; !ok {
+		return nil, nil
+	}
+
+	options := []string{"rw"}
+	if f.readOnly[target] {
+		options = []string{"ro"}
+	}
+	for _, o := range f.options[target] {
+		if o != "ro" && o != "rw" {
+			options = append(options, o)
+		}
+	}
+	return options, nil
+}
+
+// GetMountFsType returns "fake" for mounted target, because fake mounter doesn't know filesystems of sources
+func (f *FakeMounter) GetMountFsType(_ context.Context, target string) (string, error) {
+	if target == "" {
+		return "", fmt.Errorf("getMountFsType target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.mounts[target]; !ok {
+		return "", nil
+	}
+	return "fake", nil
+}
+
+// GetMountRefs returns sorted targets given device is mounted to, bind mounts are resolved to the device on mount
+func (f *FakeMounter) GetMountRefs(_ context.Context, device string) ([]string, error) {
+	if device == "" {
+		return nil, fmt.Errorf("getMountRefs device can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	targets := make([]string, 0)
+	for target, s := range f.mounts {
+		if s == device {
+			targets = append(targets, target)
+		}
+	}
+	sort.Strings(targets)
+
+	return targets, nil
+}
+
+// GetMountPropagation returns propagation flags set for all paths, shared by default
+func (f *FakeMounter) GetMountPropagation(_ context.Context, path string) ([]string, error) {
+	if path == "" {
+		return nil, fmt.Errorf("getMountPropagation path can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string{}, f.propagation...), nil
+}
+
+// IsFilesystemReadOnly returns true if filesystem of target was mounted with ro option
+func (f *FakeMounter) IsFilesystemReadOnly(_ context.Context, target string) (bool, error) {
+	if target == "" {
+		return false, fmt.Errorf("isFilesystemReadOnly target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.readOnly[target], nil
+}
+
+// Remount updates ro option of mounted target
+func (f *FakeMounter) Remount(_ context.Context, target string, options []string) error {
+	if target == "" {
+		return fmt.Errorf("remount target can't be empty")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.mounts[target]; !ok {
+		return fmt.Errorf("target %s is not mounted", target)
+	}
+
+	if hasOption(options, "ro") {
+		f.readOnly[target] = true
+	} else if hasOption(options, "rw") {
+		f.readOnly[target] = false
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"strings"
+)
+
+const (
+	// maxFsLabelLength ext4 volume label length limit
+	maxFsLabelLength = 16
+)
+
+// fsLabel returns filesystem label for volume. Common "pvc-" prefix is dropped to keep more significant characters
+func fsLabel(volumeId string) string {
+	label := strings.TrimPrefix(volumeId, "pvc-")
+	if len(label) > maxFsLabelLength {
+		label = label[:maxFsLabelLength]
+	}
+	return label
+}
+
+// fsUUID returns deterministic name based (version 5 like) UUID for volume
+func fsUUID(volumeId string) string {
+	sum := sha1.Sum([]byte(volumeId))
+
+	sum[6] = (sum[6] & 0x0f) | 0x50 // version 5
+	sum[8] = (sum[8] & 0x3f) | 0x80 // RFC 4122 variant
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
@@ -0,0 +1,31 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"os"
+)
+
+// ImagesDirOptions permissions and ownership enforced on images dir
+type ImagesDirOptions struct {
+	// Mode permissions set on images dir, unchanged if nil
+	Mode *os.FileMode
+	// UID owner set on images dir, unchanged if nil
+	UID *int
+	// GID group set on images dir, unchanged if nil
+	GID *int
+}
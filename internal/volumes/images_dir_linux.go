@@ -0,0 +1,77 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"os"
+)
+
+// PrepareImagesDir applies permissions and ownership to images dir and checks it is a directory writable
+// by the process, so misconfigured host path fails on start instead of later volume operations
+func PrepareImagesDir(dir string, opts ImagesDirOptions) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("images dir %s doesn't exist", dir)
+		}
+		return fmt.Errorf("error stat images dir %s: %w", dir, err)
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("images dir %s is not a directory", dir)
+	}
+
+	if opts.UID != nil || opts.GID != nil {
+		uid, gid := -1, -1
+		if opts.UID != nil {
+			uid = *opts.UID
+		}
+		if opts.GID != nil {
+			gid = *opts.GID
+		}
+
+		if err := os.Chown(dir, uid, gid); err != nil {
+			return fmt.Errorf("error change owner of images dir %s: %w", dir, err)
+		}
+	}
+
+	if opts.Mode != nil {
+		if err := os.Chmod(dir, *opts.Mode); err != nil {
+			return fmt.Errorf("error change mode of images dir %s: %w", dir, err)
+		}
+	}
+
+	// access checks permissions of real uid, which is the same as effective one for the plugin
+	if err := unix.Access(dir, unix.W_OK|unix.X_OK); err != nil {
+		return fmt.Errorf("images dir %s is not writable by uid %d (mode %s, owner %s): %w", dir, os.Getuid(), info.Mode().Perm(), fileOwner(dir), err)
+	}
+
+	return nil
+}
+
+// fileOwner returns uid:gid of file for error messages
+func fileOwner(filename string) string {
+	var stat unix.Stat_t
+	if err := unix.Stat(filename, &stat); err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("%d:%d", stat.Uid, stat.Gid)
+}
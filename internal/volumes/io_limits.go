@@ -0,0 +1,34 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+// IOLimits loop device io throttling settings. Zero value means unlimited
+type IOLimits struct {
+	// ReadIOPS read operations per second
+	ReadIOPS uint64 `json:"readIops,omitempty"`
+	// WriteIOPS write operations per second
+	WriteIOPS uint64 `json:"writeIops,omitempty"`
+	// ReadBPS read bytes per second
+	ReadBPS uint64 `json:"readBps,omitempty"`
+	// WriteBPS write bytes per second
+	WriteBPS uint64 `json:"writeBps,omitempty"`
+}
+
+// IsEmpty returns true if no limit is set
+func (l *IOLimits) IsEmpty() bool {
+	return l == nil || (l.ReadIOPS == 0 && l.WriteIOPS == 0 && l.ReadBPS == 0 && l.WriteBPS == 0)
+}
@@ -0,0 +1,104 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// ApplyIOLimits writes device limits to cgroup v2 io.max. Nil or empty limits removes device limits.
+// Does nothing if io cgroup is not configured or cgroup v2 io controller is not available
+func (s *SparseFileVolumeController) ApplyIOLimits(_ context.Context, device string, limits *IOLimits) error {
+	s.logger.Debug("ApplyIOLimits called", zap.String("device", device), zap.Any("limits", limits))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	if s.opts.IOCgroup == "" {
+		if !limits.IsEmpty() {
+			s.logger.Warn("Volume has io limits, but io cgroup is not configured. Skip applying limits",
+				zap.String("device", device),
+			)
+		}
+		return nil
+	}
+
+	ioMaxFile := filepath.Join(s.opts.IOCgroup, "io.max")
+	if _, err := os.Stat(ioMaxFile); err != nil {
+		if os.IsNotExist(err) {
+			s.logger.Warn("Cgroup v2 io controller is not available. Skip applying limits",
+				zap.String("device", device),
+				zap.String("io_max_file", ioMaxFile),
+			)
+			return nil
+		}
+		return fmt.Errorf("error stat io.max file: %w", err)
+	}
+
+	info, err := os.Stat(device)
+	if err != nil {
+		return fmt.Errorf("error stat device: %w", err)
+	}
+
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || info.Mode()&os.ModeDevice == 0 {
+		return fmt.Errorf("%s is not a block device", device)
+	}
+
+	if limits == nil {
+		limits = &IOLimits{}
+	}
+
+	// "max" removes the limit, device entry disappears when all limits are removed
+	line := fmt.Sprintf("%d:%d rbps=%s wbps=%s riops=%s wiops=%s",
+		unix.Major(uint64(stat.Rdev)),
+		unix.Minor(uint64(stat.Rdev)),
+		ioMaxValue(limits.ReadBPS),
+		ioMaxValue(limits.WriteBPS),
+		ioMaxValue(limits.ReadIOPS),
+		ioMaxValue(limits.WriteIOPS),
+	)
+
+	s.logger.Debug("Write io limits", zap.String("io_max_file", ioMaxFile), zap.String("value", line))
+	if err := os.WriteFile(ioMaxFile, []byte(line), 0); err != nil {
+		return fmt.Errorf("error write io.max file: %w", err)
+	}
+
+	s.logger.Debug("Device io limits were applied successfully",
+		zap.String("device", device),
+		zap.String("value", line),
+	)
+	return nil
+}
+
+// ioMaxValue returns io.max limit value
+func ioMaxValue(limit uint64) string {
+	if limit == 0 {
+		return "max"
+	}
+	return strconv.FormatUint(limit, 10)
+}
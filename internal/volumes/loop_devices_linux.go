@@ -0,0 +1,108 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	// loopMaxParameter loop module parameter, fixed count of loop devices or 0 if they are created on demand
+	loopMaxParameter = "/sys/module/loop/parameters/max_loop"
+)
+
+// GetLoopDevicesUsage returns count of loop devices bound to any file and to volume images of all pools.
+// Total is max_loop parameter of loop module or, when devices are created on demand, count of existing loop devices
+func (s *SparseFileVolumeController) GetLoopDevicesUsage(_ context.Context) (*LoopDevicesUsage, error) {
+	s.logger.Debug("GetLoopDevicesUsage called")
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, fmt.Errorf("error list loop devices: %w", err)
+	}
+
+	usage := &LoopDevicesUsage{InUse: len(backingFiles)}
+	for _, backingFile := range backingFiles {
+		content, err := os.ReadFile(backingFile)
+		if err != nil {
+			// device could be detached since listing
+			if os.IsNotExist(err) {
+				usage.InUse--
+				continue
+			}
+			return nil, fmt.Errorf("error read loop device backing file: %w", err)
+		}
+
+		if s.isImagePath(strings.TrimSpace(string(content))) {
+			usage.Volumes++
+		}
+	}
+
+	usage.Total, err = loopDevicesTotal()
+	if err != nil {
+		return nil, err
+	}
+
+	return usage, nil
+}
+
+// isImagePath returns true if file is in images dir of any pool
+func (s *SparseFileVolumeController) isImagePath(filename string) bool {
+	for _, dir := range s.getPoolDirs() {
+		resolved, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			resolved = dir
+		}
+
+		if isPathUnder(filename, filepath.Clean(resolved)) {
+			return true
+		}
+	}
+	return false
+}
+
+// loopDevicesTotal returns fixed count of loop devices or count of existing ones if they are created on demand
+func loopDevicesTotal() (int, error) {
+	content, err := os.ReadFile(loopMaxParameter)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("error read loop max_loop parameter: %w", err)
+	}
+
+	if err == nil {
+		maxLoop, err := strconv.Atoi(strings.TrimSpace(string(content)))
+		if err != nil {
+			return 0, fmt.Errorf("error parse loop max_loop parameter: %w", err)
+		}
+
+		if maxLoop > 0 {
+			return maxLoop, nil
+		}
+	}
+
+	devices, err := filepath.Glob("/dev/loop[0-9]*")
+	if err != nil {
+		return 0, fmt.Errorf("error list loop devices: %w", err)
+	}
+	return len(devices), nil
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+// VolumeMetadata per volume options persisted next to the volume image
+type VolumeMetadata struct {
+	// Pool storage pool of volume, default pool if empty
+	Pool string `json:"pool,omitempty"`
+	// Name human-friendly volume name, e.g. <pvc-namespace>-<pvc-name>
+	Name string `json:"name,omitempty"`
+	// DirectIO overrides controller's direct-io setting for loop device when set
+	DirectIO *bool `json:"directIO,omitempty"`
+	// SectorSize logical sector size of loop device, chosen on format, losetup default if 0
+	SectorSize int `json:"sectorSize,omitempty"`
+	// FsUUID filesystem UUID derived from volume id was set on format
+	FsUUID bool `json:"fsUUID,omitempty"`
+	// ReservedBlocksPercent overrides controller's percentage of filesystem blocks reserved for root on format when set
+	ReservedBlocksPercent *int `json:"reservedBlocksPercent,omitempty"`
+	// IOLimits loop device io throttling, no limits if nil
+	IOLimits *IOLimits `json:"ioLimits,omitempty"`
+	// DeviceTuning loop device queue settings, controller's defaults if nil
+	DeviceTuning *DeviceTuning `json:"deviceTuning,omitempty"`
+	// SkipFormat never format volume on stage, workload formats it itself
+	SkipFormat bool `json:"skipFormat,omitempty"`
+	// FsType filesystem type requested on create, empty if not requested
+	FsType string `json:"fsType,omitempty"`
+	// LimitBytes capacity limit requested on create, expand beyond it is rejected, unlimited if 0
+	LimitBytes int64 `json:"limitBytes,omitempty"`
+	// Template name of template image volume was created from
+	Template string `json:"template,omitempty"`
+	// Ownership volume files owner applied on publish, unchanged if nil
+	Ownership *Ownership `json:"ownership,omitempty"`
+	// VolumeContext create parameters returned in volume context, so they reach node calls
+	VolumeContext map[string]string `json:"volumeContext,omitempty"`
+	// Ephemeral inline ephemeral volume of pod, deleted on unpublish
+	Ephemeral bool `json:"ephemeral,omitempty"`
+}
@@ -0,0 +1,116 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"strings"
+)
+
+// SaveMetadata writes volume metadata file. Existing metadata is replaced
+func (s *SparseFileVolumeController) SaveMetadata(_ context.Context, volumeId string, metadata *VolumeMetadata) error {
+	s.logger.Debug("SaveMetadata called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	if metadata == nil {
+		return fmt.Errorf("metadata can't be nil")
+	}
+
+	if !s.isFileExists(s.getImageFullPath(volumeId)) {
+		return ErrorVolumeNotFound
+	}
+
+	data, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("error marshal metadata: %w", err)
+	}
+
+	// write to temporary file and rename it, so metadata file is never partially written
+	filename := s.getMetadataFullPath(volumeId)
+	tmpFilename := filename + ".tmp"
+	if err := os.WriteFile(tmpFilename, data, 0640); err != nil {
+		return fmt.Errorf("error write metadata file: %w", err)
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return fmt.Errorf("error rename metadata file: %w", err)
+	}
+
+	s.logger.Debug("Volume metadata was saved successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+	)
+	return nil
+}
+
+// GetMetadata returns volume metadata. Returns empty metadata if volume has no metadata file
+func (s *SparseFileVolumeController) GetMetadata(_ context.Context, volumeId string) (*VolumeMetadata, error) {
+	s.logger.Debug("GetMetadata called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return nil, fmt.Errorf("volumeId can't be empty")
+	}
+
+	if !s.isFileExists(s.getImageFullPath(volumeId)) {
+		return nil, ErrorVolumeNotFound
+	}
+
+	filename := s.getMetadataFullPath(volumeId)
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			s.logger.Debug("Metadata file is not exists, assume volume has default options",
+				zap.String("volume_id", volumeId),
+				zap.String("filename", filename),
+			)
+			return &VolumeMetadata{}, nil
+		}
+		return nil, fmt.Errorf("error read metadata file: %w", err)
+	}
+
+	metadata := &VolumeMetadata{}
+	if err := json.Unmarshal(data, metadata); err != nil {
+		return nil, fmt.Errorf("error unmarshal metadata: %w", err)
+	}
+
+	return metadata, nil
+}
+
+// deleteMetadata removes volume metadata file. Returns nil if file is not exists
+func (s *SparseFileVolumeController) deleteMetadata(volumeId string) error {
+	err := os.Remove(s.getMetadataFullPath(volumeId))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error remove metadata file: %w", err)
+	}
+
+	return nil
+}
+
+// getMetadataFullPath returns volume's metadata file absolute path
+func (s *SparseFileVolumeController) getMetadataFullPath(volumeId string) string {
+	return fmt.Sprintf("%s/%s.json", strings.TrimSuffix(s.getVolumeDir(volumeId), "/"), volumeId)
+}
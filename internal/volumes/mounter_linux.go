@@ -0,0 +1,606 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LinuxMounterOptions optional settings of linux mounter
+type LinuxMounterOptions struct {
+	// FindMntTimeout timeout of mount table lookups independent of request context, disabled if 0
+	FindMntTimeout time.Duration
+	// MountDirMode permissions of created target directories, 0750 if 0
+	MountDirMode os.FileMode
+}
+
+// LinuxMounter implements Mounter functions on Linux systems
+type LinuxMounter struct {
+	// opts optional settings
+	opts LinuxMounterOptions
+	// logger .
+	logger *zap.Logger
+}
+
+// NewLinuxMounter returns new mounter
+func NewLinuxMounter(opts LinuxMounterOptions, logger *zap.Logger) *LinuxMounter {
+	return &LinuxMounter{
+		opts:   opts,
+		logger: logger.With(zap.String("logger", "real_mounter")),
+	}
+}
+
+// Mount mounts source to target with given options. Returns nil if mount successfully or volume already mounted
+func (r *LinuxMounter) Mount(ctx context.Context, source string, target string, options []string) error {
+	r.logger.Debug("Mount called",
+		zap.String("source", source),
+		zap.String("target", target),
+		zap.Strings("options", options),
+	)
+
+	if source == "" {
+		return errors.New("mount source can't be empty")
+	}
+
+	if target == "" {
+		return errors.New("mount target can't be empty")
+	}
+
+	isMounted, err := r.IsMounted(ctx, target)
+	if err != nil {
+		return fmt.Errorf("error check if target mounted: %w", err)
+	}
+
+	if isMounted {
+		r.logger.Debug("Target already mounted",
+			zap.String("source", source),
+			zap.String("target", target),
+		)
+		return nil
+	}
+
+	mountDirMode := r.opts.MountDirMode
+	if mountDirMode == 0 {
+		mountDirMode = 0750
+	}
+
+	if err := os.MkdirAll(target, mountDirMode); err != nil {
+		return fmt.Errorf("error create directory: %w", err)
+	}
+
+	mountCmd := fmt.Sprintf("mount")
+
+	args := make([]string, 0)
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+
+	args = append(
+		args,
+		source,
+		target,
+	)
+
+	if _, err := runCommand(ctx, r.logger, nil, mountCmd, args...); err != nil {
+		return err
+	}
+
+	r.logger.Debug("Mounted source to target successfully",
+		zap.String("source", source),
+		zap.String("target", target),
+		zap.Strings("options", options),
+	)
+	return nil
+}
+
+// Unmount unmounts target. Returns nil if unmount successfully or already unmounted
+func (r *LinuxMounter) Unmount(ctx context.Context, target string) error {
+	r.logger.Debug("Unmount called", zap.String("target", target))
+
+	if target == "" {
+		return errors.New("unmount target can't be empty")
+	}
+
+	isMounted, err := r.IsMounted(ctx, target)
+	if err != nil {
+		return fmt.Errorf("error check if target mounted: %w", err)
+	}
+
+	if !isMounted {
+		r.logger.Debug("Target already unmounted",
+			zap.String("target", target),
+		)
+		return nil
+	}
+
+	umountCmd := fmt.Sprintf("umount")
+
+	args := []string{
+		target,
+	}
+
+	if _, err := runCommand(ctx, r.logger, nil, umountCmd, args...); err != nil {
+		return err
+	}
+
+	r.logger.Debug("Target was unmounted successfully",
+		zap.String("target", target),
+	)
+	return nil
+}
+
+// UnmountLazy lazily unmounts target with "umount -l", so busy or stuck target is detached immediately
+func (r *LinuxMounter) UnmountLazy(ctx context.Context, target string) error {
+	r.logger.Debug("UnmountLazy called", zap.String("target", target))
+
+	if target == "" {
+		return errors.New("unmount target can't be empty")
+	}
+
+	umountCmd := "umount"
+
+	args := []string{
+		"-l",
+		target,
+	}
+
+	if _, err := runCommand(ctx, r.logger, nil, umountCmd, args...); err != nil {
+		return err
+	}
+
+	r.logger.Debug("Target was lazily unmounted", zap.String("target", target))
+	return nil
+}
+
+// IsMounted checks and returns true if target is mounted
+func (r *LinuxMounter) IsMounted(ctx context.Context, target string) (bool, error) {
+	r.logger.Debug("IsMounted called", zap.String("target", target))
+
+	if target == "" {
+		return false, errors.New("isMounted target can't be empty")
+	}
+
+	findMntCmd := "findmnt"
+
+	args := []string{
+		"-o",
+		"TARGET,PROPAGATION,FSTYPE,OPTIONS",
+		"-J",
+		"-M",
+		target,
+	}
+
+	// findmnt could hang on misbehaving storage, e.g. network filesystem, and wedge the whole request
+	findMntCtx := ctx
+	if r.opts.FindMntTimeout > 0 {
+		var cancel context.CancelFunc
+		findMntCtx, cancel = context.WithTimeout(ctx, r.opts.FindMntTimeout)
+		defer cancel()
+	}
+
+	// findmnt exits with 1 when it couldn't find anything
+	out, err := runCommand(findMntCtx, r.logger, &commandOptions{handledExitCodes: []int{1}}, findMntCmd, args...)
+	if err != nil {
+		if ctx.Err() == nil && findMntCtx.Err() == context.DeadlineExceeded {
+			r.logger.Error("Command timed out",
+				zap.String("cmd", findMntCmd),
+				zap.Strings("args", args),
+				zap.Duration("timeout", r.opts.FindMntTimeout),
+			)
+			return false, fmt.Errorf("command (%s) timed out after %s: %w", findMntCmd, r.opts.FindMntTimeout, context.DeadlineExceeded)
+		}
+
+		cmdErr := asCommandError(err)
+		if cmdErr == nil || cmdErr.ExitCode != 1 {
+			return false, err
+		}
+
+		if strings.TrimSpace(cmdErr.Stdout+cmdErr.Stderr) == "" {
+			r.logger.Debug("Findmnt exists with non-zero exit code, assume it couldn't find anything",
+				zap.String("target", target),
+			)
+			return false, nil
+		}
+
+		r.logger.Error("Error exec command",
+			zap.String("cmd", findMntCmd),
+			zap.Strings("args", args),
+			zap.String("stdout", cmdErr.Stdout),
+			zap.String("stderr", cmdErr.Stderr),
+			zap.Error(err),
+		)
+		return false, err
+	}
+
+	if strings.TrimSpace(string(out)) == "" {
+		r.logger.Debug("Findmnt no response means there is no mount", zap.String("target", target))
+		return false, nil
+	}
+
+	type findMntResponse struct {
+		FileSystems []struct {
+			Target      string `json:"target"`
+			Propagation string `json:"propagation"`
+			FsType      string `json:"fstype"`
+			Options     string `json:"options"`
+		} `json:"filesystems"`
+	}
+
+	var resp *findMntResponse
+	err = json.Unmarshal(out, &resp)
+	if err != nil {
+		return false, fmt.Errorf("error on unmarshal: %w", err)
+	}
+
+	isMounted := false
+	for _, fs := range resp.FileSystems {
+		if fs.Propagation != "shared" {
+			return true, fmt.Errorf("bad mount propagation (%s) for target %s", fs.Propagation, target)
+		}
+
+		if fs.Target == target {
+			isMounted = true
+		}
+	}
+
+	r.logger.Debug("Result of mount search",
+		zap.String("target", target),
+		zap.Bool("is_mounted", isMounted),
+	)
+	return isMounted, nil
+}
+
+// GetMountSource returns source device of mounted target from /proc/mounts or empty string if target isn't mounted.
+// The last mount wins when target is mounted several times
+func (r *LinuxMounter) GetMountSource(_ context.Context, target string) (string, error) {
+	r.logger.Debug("GetMountSource called", zap.String("target", target))
+
+	if target == "" {
+		return "", errors.New("getMountSource target can't be empty")
+	}
+
+	mounts, err := readMountTable()
+	if err != nil {
+		return "", err
+	}
+
+	source := ""
+	for _, m := range mounts {
+		if m.target == target {
+			source = m.source
+		}
+	}
+
+	r.logger.Debug("Result of mount source search",
+		zap.String("target", target),
+		zap.String("source", source),
+	)
+	return source, nil
+}
+
+// GetMountOptions returns options of mounted target from /proc/mounts or nil if target isn't mounted.
+// The last mount wins when target is mounted several times
+func (r *LinuxMounter) GetMountOptions(_ context.Context, target string) ([]string, error) {
+	r.logger.Debug("GetMountOptions called", zap.String("target", target))
+
+	if target == "" {
+		return nil, errors.New("getMountOptions target can't be empty")
+	}
+
+	mounts, err := readMountTable()
+	if err != nil {
+		return nil, err
+	}
+
+	var options []string
+	for _, m := range mounts {
+		if m.target == target {
+			options = m.options
+		}
+	}
+
+	return options, nil
+}
+
+// GetMountFsType returns filesystem type of mounted target from /proc/mounts or empty string if target isn't mounted.
+// The last mount wins when target is mounted several times
+func (r *LinuxMounter) GetMountFsType(_ context.Context, target string) (string, error) {
+	r.logger.Debug("GetMountFsType called", zap.String("target", target))
+
+	if target == "" {
+		return "", errors.New("getMountFsType target can't be empty")
+	}
+
+	mounts, err := readMountTable()
+	if err != nil {
+		return "", err
+	}
+
+	fsType := ""
+	for _, m := range mounts {
+		if m.target == target {
+			fsType = m.fsType
+		}
+	}
+
+	return fsType, nil
+}
+
+// GetMountRefs returns all mount points backed by given device from mountinfo, including bind mounts.
+// Device is matched by its major:minor number, so mounts by other device names are found too
+func (r *LinuxMounter) GetMountRefs(_ context.Context, device string) ([]string, error) {
+	r.logger.Debug("GetMountRefs called", zap.String("device", device))
+
+	if device == "" {
+		return nil, errors.New("getMountRefs device can't be empty")
+	}
+
+	devNumber := ""
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err == nil && stat.Mode&unix.S_IFMT == unix.S_IFBLK {
+		devNumber = fmt.Sprintf("%d:%d", unix.Major(stat.Rdev), unix.Minor(stat.Rdev))
+	}
+
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("error read mountinfo: %w", err)
+	}
+
+	// <id> <parent> <maj:min> <root> <target> <options> [optional fields...] - <fstype> <source> <super options>
+	refs := make([]string, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		source := ""
+		for i := 6; i < len(fields)-2; i++ {
+			if fields[i] == "-" {
+				source = unescapeMountPath(fields[i+2])
+				break
+			}
+		}
+
+		if (devNumber != "" && fields[2] == devNumber) || source == device {
+			refs = append(refs, unescapeMountPath(fields[4]))
+		}
+	}
+
+	r.logger.Debug("Result of mount refs search",
+		zap.String("device", device),
+		zap.Strings("refs", refs),
+	)
+	return refs, nil
+}
+
+// GetMountPropagation returns propagation flags of the mount holding path from mountinfo optional fields.
+// Path doesn't have to be a mount point itself, the nearest mount above it is taken
+func (r *LinuxMounter) GetMountPropagation(_ context.Context, path string) ([]string, error) {
+	r.logger.Debug("GetMountPropagation called", zap.String("path", path))
+
+	if path == "" {
+		return nil, errors.New("getMountPropagation path can't be empty")
+	}
+
+	path = filepath.Clean(path)
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("error read mountinfo: %w", err)
+	}
+
+	// <id> <parent> <maj:min> <root> <target> <options> [optional fields...] - <fstype> <source> <super options>
+	var propagation []string
+	mountTarget := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 {
+			continue
+		}
+
+		target := unescapeMountPath(fields[4])
+		if !isPathUnder(path, target) || len(target) < len(mountTarget) {
+			continue
+		}
+
+		// later mount of the same target overlays the earlier one
+		mountTarget = target
+		propagation = make([]string, 0)
+		for _, field := range fields[6:] {
+			if field == "-" {
+				break
+			}
+
+			switch {
+			case strings.HasPrefix(field, "shared:"):
+				propagation = append(propagation, "shared")
+			case strings.HasPrefix(field, "master:"):
+				propagation = append(propagation, "slave")
+			case field == "unbindable":
+				propagation = append(propagation, "unbindable")
+			}
+		}
+		if len(propagation) == 0 {
+			propagation = append(propagation, "private")
+		}
+	}
+
+	if propagation == nil {
+		return nil, fmt.Errorf("no mount holds path %s", path)
+	}
+
+	r.logger.Debug("Result of mount propagation search",
+		zap.String("path", path),
+		zap.String("mount_target", mountTarget),
+		zap.Strings("propagation", propagation),
+	)
+	return propagation, nil
+}
+
+// IsFilesystemReadOnly returns true if superblock of filesystem mounted to target is read-only.
+// Unlike mount options, it isn't affected by read-only bind mounts. Returns false if target isn't mounted
+func (r *LinuxMounter) IsFilesystemReadOnly(_ context.Context, target string) (bool, error) {
+	r.logger.Debug("IsFilesystemReadOnly called", zap.String("target", target))
+
+	if target == "" {
+		return false, errors.New("isFilesystemReadOnly target can't be empty")
+	}
+
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return false, fmt.Errorf("error read mountinfo: %w", err)
+	}
+
+	// <id> <parent> <maj:min> <root> <target> <options> [optional fields...] - <fstype> <source> <super options>
+	readOnly := false
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 10 || unescapeMountPath(fields[4]) != target {
+			continue
+		}
+
+		for i := 6; i < len(fields)-3; i++ {
+			if fields[i] == "-" {
+				readOnly = hasOption(strings.Split(fields[i+3], ","), "ro")
+				break
+			}
+		}
+	}
+
+	return readOnly, nil
+}
+
+// Remount changes mount options of mounted target
+func (r *LinuxMounter) Remount(ctx context.Context, target string, options []string) error {
+	r.logger.Debug("Remount called", zap.String("target", target), zap.Strings("options", options))
+
+	if target == "" {
+		return errors.New("remount target can't be empty")
+	}
+
+	mountCmd := "mount"
+
+	args := []string{
+		"-o",
+		strings.Join(append([]string{"remount"}, options...), ","),
+		target,
+	}
+
+	if _, err := runCommand(ctx, r.logger, nil, mountCmd, args...); err != nil {
+		return err
+	}
+
+	r.logger.Debug("Target was remounted successfully", zap.String("target", target))
+	return nil
+}
+
+// mountEntry single mount of kernel mount table
+type mountEntry struct {
+	// source mounted device or file
+	source string
+	// target mount point
+	target string
+	// fsType filesystem type
+	fsType string
+	// options mount options
+	options []string
+}
+
+// readMountTable returns mounts from /proc/mounts in mount order
+func readMountTable() ([]mountEntry, error) {
+	data, err := os.ReadFile("/proc/mounts")
+	if err != nil {
+		return nil, fmt.Errorf("error read mounts: %w", err)
+	}
+
+	mounts := make([]mountEntry, 0)
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+
+		mounts = append(mounts, mountEntry{
+			source:  unescapeMountPath(fields[0]),
+			target:  unescapeMountPath(fields[1]),
+			fsType:  fields[2],
+			options: strings.Split(fields[3], ","),
+		})
+	}
+
+	return mounts, nil
+}
+
+// isDeviceMounted returns true if device is mounted anywhere
+func isDeviceMounted(device string) (bool, error) {
+	mounts, err := readMountTable()
+	if err != nil {
+		return false, err
+	}
+
+	for _, m := range mounts {
+		if m.source == device {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// isPathUnder returns true if path is dir itself or lies under it
+func isPathUnder(path string, dir string) bool {
+	if dir == "/" || path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// unescapeMountPath decodes octal escapes (\040 etc.) used by kernel in mount tables
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if v, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
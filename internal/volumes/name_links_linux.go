@@ -0,0 +1,128 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// nameLinksDir directory inside images dir with human-friendly symlinks to images
+	nameLinksDir = "by-name"
+)
+
+// CreateNameLink creates by-name/<name> symlink to volume image. Does nothing if name links are disabled.
+// Existing link with the same name is replaced
+func (s *SparseFileVolumeController) CreateNameLink(_ context.Context, volumeId string, name string) error {
+	s.logger.Debug("CreateNameLink called", zap.String("volume_id", volumeId), zap.String("name", name))
+
+	if !s.opts.NameLinks {
+		return nil
+	}
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	if name == "" || name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return fmt.Errorf("invalid link name %q", name)
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	linksDir := filepath.Join(s.getVolumeDir(volumeId), nameLinksDir)
+	if err := os.MkdirAll(linksDir, 0750); err != nil {
+		return fmt.Errorf("error create directory: %w", err)
+	}
+
+	link := filepath.Join(linksDir, name)
+	linkTarget := filepath.Join("..", filepath.Base(filename))
+	if current, err := os.Readlink(link); err == nil {
+		if current == linkTarget {
+			s.logger.Debug("Name link already exists, so skip creating",
+				zap.String("volume_id", volumeId),
+				zap.String("link", link),
+			)
+			return nil
+		}
+
+		s.logger.Info("Name link points to another image, replace it",
+			zap.String("volume_id", volumeId),
+			zap.String("link", link),
+			zap.String("current_target", current),
+		)
+		if err := os.Remove(link); err != nil {
+			return fmt.Errorf("error remove link: %w", err)
+		}
+	}
+
+	if err := os.Symlink(linkTarget, link); err != nil {
+		return fmt.Errorf("error create link: %w", err)
+	}
+
+	s.logger.Debug("Name link was created successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("link", link),
+	)
+	return nil
+}
+
+// deleteNameLink removes by-name symlink of volume if it still points to volume image
+func (s *SparseFileVolumeController) deleteNameLink(ctx context.Context, volumeId string) error {
+	metadata, err := s.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	if metadata.Name == "" {
+		return nil
+	}
+
+	link := filepath.Join(s.getVolumeDir(volumeId), nameLinksDir, metadata.Name)
+	current, err := os.Readlink(link)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error read link: %w", err)
+	}
+
+	// link could be already taken by another volume with the same name
+	if current != filepath.Join("..", filepath.Base(s.getImageFullPath(volumeId))) {
+		return nil
+	}
+
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error remove link: %w", err)
+	}
+
+	s.logger.Debug("Name link was deleted successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("link", link),
+	)
+	return nil
+}
@@ -0,0 +1,34 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"errors"
+)
+
+var (
+	ErrorExportDisabled = errors.New("nbd export is disabled")
+	ErrorNoFreeNbdPort  = errors.New("no free nbd export port")
+)
+
+// NbdExport read-only nbd export of volume image
+type NbdExport struct {
+	// Address nbd server address, host:port
+	Address string `json:"address"`
+	// Name nbd export name
+	Name string `json:"name"`
+}
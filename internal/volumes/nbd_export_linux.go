@@ -0,0 +1,168 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"net"
+	"os/exec"
+	"strconv"
+)
+
+// nbdExport running nbd server of volume image
+type nbdExport struct {
+	// export export address and name
+	export NbdExport
+	// port nbd server port
+	port int
+	// cmd qemu-nbd process
+	cmd *exec.Cmd
+	// done closed when qemu-nbd process exits
+	done chan struct{}
+}
+
+// ExportVolume exports volume image read-only over nbd with qemu-nbd and returns export address and name.
+// Returns existing export if volume is already exported
+func (s *SparseFileVolumeController) ExportVolume(_ context.Context, volumeId string) (*NbdExport, error) {
+	s.logger.Debug("ExportVolume called", zap.String("volume_id", volumeId))
+
+	if !s.opts.NbdExport {
+		return nil, ErrorExportDisabled
+	}
+
+	if volumeId == "" {
+		return nil, fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return nil, ErrorVolumeNotFound
+	}
+
+	s.exportsMu.Lock()
+	defer s.exportsMu.Unlock()
+
+	if e, ok := s.exports[volumeId]; ok {
+		select {
+		case <-e.done:
+			s.logger.Warn("Nbd server of volume has exited, export it again", zap.String("volume_id", volumeId))
+			delete(s.exports, volumeId)
+		default:
+			export := e.export
+			return &export, nil
+		}
+	}
+
+	port, err := s.getFreeNbdPort()
+	if err != nil {
+		return nil, err
+	}
+
+	qemuNbdCmd := "qemu-nbd"
+	if _, err := lookupExecutable(qemuNbdCmd); err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"--read-only",
+		"--persistent",
+		"--format=raw",
+		"--bind", s.opts.NbdExportAddress,
+		"--port", strconv.Itoa(port),
+		"--export-name", volumeId,
+		filename,
+	}
+
+	// nbd server outlives the request, so it isn't bound to request context
+	s.logger.Debug("Exec command", zap.String("cmd", qemuNbdCmd), zap.Strings("args", args))
+	cmd := exec.Command(qemuNbdCmd, args...)
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error start command (%s): %w", qemuNbdCmd, err)
+	}
+
+	e := &nbdExport{
+		export: NbdExport{
+			Address: net.JoinHostPort(s.opts.NbdExportAddress, strconv.Itoa(port)),
+			Name:    volumeId,
+		},
+		port: port,
+		cmd:  cmd,
+		done: make(chan struct{}),
+	}
+	go func() {
+		err := cmd.Wait()
+		s.logger.Info("Nbd server exited", zap.String("volume_id", volumeId), zap.Error(err))
+		close(e.done)
+	}()
+	s.exports[volumeId] = e
+
+	s.logger.Info("Volume was exported over nbd",
+		zap.String("volume_id", volumeId),
+		zap.String("address", e.export.Address),
+	)
+	export := e.export
+	return &export, nil
+}
+
+// UnexportVolume stops nbd server of volume. Returns nil if volume is not exported
+func (s *SparseFileVolumeController) UnexportVolume(_ context.Context, volumeId string) error {
+	s.logger.Debug("UnexportVolume called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	s.exportsMu.Lock()
+	defer s.exportsMu.Unlock()
+
+	e, ok := s.exports[volumeId]
+	if !ok {
+		return nil
+	}
+
+	select {
+	case <-e.done:
+	default:
+		if err := e.cmd.Process.Kill(); err != nil {
+			return fmt.Errorf("error stop nbd server: %w", err)
+		}
+		<-e.done
+	}
+	delete(s.exports, volumeId)
+
+	s.logger.Info("Volume nbd export was stopped", zap.String("volume_id", volumeId))
+	return nil
+}
+
+// getFreeNbdPort returns first export port not used by other exports. Must be called with exportsMu locked
+func (s *SparseFileVolumeController) getFreeNbdPort() (int, error) {
+	used := make(map[int]bool, len(s.exports))
+	for _, e := range s.exports {
+		used[e.port] = true
+	}
+
+	for port := s.opts.NbdExportPort; port < s.opts.NbdExportPort+s.opts.NbdExportMaxCount; port++ {
+		if !used[port] {
+			return port, nil
+		}
+	}
+	return 0, ErrorNoFreeNbdPort
+}
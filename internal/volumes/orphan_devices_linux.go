@@ -0,0 +1,117 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// deletedBackingFileSuffix suffix of loop device backing file which was deleted while device is attached
+	deletedBackingFileSuffix = " (deleted)"
+)
+
+// GetOrphanedDevices returns loop devices bound to deleted volume images from /sys/block/<dev>/loop/backing_file,
+// with former image path by device
+func (s *SparseFileVolumeController) GetOrphanedDevices(_ context.Context) (map[string]string, error) {
+	s.logger.Debug("GetOrphanedDevices called")
+
+	backingFiles, err := filepath.Glob("/sys/block/loop*/loop/backing_file")
+	if err != nil {
+		return nil, fmt.Errorf("error list loop devices: %w", err)
+	}
+
+	poolDirs := make(map[string]bool)
+	for _, dir := range s.getPoolDirs() {
+		poolDirs[filepath.Clean(dir)] = true
+	}
+
+	devices := make(map[string]string)
+	for _, backingFile := range backingFiles {
+		data, err := os.ReadFile(backingFile)
+		if err != nil {
+			// device could be detached since listing
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("error read loop device backing file: %w", err)
+		}
+
+		backing := strings.TrimSpace(string(data))
+		if !strings.HasSuffix(backing, deletedBackingFileSuffix) {
+			continue
+		}
+
+		backing = strings.TrimSuffix(backing, deletedBackingFileSuffix)
+		if !poolDirs[filepath.Dir(backing)] {
+			continue
+		}
+
+		if _, ok := s.parseImageFileName(filepath.Base(backing)); !ok {
+			continue
+		}
+
+		// /sys/block/<dev>/loop/backing_file
+		devices["/dev/"+filepath.Base(filepath.Dir(filepath.Dir(backingFile)))] = backing
+	}
+
+	return devices, nil
+}
+
+// DetachOrphanedDevice detaches loop device bound to deleted volume image. Device bound to existing file is refused
+func (s *SparseFileVolumeController) DetachOrphanedDevice(ctx context.Context, device string) error {
+	s.logger.Debug("DetachOrphanedDevice called", zap.String("device", device))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	data, err := os.ReadFile(filepath.Join("/sys/block", filepath.Base(device), "loop", "backing_file"))
+	if err != nil {
+		// do nothing if already detached
+		if os.IsNotExist(err) {
+			s.logger.Debug("Device is not attached, so skip detaching", zap.String("device", device))
+			return nil
+		}
+		return fmt.Errorf("error read loop device backing file: %w", err)
+	}
+
+	if backing := strings.TrimSpace(string(data)); !strings.HasSuffix(backing, deletedBackingFileSuffix) {
+		return fmt.Errorf("device %s is bound to existing file %s, so it isn't orphaned", device, backing)
+	}
+
+	loSetupCmd := "losetup"
+
+	args := []string{
+		"--detach",
+		device,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Orphaned device was detached successfully", zap.String("device", device))
+	return nil
+}
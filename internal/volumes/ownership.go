@@ -0,0 +1,45 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"os"
+)
+
+const (
+	// OwnershipChangeAlways change ownership of all volume files on every mount
+	OwnershipChangeAlways = "Always"
+	// OwnershipChangeOnRootMismatch change ownership of volume files only if volume root doesn't match
+	OwnershipChangeOnRootMismatch = "OnRootMismatch"
+)
+
+// Ownership volume files owner and root directory permissions applied after mount, like kubernetes fsGroup
+type Ownership struct {
+	// UID owner user id, unchanged if nil
+	UID *int `json:"uid,omitempty"`
+	// GID owner group id, unchanged if nil
+	GID *int `json:"gid,omitempty"`
+	// Mode permission bits of volume root directory, unchanged if 0
+	Mode os.FileMode `json:"mode,omitempty"`
+	// ChangePolicy when to change ownership of volume files, OnRootMismatch if empty
+	ChangePolicy string `json:"changePolicy,omitempty"`
+}
+
+// IsEmpty returns true if nothing should be changed
+func (o *Ownership) IsEmpty() bool {
+	return o == nil || (o.UID == nil && o.GID == nil && o.Mode == 0)
+}
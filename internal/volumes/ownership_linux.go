@@ -0,0 +1,125 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ApplyOwnership changes owner of files under path and permissions of path itself. Files already having
+// the requested owner are not touched. Does nothing if ownership is empty
+func (s *SparseFileVolumeController) ApplyOwnership(ctx context.Context, path string, ownership *Ownership) error {
+	s.logger.Debug("ApplyOwnership called", zap.String("path", path), zap.Any("ownership", ownership))
+
+	if path == "" {
+		return fmt.Errorf("path can't be empty")
+	}
+
+	if ownership.IsEmpty() {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("error stat path: %w", err)
+	}
+
+	if ownership.ChangePolicy != OwnershipChangeAlways && ownership.matches(info) {
+		s.logger.Debug("Volume root already has requested ownership, so skip changing",
+			zap.String("path", path),
+		)
+		return nil
+	}
+
+	if ownership.UID != nil || ownership.GID != nil {
+		changed := 0
+		err := filepath.WalkDir(path, func(name string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			entryInfo, err := entry.Info()
+			if err != nil {
+				return err
+			}
+
+			if ownership.matchesOwner(entryInfo) {
+				return nil
+			}
+
+			changed++
+			return os.Lchown(name, ownership.uid(), ownership.gid())
+		})
+		if err != nil {
+			return fmt.Errorf("error change owner: %w", err)
+		}
+
+		s.logger.Debug("Volume files owner was changed", zap.String("path", path), zap.Int("changed", changed))
+	}
+
+	if ownership.Mode != 0 {
+		if err := os.Chmod(path, ownership.Mode); err != nil {
+			return fmt.Errorf("error change mode: %w", err)
+		}
+	}
+
+	s.logger.Debug("Volume ownership was applied successfully", zap.String("path", path))
+	return nil
+}
+
+// matches returns true if file has requested owner and permissions
+func (o *Ownership) matches(info os.FileInfo) bool {
+	return o.matchesOwner(info) && (o.Mode == 0 || info.Mode().Perm() == o.Mode.Perm())
+}
+
+// matchesOwner returns true if file has requested owner
+func (o *Ownership) matchesOwner(info os.FileInfo) bool {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+
+	return (o.UID == nil || int(stat.Uid) == *o.UID) && (o.GID == nil || int(stat.Gid) == *o.GID)
+}
+
+// uid returns requested owner user id or -1 to keep it unchanged
+func (o *Ownership) uid() int {
+	if o.UID == nil {
+		return -1
+	}
+	return *o.UID
+}
+
+// gid returns requested owner group id or -1 to keep it unchanged
+func (o *Ownership) gid() int {
+	if o.GID == nil {
+		return -1
+	}
+	return *o.GID
+}
@@ -0,0 +1,73 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"path/filepath"
+	"sort"
+)
+
+// getPoolDir returns images dir of pool. Empty pool is default images dir
+func (s *SparseFileVolumeController) getPoolDir(pool string) (string, error) {
+	if pool == "" {
+		return s.imagesDir, nil
+	}
+
+	dir, ok := s.opts.Pools[pool]
+	if !ok {
+		return "", ErrorPoolNotFound
+	}
+	return dir, nil
+}
+
+// getPoolDirs returns images dirs of all pools, default images dir first
+func (s *SparseFileVolumeController) getPoolDirs() []string {
+	names := make([]string, 0, len(s.opts.Pools))
+	for name := range s.opts.Pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	dirs := []string{s.imagesDir}
+	seen := map[string]bool{filepath.Clean(s.imagesDir): true}
+	for _, name := range names {
+		dir := s.opts.Pools[name]
+		if seen[filepath.Clean(dir)] {
+			continue
+		}
+		seen[filepath.Clean(dir)] = true
+		dirs = append(dirs, dir)
+	}
+	return dirs
+}
+
+// getVolumeDir returns images dir where volume image lives. Pool of volume is chosen once on create,
+// so it's resolved by image presence. Returns default images dir if volume doesn't exist
+func (s *SparseFileVolumeController) getVolumeDir(volumeId string) string {
+	if len(s.opts.Pools) == 0 {
+		return s.imagesDir
+	}
+
+	for _, dir := range s.getPoolDirs() {
+		if s.isFileExists(filepath.Join(dir, s.getImageFileName(volumeId))) {
+			return dir
+		}
+	}
+	return s.imagesDir
+}
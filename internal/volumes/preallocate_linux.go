@@ -0,0 +1,92 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/reinstall/csi-local-sparse/internal/metrics"
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+	"os"
+	"time"
+)
+
+const (
+	// preallocateChunkSize size of image region allocated by one fallocate call
+	preallocateChunkSize int64 = 1 << 30
+	// preallocateProgressInterval minimum interval of preallocation progress logs
+	preallocateProgressInterval = 10 * time.Second
+)
+
+// preallocate allocates all blocks of image chunk by chunk, so allocation of large image can be cancelled
+// and reports its progress. Partially allocated image is left to caller
+func (s *SparseFileVolumeController) preallocate(ctx context.Context, volumeId string, filename string, sizeBytes int64) error {
+	s.logger.Debug("preallocate called",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+		zap.Int64("size_bytes", sizeBytes),
+	)
+
+	file, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	if err != nil {
+		return fmt.Errorf("error open image: %w", err)
+	}
+	defer func() { _ = file.Close() }()
+
+	defer metrics.VolumePreallocateProgressRatio.DeleteLabelValues(volumeId)
+
+	started := time.Now()
+	lastReport := started
+	for offset := int64(0); offset < sizeBytes; offset += preallocateChunkSize {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		length := sizeBytes - offset
+		if length > preallocateChunkSize {
+			length = preallocateChunkSize
+		}
+
+		if err := unix.Fallocate(int(file.Fd()), 0, offset, length); err != nil {
+			if errors.Is(err, unix.ENOSPC) {
+				return fmt.Errorf("error allocate %d bytes at %d: %v: %w", length, offset, err, ErrorInsufficientCapacity)
+			}
+			return fmt.Errorf("error allocate %d bytes at %d: %w", length, offset, err)
+		}
+
+		ratio := float64(offset+length) / float64(sizeBytes)
+		metrics.VolumePreallocateProgressRatio.WithLabelValues(volumeId).Set(ratio)
+
+		if time.Since(lastReport) >= preallocateProgressInterval {
+			s.logger.Info("Volume image preallocation is in progress",
+				zap.String("volume_id", volumeId),
+				zap.Int("percent", int(ratio*100)),
+			)
+			lastReport = time.Now()
+		}
+	}
+
+	s.logger.Debug("Volume image was preallocated successfully",
+		zap.String("volume_id", volumeId),
+		zap.Duration("duration", time.Since(started)),
+	)
+	return nil
+}
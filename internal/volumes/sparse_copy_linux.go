@@ -0,0 +1,170 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"os"
+)
+
+const (
+	// sparseCopyChunkSize maximum bytes copied at once, context is checked between chunks
+	sparseCopyChunkSize = 64 * 1024 * 1024
+	// sparseCopyBufferSize buffer size of read/write fallback copy
+	sparseCopyBufferSize = 1024 * 1024
+)
+
+// copySparseFile copies file to new target file transferring only data extents, so holes are neither read
+// nor allocated. Target is reflinked when filesystem supports it. Fails if target already exists
+func copySparseFile(ctx context.Context, source string, target string) (err error) {
+	src, err := os.Open(source)
+	if err != nil {
+		return fmt.Errorf("error open source: %w", err)
+	}
+	defer func() { _ = src.Close() }()
+
+	info, err := src.Stat()
+	if err != nil {
+		return fmt.Errorf("error stat source: %w", err)
+	}
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("error create target: %w", err)
+	}
+	defer func() {
+		if closeErr := dst.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("error close target: %w", closeErr)
+		}
+	}()
+
+	// reflink shares extents with source, so copy takes neither time nor space
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		return nil
+	}
+
+	size := info.Size()
+	offset := int64(0)
+	for offset < size {
+		dataStart, err := unix.Seek(int(src.Fd()), offset, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			// no data after offset, the rest of file is a hole
+			break
+		}
+		if errors.Is(err, unix.EINVAL) {
+			// filesystem can't seek data, so the rest of file is read and zero blocks are skipped
+			if err := copyFileExtentFallback(ctx, src, dst, offset, size); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("error seek data: %w", err)
+		}
+
+		dataEnd, err := unix.Seek(int(src.Fd()), dataStart, unix.SEEK_HOLE)
+		if err != nil {
+			return fmt.Errorf("error seek hole: %w", err)
+		}
+
+		if err := copyFileExtent(ctx, src, dst, dataStart, dataEnd); err != nil {
+			return err
+		}
+		offset = dataEnd
+	}
+
+	// trailing hole isn't written, so size is set explicitly
+	if err := dst.Truncate(size); err != nil {
+		return fmt.Errorf("error truncate target: %w", err)
+	}
+
+	return nil
+}
+
+// copyFileExtent copies [start, end) range of source to the same offsets of target with copy_file_range,
+// falling back to read and write when kernel can't copy between given files
+func copyFileExtent(ctx context.Context, src *os.File, dst *os.File, start int64, end int64) error {
+	for start < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		length := end - start
+		if length > sparseCopyChunkSize {
+			length = sparseCopyChunkSize
+		}
+
+		srcOffset, dstOffset := start, start
+		n, err := unix.CopyFileRange(int(src.Fd()), &srcOffset, int(dst.Fd()), &dstOffset, int(length), 0)
+		if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.EOPNOTSUPP) {
+			return copyFileExtentFallback(ctx, src, dst, start, end)
+		}
+		if err != nil {
+			return fmt.Errorf("error copy file range: %w", err)
+		}
+		if n == 0 {
+			return fmt.Errorf("error copy file range: %w", io.ErrUnexpectedEOF)
+		}
+
+		start += int64(n)
+	}
+
+	return nil
+}
+
+// copyFileExtentFallback copies [start, end) range of source to target with read and write.
+// Zero blocks are skipped, so they stay holes in target
+func copyFileExtentFallback(ctx context.Context, src *os.File, dst *os.File, start int64, end int64) error {
+	buf := make([]byte, sparseCopyBufferSize)
+	zero := make([]byte, sparseCopyBufferSize)
+
+	for start < end {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		length := end - start
+		if length > int64(len(buf)) {
+			length = int64(len(buf))
+		}
+
+		n, err := src.ReadAt(buf[:length], start)
+		if n == 0 && err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return fmt.Errorf("error read source: %w", err)
+		}
+
+		if !bytes.Equal(buf[:n], zero[:n]) {
+			if _, err := dst.WriteAt(buf[:n], start); err != nil {
+				return fmt.Errorf("error write target: %w", err)
+			}
+		}
+
+		start += int64(n)
+	}
+
+	return nil
+}
@@ -0,0 +1,245 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"golang.org/x/sys/unix"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// sparseTestExtent data extent of sparse test file
+type sparseTestExtent struct {
+	offset int64
+	length int
+}
+
+// createSparseTestFile creates file of given size with patterned data at given extents and holes elsewhere
+func createSparseTestFile(t testing.TB, filename string, size int64, extents []sparseTestExtent) {
+	t.Helper()
+
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	for i, extent := range extents {
+		data := bytes.Repeat([]byte{byte(i + 1)}, extent.length)
+		if _, err := f.WriteAt(data, extent.offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := f.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// allocatedBytes returns bytes of blocks actually allocated by file
+func allocatedBytes(t testing.TB, filename string) int64 {
+	t.Helper()
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.Sys().(*syscall.Stat_t).Blocks * 512
+}
+
+// assertHoleAt fails test unless there is no data in file between offset and next data offset want,
+// or up to the end of file if want is -1
+func assertHoleAt(t *testing.T, filename string, offset int64, want int64) {
+	t.Helper()
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = f.Close() }()
+
+	got, err := unix.Seek(int(f.Fd()), offset, unix.SEEK_DATA)
+	if want == -1 {
+		if !errors.Is(err, unix.ENXIO) {
+			t.Errorf("data after %d at %d, want trailing hole", offset, got)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("seek data after %d error = %v", offset, err)
+	}
+	if got != want {
+		t.Errorf("data after %d starts at %d, want %d", offset, got, want)
+	}
+}
+
+func TestCopySparseFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		size    int64
+		extents []sparseTestExtent
+	}{
+		{name: "empty", size: 0},
+		{name: "hole only", size: 64 << 20},
+		{name: "data only", size: 1 << 20, extents: []sparseTestExtent{{offset: 0, length: 1 << 20}}},
+		{
+			name: "data between holes",
+			size: 64 << 20,
+			extents: []sparseTestExtent{
+				{offset: 0, length: 4096},
+				{offset: 1 << 20, length: 8192},
+				{offset: 32 << 20, length: 1 << 20},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			source := filepath.Join(dir, "source")
+			target := filepath.Join(dir, "target")
+			createSparseTestFile(t, source, tt.size, tt.extents)
+
+			if err := copySparseFile(context.Background(), source, target); err != nil {
+				t.Fatalf("copySparseFile() error = %v", err)
+			}
+
+			sourceData, err := os.ReadFile(source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			targetData, err := os.ReadFile(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(sourceData, targetData) {
+				t.Fatalf("target data differs from source")
+			}
+
+			if allocated, sourceAllocated := allocatedBytes(t, target), allocatedBytes(t, source); allocated > sourceAllocated {
+				t.Errorf("target allocated %d bytes, source %d", allocated, sourceAllocated)
+			}
+
+			// holes between extents and trailing hole are kept
+			for i, extent := range tt.extents {
+				end := extent.offset + int64(extent.length)
+				next := int64(-1)
+				if i+1 < len(tt.extents) {
+					next = tt.extents[i+1].offset
+				}
+				if end < tt.size {
+					assertHoleAt(t, target, end, next)
+				}
+			}
+		})
+	}
+}
+
+func TestCopySparseFileTargetExists(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	createSparseTestFile(t, source, 1<<20, nil)
+	createSparseTestFile(t, target, 1<<20, nil)
+
+	if err := copySparseFile(context.Background(), source, target); !errors.Is(err, os.ErrExist) {
+		t.Fatalf("copySparseFile() error = %v, want %v", err, os.ErrExist)
+	}
+}
+
+func TestCopyFileExtentFallback(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source")
+	target := filepath.Join(dir, "target")
+	size := int64(8 << 20)
+	// zero block written as data is read and skipped
+	createSparseTestFile(t, source, size, []sparseTestExtent{{offset: 2 << 20, length: 4096}})
+	f, err := os.OpenFile(source, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt(make([]byte, 1<<20), 4<<20); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	src, err := os.Open(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = src.Close() }()
+	dst, err := os.Create(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = dst.Close() }()
+
+	if err := copyFileExtentFallback(context.Background(), src, dst, 0, size); err != nil {
+		t.Fatalf("copyFileExtentFallback() error = %v", err)
+	}
+	if err := dst.Truncate(size); err != nil {
+		t.Fatal(err)
+	}
+
+	sourceData, err := os.ReadFile(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	targetData, err := os.ReadFile(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sourceData, targetData) {
+		t.Fatalf("target data differs from source")
+	}
+
+	// data is written by whole buffers, so hole starts from the next buffer
+	assertHoleAt(t, target, 0, 2<<20)
+	assertHoleAt(t, target, 2<<20+sparseCopyBufferSize, -1)
+}
+
+func BenchmarkCopySparseFile(b *testing.B) {
+	dir := b.TempDir()
+	source := filepath.Join(dir, "source")
+	// mostly empty 100Gi image with filesystem metadata like extents spread over it
+	extents := make([]sparseTestExtent, 0)
+	for offset := int64(0); offset < 100<<30; offset += 4 << 30 {
+		extents = append(extents, sparseTestExtent{offset: offset, length: 1 << 20})
+	}
+	createSparseTestFile(b, source, 100<<30, extents)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		target := filepath.Join(dir, "target")
+		if err := copySparseFile(context.Background(), source, target); err != nil {
+			b.Fatal(err)
+		}
+
+		b.StopTimer()
+		if err := os.Remove(target); err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+	}
+}
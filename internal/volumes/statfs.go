@@ -0,0 +1,53 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"math"
+)
+
+// multiplyClamped returns a*b clamped to math.MaxInt64 instead of overflow.
+// Statfs_t field types differ between architectures, so callers convert them to uint64 first
+func multiplyClamped(a uint64, b uint64) int64 {
+	if a == 0 || b == 0 {
+		return 0
+	}
+
+	if a > math.MaxInt64/b {
+		return math.MaxInt64
+	}
+
+	return int64(a * b)
+}
+
+// toInt64Clamped returns v clamped to math.MaxInt64
+func toInt64Clamped(v uint64) int64 {
+	if v > math.MaxInt64 {
+		return math.MaxInt64
+	}
+
+	return int64(v)
+}
+
+// subtractFloor returns a-b or 0 if b > a
+func subtractFloor(a uint64, b uint64) uint64 {
+	if b > a {
+		return 0
+	}
+
+	return a - b
+}
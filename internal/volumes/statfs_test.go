@@ -0,0 +1,91 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"math"
+	"testing"
+)
+
+func TestMultiplyClamped(t *testing.T) {
+	tests := []struct {
+		name string
+		a    uint64
+		b    uint64
+		want int64
+	}{
+		{name: "zero blocks", a: 0, b: 4096, want: 0},
+		{name: "zero block size", a: 1 << 40, b: 0, want: 0},
+		{name: "40TB pool", a: 10737418240, b: 4096, want: 43980465111040},
+		{name: "max without overflow", a: math.MaxInt64 / 4096, b: 4096, want: math.MaxInt64 / 4096 * 4096},
+		{name: "one block over max", a: math.MaxInt64/4096 + 1, b: 4096, want: math.MaxInt64},
+		{name: "max int64 by one", a: math.MaxInt64, b: 1, want: math.MaxInt64},
+		{name: "above max int64 by one", a: math.MaxInt64 + 1, b: 1, want: math.MaxInt64},
+		{name: "max uint64", a: math.MaxUint64, b: math.MaxUint64, want: math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := multiplyClamped(tt.a, tt.b); got != tt.want {
+				t.Errorf("multiplyClamped(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToInt64Clamped(t *testing.T) {
+	tests := []struct {
+		name string
+		v    uint64
+		want int64
+	}{
+		{name: "zero", v: 0, want: 0},
+		{name: "max int64", v: math.MaxInt64, want: math.MaxInt64},
+		{name: "above max int64", v: math.MaxInt64 + 1, want: math.MaxInt64},
+		{name: "max uint64", v: math.MaxUint64, want: math.MaxInt64},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := toInt64Clamped(tt.v); got != tt.want {
+				t.Errorf("toInt64Clamped(%d) = %d, want %d", tt.v, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubtractFloor(t *testing.T) {
+	tests := []struct {
+		name string
+		a    uint64
+		b    uint64
+		want uint64
+	}{
+		{name: "less", a: 10, b: 3, want: 7},
+		{name: "equal", a: 10, b: 10, want: 0},
+		{name: "greater", a: 3, b: 10, want: 0},
+		{name: "max uint64", a: math.MaxUint64, b: 1, want: math.MaxUint64 - 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := subtractFloor(tt.a, tt.b); got != tt.want {
+				t.Errorf("subtractFloor(%d, %d) = %d, want %d", tt.a, tt.b, got, tt.want)
+			}
+		})
+	}
+}
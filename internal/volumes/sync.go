@@ -0,0 +1,47 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// syncFileAndDir flushes file and its directory entry to disk, so created file survives power loss
+func syncFileAndDir(filename string) error {
+	if err := syncPath(filename); err != nil {
+		return fmt.Errorf("error sync file: %w", err)
+	}
+
+	if err := syncPath(filepath.Dir(filename)); err != nil {
+		return fmt.Errorf("error sync directory: %w", err)
+	}
+
+	return nil
+}
+
+// syncPath fsyncs file or directory
+func syncPath(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+
+	return f.Sync()
+}
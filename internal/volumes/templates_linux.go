@@ -0,0 +1,162 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"fmt"
+	"go.uber.org/zap"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// defaultTemplatesDir templates dir relative to images dir used when templates dir is not configured
+	defaultTemplatesDir = "templates"
+)
+
+// CreateFromTemplate creates volume as a copy of admin managed template image expanded to given size.
+// Template must have given filesystem, since it's mounted as is. Only data extents are copied and copy is reflinked when filesystem supports it. Ext filesystem of template is grown to the whole volume
+func (s *SparseFileVolumeController) CreateFromTemplate(ctx context.Context, volumeId string, pool string, template string, fsType string, sizeBytes int64) (bool, error) {
+	s.logger.Debug("CreateFromTemplate called",
+		zap.String("volume_id", volumeId),
+		zap.String("pool", pool),
+		zap.String("template", template),
+		zap.String("fs_type", fsType),
+		zap.Int64("size_bytes", sizeBytes),
+	)
+
+	if volumeId == "" {
+		return false, fmt.Errorf("volumeId can't be empty")
+	}
+
+	if sizeBytes == 0 {
+		return false, fmt.Errorf("size can't be equal 0")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if s.isFileExists(filename) {
+		s.logger.Debug("File is already exists, so skip creating",
+			zap.String("volume_id", volumeId),
+			zap.String("filename", filename),
+		)
+		return false, s.checkExistingSize(ctx, volumeId, sizeBytes)
+	}
+
+	templateFilename, err := s.getTemplateFullPath(template)
+	if err != nil {
+		return false, err
+	}
+
+	info, err := os.Stat(templateFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, fmt.Errorf("template %q: %w", template, ErrorTemplateNotFound)
+		}
+		return false, fmt.Errorf("error stat template: %w", err)
+	}
+
+	if info.Size() > sizeBytes {
+		return false, fmt.Errorf("template %q size %d, requested %d: %w", template, info.Size(), sizeBytes, ErrorTemplateTooLarge)
+	}
+
+	templateFs, err := s.getCurrentFilesystem(ctx, templateFilename)
+	if err != nil {
+		return false, fmt.Errorf("error get template filesystem: %w", err)
+	}
+
+	if templateFs != fsType {
+		return false, fmt.Errorf("template %q has filesystem %q, requested %q: %w", template, templateFs, fsType, ErrorTemplateFsMismatch)
+	}
+
+	dir, err := s.getPoolDir(pool)
+	if err != nil {
+		return false, err
+	}
+	filename = filepath.Join(dir, s.getImageFileName(volumeId))
+
+	// volume appears only after it's completely prepared, so retry after failure starts from scratch
+	tmpFilename := filename + ".tmp"
+	if err := s.prepareFromTemplate(ctx, templateFilename, tmpFilename, templateFs, sizeBytes); err != nil {
+		_ = os.Remove(tmpFilename)
+		return false, err
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return false, fmt.Errorf("error rename prepared image: %w", err)
+	}
+
+	if !s.opts.NoSyncOnCreate {
+		if err := syncFileAndDir(filename); err != nil {
+			return true, fmt.Errorf("error sync created file: %w", err)
+		}
+	}
+
+	s.logger.Debug("Volume file was created from template successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+		zap.String("template", template),
+	)
+	return true, nil
+}
+
+// prepareFromTemplate copies template to filename, expands it to given size and grows its ext filesystem
+func (s *SparseFileVolumeController) prepareFromTemplate(ctx context.Context, templateFilename string, filename string, fsType string, sizeBytes int64) error {
+	if err := copySparseFile(ctx, templateFilename, filename); err != nil {
+		return fmt.Errorf("error copy template: %w", err)
+	}
+
+	if err := s.truncate(ctx, filename, sizeBytes); err != nil {
+		return fmt.Errorf("error truncate file: %w", err)
+	}
+
+	if !isExtFilesystem(fsType) {
+		s.logger.Debug("Template filesystem can't be resized, keep it as is",
+			zap.String("filename", filename),
+			zap.String("fs_type", fsType),
+		)
+		return nil
+	}
+
+	if err := s.checkFs(ctx, filename); err != nil {
+		return fmt.Errorf("error check filesystem: %w", err)
+	}
+
+	if err := s.resizeFs(ctx, filename, 0); err != nil {
+		return fmt.Errorf("error resize filesystem: %w", err)
+	}
+
+	return nil
+}
+
+// getTemplateFullPath returns path of template image by template name
+func (s *SparseFileVolumeController) getTemplateFullPath(template string) (string, error) {
+	if template == "" || strings.Contains(template, "/") || strings.HasPrefix(template, ".") {
+		return "", fmt.Errorf("invalid template name %q", template)
+	}
+
+	dir := s.opts.TemplatesDir
+	if dir == "" {
+		dir = filepath.Join(s.imagesDir, defaultTemplatesDir)
+	}
+
+	return filepath.Join(dir, template+s.getImageExtension()), nil
+}
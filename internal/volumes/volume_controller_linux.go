@@ -0,0 +1,1667 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go.uber.org/zap"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var (
+	// errFsNeedsCheck resize2fs refused to resize filesystem, which wasn't checked since last mount
+	errFsNeedsCheck = errors.New("filesystem needs check before resize")
+)
+
+// SparseFileVolumeControllerOptions optional settings of sparse file volume controller
+type SparseFileVolumeControllerOptions struct {
+	// DirectIO use direct-io on loop devices
+	DirectIO bool
+	// DeviceTuning default read-ahead and io scheduler of loop devices, kernel defaults if empty
+	DeviceTuning DeviceTuning
+	// IOCgroup cgroup v2 directory where per volume io limits are applied, disabled if empty
+	IOCgroup string
+	// NameLinks create human-friendly symlinks to volume images in by-name directory
+	NameLinks bool
+	// FsLabel set filesystem label to volume id (truncated to filesystem limit) on format
+	FsLabel bool
+	// FsUUID set filesystem UUID derived from volume id on format, so it's verified after attach
+	FsUUID bool
+	// LoopSectorSize logical sector size of loop devices of newly formatted volumes, losetup default if 0
+	LoopSectorSize int
+	// ReservedBlocksPercent percentage of filesystem blocks reserved for root on format, mkfs default if nil
+	ReservedBlocksPercent *int
+	// FsMaxMountCount maximum mount count between ext filesystem checks set after format, 0 disables the checks, unchanged if nil
+	FsMaxMountCount *int
+	// FsCheckIntervalDays maximum days between ext filesystem checks set after format, 0 disables the checks, unchanged if nil
+	FsCheckIntervalDays *int
+	// FormatJitter maximum random delay before mkfs, spreading disk load of simultaneous formats, disabled if 0
+	FormatJitter time.Duration
+	// HeavyCommandsNice niceness of mkfs and resize commands, unchanged if 0
+	HeavyCommandsNice int
+	// HeavyCommandsIoniceClass io scheduling class of mkfs and resize commands (1 - realtime, 2 - best-effort, 3 - idle), unchanged if 0
+	HeavyCommandsIoniceClass int
+	// ImageExtension volume image file extension without dot, "img" if empty
+	ImageExtension string
+	// ImagePrefix volume image file name prefix
+	ImagePrefix string
+	// Pools additional named images dirs by pool name
+	Pools map[string]string
+	// NoSyncOnCreate skip fsync of created image and images dir
+	NoSyncOnCreate bool
+	// PunchHolesOnDelete deallocate all blocks of image before removing it, for copy-on-write and deduplicating filesystems
+	PunchHolesOnDelete bool
+	// Preallocate allocate all blocks of created image instead of leaving it sparse
+	Preallocate bool
+	// DetachSingle detach only the device of volume instead of all loop devices bound to its image
+	DetachSingle bool
+	// ScanBusyDeviceHolders scan /proc for processes holding device open when detach fails with busy device
+	ScanBusyDeviceHolders bool
+	// TemplatesDir directory of volume template images, <images dir>/templates if empty
+	TemplatesDir string
+	// NbdExport allow exporting volume images over nbd
+	NbdExport bool
+	// NbdExportAddress listening address of nbd servers
+	NbdExportAddress string
+	// NbdExportPort first port of nbd servers, each exported volume takes its own port
+	NbdExportPort int
+	// NbdExportMaxCount maximum count of simultaneously exported volumes
+	NbdExportMaxCount int
+}
+
+// SparseFileVolumeController volume controller working with linux sparse files
+type SparseFileVolumeController struct {
+	// imagesDir sparse images directory path
+	imagesDir string
+	// opts optional settings
+	opts SparseFileVolumeControllerOptions
+	// exports running nbd exports by volume id
+	exports map[string]*nbdExport
+	// exportsMu guards exports
+	exportsMu sync.Mutex
+	// logger .
+	logger *zap.Logger
+}
+
+// NewLinuxSparseFileVolumeController returns new controller
+func NewLinuxSparseFileVolumeController(dataDir string, opts SparseFileVolumeControllerOptions, logger *zap.Logger) *SparseFileVolumeController {
+	return &SparseFileVolumeController{
+		imagesDir: dataDir,
+		opts:      opts,
+		exports:   map[string]*nbdExport{},
+		logger:    logger.With(zap.String("logger", "SparseFileVolumeController")),
+	}
+}
+
+// Create creates volume sparse file in pool images dir if it's not already exists in any pool.
+// Returns true if file was created by this call, false and nil if file with the same size is exists,
+// ErrorVolumeAlreadyExists if its size differs
+func (s *SparseFileVolumeController) Create(ctx context.Context, volumeId string, pool string, sizeBytes int64) (bool, error) {
+	s.logger.Debug("Create called",
+		zap.String("volume_id", volumeId),
+		zap.String("pool", pool),
+		zap.Int64("size_bytes", sizeBytes),
+	)
+
+	if volumeId == "" {
+		return false, fmt.Errorf("volumeId can't be empty")
+	}
+
+	if sizeBytes == 0 {
+		return false, fmt.Errorf("size can't be equal 0")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if s.isFileExists(filename) {
+		s.logger.Debug("File is already exists, so skip creating",
+			zap.String("volume_id", volumeId),
+			zap.String("filename", filename),
+		)
+		return false, s.checkExistingSize(ctx, volumeId, sizeBytes)
+	}
+
+	dir, err := s.getPoolDir(pool)
+	if err != nil {
+		return false, err
+	}
+	filename = fmt.Sprintf("%s/%s", strings.TrimSuffix(dir, "/"), s.getImageFileName(volumeId))
+
+	// volume appears only after it's completely created, so failed or cancelled create never leaves image,
+	// which retry would take as existing volume of possibly wrong size
+	tmpFilename := filename + ".tmp"
+	if err := s.prepareImage(ctx, volumeId, tmpFilename, sizeBytes); err != nil {
+		// partially created image would hold space until retry
+		if removeErr := os.Remove(tmpFilename); removeErr != nil && !os.IsNotExist(removeErr) {
+			s.logger.Error("Error remove partially created image",
+				zap.String("volume_id", volumeId),
+				zap.String("filename", tmpFilename),
+				zap.Error(removeErr),
+			)
+		}
+		return false, err
+	}
+
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		_ = os.Remove(tmpFilename)
+		return false, fmt.Errorf("error rename created image: %w", err)
+	}
+
+	// image data was synced before rename, so only directory entry is left
+	if !s.opts.NoSyncOnCreate {
+		if err := syncPath(filepath.Dir(filename)); err != nil {
+			return true, fmt.Errorf("error sync images directory: %w", err)
+		}
+	}
+
+	s.logger.Debug("Volume file was created successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+	)
+	return true, nil
+}
+
+// prepareImage creates sparse or preallocated image of given size and syncs it. Stale image of interrupted create is
+// replaced. Cancelled context fails prepare even if image is complete, so caller removes it
+func (s *SparseFileVolumeController) prepareImage(ctx context.Context, volumeId string, filename string, sizeBytes int64) error {
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error remove stale image: %w", err)
+	}
+
+	if err := s.truncate(ctx, filename, sizeBytes); err != nil {
+		return fmt.Errorf("error truncate file: %w", err)
+	}
+
+	if s.opts.Preallocate {
+		if err := s.preallocate(ctx, volumeId, filename, sizeBytes); err != nil {
+			return fmt.Errorf("error preallocate image: %w", err)
+		}
+	}
+
+	if !s.opts.NoSyncOnCreate {
+		if err := syncPath(filename); err != nil {
+			return fmt.Errorf("error sync created file: %w", err)
+		}
+	}
+
+	return ctx.Err()
+}
+
+// checkExistingSize returns ErrorVolumeAlreadyExists if existing volume size differs from requested one,
+// so repeated create of the same volume succeeds, while create of incompatible one fails
+func (s *SparseFileVolumeController) checkExistingSize(ctx context.Context, volumeId string, sizeBytes int64) error {
+	currentSize, err := s.GetVolumeSize(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get current volume size: %w", err)
+	}
+
+	if currentSize != sizeBytes {
+		return fmt.Errorf("volume size %d differs from requested %d: %w", currentSize, sizeBytes, ErrorVolumeAlreadyExists)
+	}
+	return nil
+}
+
+// Delete deletes volume sparse file. Returns nil if file is not exists or deleted successfully
+func (s *SparseFileVolumeController) Delete(ctx context.Context, volumeId string) error {
+	s.logger.Debug("Delete called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		s.logger.Debug("File is not exists, assume it was already deleted and skip removing",
+			zap.String("volume_id", volumeId),
+			zap.String("filename", filename),
+		)
+		return s.deleteMetadata(volumeId)
+	}
+
+	// punching holes of attached image would zero data under live device
+	if s.opts.PunchHolesOnDelete {
+		dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+		if err != nil {
+			return fmt.Errorf("error get device by volumeId: %w", err)
+		}
+
+		if dev != "" {
+			return fmt.Errorf("image is attached to %s: %w", dev, ErrorVolumeInUse)
+		}
+	}
+
+	if err := s.deleteNameLink(ctx, volumeId); err != nil {
+		return fmt.Errorf("error delete name link: %w", err)
+	}
+
+	if err := s.UnexportVolume(ctx, volumeId); err != nil {
+		return fmt.Errorf("error unexport volume: %w", err)
+	}
+
+	// extents shared with snapshots of backing filesystem aren't freed by unlink alone
+	if s.opts.PunchHolesOnDelete {
+		if err := s.punchHoles(ctx, filename); err != nil {
+			return fmt.Errorf("error punch holes: %w", err)
+		}
+	}
+
+	removeCmd := "rm"
+
+	args := []string{
+		"-f",
+		filename,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, removeCmd, args...); err != nil {
+		return err
+	}
+
+	if err := s.deleteMetadata(volumeId); err != nil {
+		return fmt.Errorf("error delete metadata: %w", err)
+	}
+
+	s.logger.Debug("Volume file was deleted successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+	)
+	return nil
+}
+
+// GetVolumeStats returns volume capacity statistics
+func (s *SparseFileVolumeController) GetVolumeStats(_ context.Context, path string) (*VolumeStatistics, error) {
+	s.logger.Debug("GetVolumeStats called")
+
+	if path == "" {
+		return nil, fmt.Errorf("path can't be empty")
+	}
+
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(path, &fs); err != nil {
+		return nil, fmt.Errorf("error get volume capacity stats: %w", err)
+	}
+
+	bsize := uint64(fs.Bsize)
+	stats := &VolumeStatistics{
+		AvailableBytes: multiplyClamped(uint64(fs.Bavail), bsize),
+		TotalBytes:     multiplyClamped(uint64(fs.Blocks), bsize),
+		UsedBytes:      multiplyClamped(subtractFloor(uint64(fs.Blocks), uint64(fs.Bfree)), bsize),
+
+		AvailableInodes: toInt64Clamped(uint64(fs.Ffree)),
+		TotalInodes:     toInt64Clamped(uint64(fs.Files)),
+		UsedInodes:      toInt64Clamped(subtractFloor(uint64(fs.Files), uint64(fs.Ffree))),
+	}
+
+	s.logger.Debug("Finish calculate volume stats",
+		zap.String("path", path),
+		zap.Int64("avail_bytes", stats.AvailableBytes),
+		zap.Int64("used_bytes", stats.UsedBytes),
+		zap.Int64("total_bytes", stats.TotalBytes),
+		zap.Int64("avail_inodes", stats.AvailableInodes),
+		zap.Int64("used_inodes", stats.UsedInodes),
+		zap.Int64("total_inodes", stats.TotalInodes),
+	)
+	return stats, nil
+}
+
+// GetCapacity returns available storage pool space in bytes
+func (s *SparseFileVolumeController) GetCapacity(_ context.Context, pool string) (int64, error) {
+	s.logger.Debug("GetCapacity called", zap.String("pool", pool))
+
+	dir, err := s.getPoolDir(pool)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.getDirCapacity(dir)
+}
+
+// getDirCapacity returns available space of filesystem of images dir
+func (s *SparseFileVolumeController) getDirCapacity(dir string) (int64, error) {
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, fmt.Errorf("error get storage capacity stats: %w", err)
+	}
+
+	avail := multiplyClamped(uint64(fs.Bfree), uint64(fs.Bsize))
+	s.logger.Debug("Finish calculate storage available capacity",
+		zap.String("storage_path", dir),
+		zap.Int64("available_bytes", avail),
+	)
+	return avail, nil
+}
+
+// GetVolumeSize returns given volume size
+func (s *SparseFileVolumeController) GetVolumeSize(ctx context.Context, volumeId string) (int64, error) {
+	s.logger.Debug("GetVolumeSize called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return 0, fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return 0, ErrorVolumeNotFound
+	}
+
+	statCmd := "stat"
+
+	args := []string{
+		"-c",
+		"%s",
+		filename,
+	}
+
+	out, err := runCommand(ctx, s.logger, nil, statCmd, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	size, err := strconv.ParseInt(strings.TrimSpace(string(out)), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("error parse output: %w", err)
+	}
+
+	s.logger.Debug("Finish calculate volume size",
+		zap.String("volume_id", volumeId),
+		zap.Int64("size_bytes", size),
+	)
+	return size, nil
+}
+
+// ExpandVolumeSize expands given volume. Returns nil if newSize <= currentSize or expand successfully
+func (s *SparseFileVolumeController) ExpandVolumeSize(ctx context.Context, volumeId string, newSizeBytes int64) error {
+	s.logger.Debug("ExpandVolumeSize called", zap.String("volume_id", volumeId), zap.Int64("new_size", newSizeBytes))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	if newSizeBytes <= 0 {
+		return fmt.Errorf("size can't be less or equal 0")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	currentSize, err := s.GetVolumeSize(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get current volume size: %w", err)
+	}
+
+	// currently shrinking is not supported
+	addSize := newSizeBytes - currentSize
+	if addSize <= 0 {
+		s.logger.Info("Volume size already satisfies requested size, so skip expanding",
+			zap.String("volume_id", volumeId),
+			zap.Int64("current_size_bytes", currentSize),
+			zap.Int64("new_size_bytes", newSizeBytes),
+		)
+		return nil
+	}
+
+	available, err := s.getDirCapacity(s.getVolumeDir(volumeId))
+	if err != nil {
+		return fmt.Errorf("error get storage capacity: %w", err)
+	}
+
+	// sparse file doesn't allocate added space upfront, so it's enough to have the delta available
+	if addSize > available {
+		return &CapacityError{Requested: addSize, Available: available}
+	}
+
+	if err := s.truncate(ctx, filename, newSizeBytes); err != nil {
+		return fmt.Errorf("error truncate file: %w", err)
+	}
+
+	s.logger.Debug("Volume size was expanded successfully",
+		zap.String("volume_id", volumeId),
+		zap.Int64("add_size_bytes", addSize),
+	)
+	return nil
+}
+
+// offlineResizeDetachTimeout timeout of detach of device attached for offline resize, independent of request deadline
+const offlineResizeDetachTimeout = 30 * time.Second
+
+// ResizeDeviceFileSystem resizes filesystem of device, attached to given volume, to the given size
+// rounded down to KiB or grows it to the whole device if size is 0. Given device is verified to be bound to volume image,
+// device is looked up by volume id if empty
+func (s *SparseFileVolumeController) ResizeDeviceFileSystem(ctx context.Context, volumeId string, device string, sizeBytes int64) error {
+	s.logger.Debug("ResizeDeviceFileSystem called",
+		zap.String("volume_id", volumeId),
+		zap.String("device", device),
+		zap.Int64("size_bytes", sizeBytes),
+	)
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	if sizeBytes < 0 {
+		return fmt.Errorf("size can't be less than 0")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	var err error
+	dev := device
+	if dev == "" {
+		dev, err = s.GetDeviceByVolumeId(ctx, volumeId)
+		if err != nil {
+			return fmt.Errorf("error get loop device: %w", err)
+		}
+	}
+
+	// offline resize: attach image only for the time of resize
+	offline := dev == ""
+	if offline {
+		dev, err = s.AttachDevice(ctx, volumeId)
+		if err != nil {
+			return fmt.Errorf("error attach device for offline resize: %w", err)
+		}
+
+		defer func() {
+			// resize could fail because ctx is expired, device must be detached anyway
+			detachCtx, cancel := context.WithTimeout(context.Background(), offlineResizeDetachTimeout)
+			defer cancel()
+
+			if err := s.DetachDevice(detachCtx, volumeId); err != nil {
+				s.logger.Error("Error detach device after offline resize",
+					zap.String("volume_id", volumeId),
+					zap.String("device", dev),
+					zap.Error(err),
+				)
+			}
+		}()
+	}
+
+	// stale loop device state after crash must not let set-capacity and resize2fs touch filesystem of another volume
+	if err := s.verifyDeviceBackingFile(ctx, dev, filename); err != nil {
+		return err
+	}
+
+	if !offline {
+		if err := s.expandLoopDevice(ctx, dev); err != nil {
+			return fmt.Errorf("error expand loop device: %w", err)
+		}
+	}
+
+	fsType, err := s.getCurrentFilesystem(ctx, dev)
+	if err != nil {
+		return fmt.Errorf("error get current filesystem: %w", err)
+	}
+
+	// filesystem created on first stage will take the whole device
+	if fsType == "" {
+		s.logger.Debug("Device is not formatted, so skip resizing filesystem", zap.String("volume_id", volumeId))
+		return nil
+	}
+
+	// e2fsck and resize2fs handle ext filesystems only
+	if !isExtFilesystem(fsType) {
+		return fmt.Errorf("resize of %q filesystem is not supported", fsType)
+	}
+
+	mounted, err := isDeviceMounted(dev)
+	if err != nil {
+		return fmt.Errorf("error check if device is mounted: %w", err)
+	}
+
+	// online resize: resize2fs grows mounted filesystem through its device
+	if mounted {
+		if err := s.resizeFs(ctx, dev, sizeBytes); err != nil {
+			return fmt.Errorf("error resize filesystem: %w", err)
+		}
+
+		s.logger.Debug("Device filesystem was resized online successfully", zap.String("volume_id", volumeId))
+		return nil
+	}
+
+	if err := s.checkFs(ctx, dev); err != nil {
+		return fmt.Errorf("error check filesystem: %w", err)
+	}
+
+	err = s.resizeFs(ctx, dev, sizeBytes)
+	if errors.Is(err, errFsNeedsCheck) {
+		s.logger.Warn("Filesystem needs check before resize, check it and retry",
+			zap.String("volume_id", volumeId),
+			zap.String("device", dev),
+		)
+
+		if err := s.checkFs(ctx, dev); err != nil {
+			return fmt.Errorf("error check filesystem: %w", err)
+		}
+		err = s.resizeFs(ctx, dev, sizeBytes)
+	}
+	if err != nil {
+		return fmt.Errorf("error resize filesystem: %w", err)
+	}
+
+	s.logger.Debug("Device filesystem was resized offline successfully", zap.String("volume_id", volumeId))
+	return nil
+}
+
+// AttachDevice attaches volume sparse file to loop device and returns device name
+func (s *SparseFileVolumeController) AttachDevice(ctx context.Context, volumeId string) (string, error) {
+	s.logger.Debug("AttachDevice called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return "", fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return "", ErrorVolumeNotFound
+	}
+
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return "", fmt.Errorf("error get device by volumeId: %w", err)
+	}
+
+	// do nothing if already attached
+	if dev != "" {
+		s.logger.Debug("Device already attached, so skip it",
+			zap.String("volume_id", volumeId),
+			zap.String("device", dev),
+		)
+		return dev, nil
+	}
+
+	metadata, err := s.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return "", fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	loSetupCmd := fmt.Sprintf("losetup")
+
+	args := []string{
+		"--find",
+		"--show",
+	}
+
+	// sector size is fixed at format time, volumes formatted without it keep default one
+	if metadata.SectorSize != 0 {
+		args = append(args, "--sector-size", strconv.Itoa(metadata.SectorSize))
+	}
+
+	// volume's own setting takes precedence over controller's one
+	if metadata.DirectIO != nil {
+		args = append(args, fmt.Sprintf("--direct-io=%s", onOff(*metadata.DirectIO)))
+	} else if s.opts.DirectIO {
+		args = append(args, "--direct-io=on")
+	}
+
+	args = append(args, filename)
+
+	out, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...)
+	if err != nil {
+		if cmdErr := asCommandError(err); cmdErr != nil && isNoFreeLoopDeviceOutput([]byte(cmdErr.Stderr)) {
+			s.logger.Error("Loop devices pool is exhausted", zap.Int("loop_devices_in_use", countLoopDevicesInUse()))
+			return "", cmdErr.withCause(ErrorNoFreeLoopDevice)
+		}
+
+		return "", err
+	}
+
+	dev = strings.TrimSpace(string(out))
+
+	s.logger.Debug("Device was attached successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("device", dev),
+	)
+	return dev, nil
+}
+
+// DetachDevice detaches volume sparse file from loop device
+func (s *SparseFileVolumeController) DetachDevice(ctx context.Context, volumeId string) error {
+	s.logger.Debug("DetachDevice called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get device by volumeId: %w", err)
+	}
+
+	// do nothing if already detached, e.g. on retried unstage
+	if dev == "" {
+		s.logger.Debug("Device is not attached, so skip detaching", zap.String("volume_id", volumeId))
+		return nil
+	}
+
+	loSetupCmd := fmt.Sprintf("losetup")
+
+	args := []string{
+		"--detach-all",
+		filename,
+	}
+	// other loop devices bound to the image on purpose are kept
+	if s.opts.DetachSingle {
+		args = []string{
+			"--detach",
+			dev,
+		}
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...); err != nil {
+		if cmdErr := asCommandError(err); cmdErr != nil && isDeviceBusyOutput([]byte(cmdErr.Stderr)) {
+			s.logBusyDeviceHolders(volumeId, dev)
+			return cmdErr.withCause(ErrorDeviceBusy)
+		}
+
+		return err
+	}
+
+	s.logger.Debug("Device was detached successfully", zap.String("volume_id", volumeId), zap.String("device", dev))
+	return nil
+}
+
+// logBusyDeviceHolders logs device which can't be detached, with processes holding it open if holders scan is enabled
+func (s *SparseFileVolumeController) logBusyDeviceHolders(volumeId string, device string) {
+	if !s.opts.ScanBusyDeviceHolders {
+		s.logger.Warn("Device is busy and can't be detached", zap.String("volume_id", volumeId), zap.String("device", device))
+		return
+	}
+
+	holders, err := findDeviceHolders(device)
+	if err != nil {
+		s.logger.Warn("Device is busy and can't be detached, error find processes holding it",
+			zap.String("volume_id", volumeId),
+			zap.String("device", device),
+			zap.Error(err),
+		)
+		return
+	}
+
+	s.logger.Warn("Device is busy and can't be detached",
+		zap.String("volume_id", volumeId),
+		zap.String("device", device),
+		zap.Strings("holders", holders),
+	)
+}
+
+// GetImagePath returns volume sparse file path
+func (s *SparseFileVolumeController) GetImagePath(_ context.Context, volumeId string) (string, error) {
+	if volumeId == "" {
+		return "", fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return "", ErrorVolumeNotFound
+	}
+
+	return filename, nil
+}
+
+// GetVolumeModTime returns last modification time of volume sparse file
+func (s *SparseFileVolumeController) GetVolumeModTime(_ context.Context, volumeId string) (time.Time, error) {
+	if volumeId == "" {
+		return time.Time{}, fmt.Errorf("volumeId can't be empty")
+	}
+
+	info, err := os.Stat(s.getImageFullPath(volumeId))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return time.Time{}, ErrorVolumeNotFound
+		}
+		return time.Time{}, fmt.Errorf("error stat image: %w", err)
+	}
+
+	return info.ModTime(), nil
+}
+
+// SetDirectIO switches direct-io mode of attached loop device
+func (s *SparseFileVolumeController) SetDirectIO(ctx context.Context, device string, enabled bool) error {
+	s.logger.Debug("SetDirectIO called", zap.String("device", device), zap.Bool("enabled", enabled))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	loSetupCmd := fmt.Sprintf("losetup")
+
+	args := []string{
+		fmt.Sprintf("--direct-io=%s", onOff(enabled)),
+		device,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Device direct-io mode was switched successfully",
+		zap.String("device", device),
+		zap.Bool("enabled", enabled),
+	)
+	return nil
+}
+
+// GetDeviceByVolumeId returns device path if attached otherwise empty string
+func (s *SparseFileVolumeController) GetDeviceByVolumeId(ctx context.Context, volumeId string) (string, error) {
+	s.logger.Debug("GetDeviceByVolumeId called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return "", fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return "", ErrorVolumeNotFound
+	}
+
+	loSetupCmd := fmt.Sprintf("losetup")
+
+	args := []string{
+		"--associated",
+		filename,
+	}
+
+	out, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...)
+	if err != nil {
+		return "", err
+	}
+
+	outStr := strings.Split(strings.TrimSpace(string(out)), ":")
+	if len(outStr) > 0 && outStr[0] != "" {
+		dev := outStr[0]
+
+		s.logger.Debug("Find device by volumeId successfully",
+			zap.String("volume_id", volumeId),
+			zap.String("device", dev),
+		)
+		return dev, nil
+	}
+
+	s.logger.Debug("Can't find device by volumeId, result is empty",
+		zap.String("volume_id", volumeId),
+	)
+	return "", nil
+}
+
+// VerifyDeviceFilesystem returns FilesystemError if filesystem UUID of attached device differs from UUID set on format
+// of the volume. Volumes formatted without UUID option aren't checked
+func (s *SparseFileVolumeController) VerifyDeviceFilesystem(ctx context.Context, volumeId string, device string) error {
+	s.logger.Debug("VerifyDeviceFilesystem called", zap.String("volume_id", volumeId), zap.String("device", device))
+
+	if device == "" {
+		return fmt.Errorf("device can't be empty")
+	}
+
+	metadata, err := s.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	if !metadata.FsUUID {
+		return nil
+	}
+
+	deviceUUID, err := s.getFilesystemUUID(ctx, device)
+	if err != nil {
+		return fmt.Errorf("error get device filesystem uuid: %w", err)
+	}
+
+	if expected := fsUUID(volumeId); deviceUUID != expected {
+		return &FilesystemError{
+			Device: device,
+			Err:    fmt.Errorf("uuid (%s) doesn't match uuid (%s) of volume %s", deviceUUID, expected, volumeId),
+		}
+	}
+
+	return nil
+}
+
+// verifyDeviceBackingFile returns error if loop device is backed by another file than given image
+func (s *SparseFileVolumeController) verifyDeviceBackingFile(ctx context.Context, device string, filename string) error {
+	backingFile, err := s.getDeviceBackingFile(ctx, device)
+	if err != nil {
+		return fmt.Errorf("error get device backing file: %w", err)
+	}
+
+	// kernel reports resolved path, while images dir may be given through symlink
+	expected, err := filepath.EvalSymlinks(filename)
+	if err == nil {
+		expected, err = filepath.Abs(expected)
+	}
+	if err != nil {
+		return fmt.Errorf("error resolve image path: %w", err)
+	}
+
+	if filepath.Clean(backingFile) != filepath.Clean(expected) {
+		s.logger.Error("Device is backed by another file than volume image",
+			zap.String("device", device),
+			zap.String("backing_file", backingFile),
+			zap.String("filename", expected),
+		)
+		return fmt.Errorf("device %s backing file (%s) doesn't match image %s", device, backingFile, expected)
+	}
+
+	return nil
+}
+
+// getDeviceBackingFile returns file loop device is backed by
+func (s *SparseFileVolumeController) getDeviceBackingFile(ctx context.Context, device string) (string, error) {
+	loSetupCmd := "losetup"
+
+	args := []string{
+		"--noheadings",
+		"--output", "BACK-FILE",
+		device,
+	}
+
+	out, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// FormatIfNot formats sparse file with given file system type if it's not yet
+// If volume has different filesystem type from given, it will be formatted with new given fsType
+func (s *SparseFileVolumeController) FormatIfNot(ctx context.Context, volumeId string, fsType string) error {
+	s.logger.Debug("FormatIfNot called",
+		zap.String("volume_id", volumeId),
+		zap.String("fs_type", fsType),
+	)
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	currentFs, err := s.getCurrentFilesystem(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("error get current filesystem: %w", err)
+	}
+
+	if currentFs == fsType {
+		s.logger.Debug("Sparse file already formatted with given filesystem. Skip formatting",
+			zap.String("filename", filename),
+			zap.String("fs_type", fsType),
+			zap.String("current_fs_type", currentFs),
+		)
+		return s.tuneDetachedFilesystem(ctx, volumeId, filename, currentFs)
+	}
+
+	// todo: support other filesystems, already formatted ones are accepted above
+	if fsType != "ext4" {
+		return fmt.Errorf("given filesystem type (%s) not supported", fsType)
+	}
+
+	// formatting image of attached device would corrupt live filesystem
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get device by volumeId: %w", err)
+	}
+
+	if dev != "" {
+		s.logger.Error("Refuse to format image attached to loop device",
+			zap.String("volume_id", volumeId),
+			zap.String("device", dev),
+			zap.String("fs_type", fsType),
+			zap.String("current_fs_type", currentFs),
+		)
+		return fmt.Errorf("image is attached to %s: %w", dev, ErrorVolumeInUse)
+	}
+
+	mkfsCmd := fmt.Sprintf("mkfs.%s", fsType)
+
+	if err := s.waitFormatJitter(ctx, volumeId); err != nil {
+		return err
+	}
+
+	args := make([]string, 0)
+	if s.opts.FsLabel {
+		args = append(args, "-L", fsLabel(volumeId))
+	}
+
+	if s.opts.FsUUID {
+		args = append(args, "-U", fsUUID(volumeId))
+	}
+
+	metadata, err := s.GetMetadata(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get volume metadata: %w", err)
+	}
+
+	// volume's own setting takes precedence over controller's one
+	reservedBlocksPercent := s.opts.ReservedBlocksPercent
+	if metadata.ReservedBlocksPercent != nil {
+		reservedBlocksPercent = metadata.ReservedBlocksPercent
+	}
+	if reservedBlocksPercent != nil {
+		args = append(args, "-m", strconv.Itoa(*reservedBlocksPercent))
+	}
+
+	args = append(args, filename)
+
+	if _, err := runCommand(ctx, s.logger, s.heavyCommandOptions(), mkfsCmd, args...); err != nil {
+		return err
+	}
+
+	if err := s.tuneFilesystem(ctx, filename, fsType); err != nil {
+		return err
+	}
+
+	if s.opts.LoopSectorSize != 0 || s.opts.FsUUID {
+		if s.opts.LoopSectorSize != 0 {
+			metadata.SectorSize = s.opts.LoopSectorSize
+		}
+		metadata.FsUUID = s.opts.FsUUID
+		if err := s.SaveMetadata(ctx, volumeId, metadata); err != nil {
+			return fmt.Errorf("error save volume metadata: %w", err)
+		}
+	}
+
+	s.logger.Debug("Sparse file was formatted successfully",
+		zap.String("volume_id", volumeId),
+		zap.String("filename", filename),
+		zap.String("fs_type", fsType),
+	)
+	return nil
+}
+
+// tuneDetachedFilesystem applies filesystem check settings to already formatted volume, unless it's attached,
+// because superblock of mounted filesystem must not be changed through its image
+func (s *SparseFileVolumeController) tuneDetachedFilesystem(ctx context.Context, volumeId string, filename string, fsType string) error {
+	if len(s.tune2fsArgs(fsType, filename)) == 0 {
+		return nil
+	}
+
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get device by volumeId: %w", err)
+	}
+
+	if dev != "" {
+		s.logger.Debug("Volume is attached, skip tune filesystem", zap.String("volume_id", volumeId), zap.String("device", dev))
+		return nil
+	}
+
+	return s.tuneFilesystem(ctx, filename, fsType)
+}
+
+// tuneFilesystem sets maximum mount count and interval between checks of ext filesystem with tune2fs.
+// Does nothing for other filesystems or if neither is configured
+func (s *SparseFileVolumeController) tuneFilesystem(ctx context.Context, filename string, fsType string) error {
+	args := s.tune2fsArgs(fsType, filename)
+	if len(args) == 0 {
+		return nil
+	}
+
+	tune2fsCmd := "tune2fs"
+	if _, err := runCommand(ctx, s.logger, nil, tune2fsCmd, args...); err != nil {
+		return fmt.Errorf("error tune filesystem: %w", err)
+	}
+
+	s.logger.Debug("Filesystem was tuned successfully", zap.String("filename", filename), zap.Strings("args", args))
+	return nil
+}
+
+// tune2fsArgs returns tune2fs arguments setting configured check settings of ext filesystem, nil if there is nothing to set
+func (s *SparseFileVolumeController) tune2fsArgs(fsType string, filename string) []string {
+	if !isExtFilesystem(fsType) || (s.opts.FsMaxMountCount == nil && s.opts.FsCheckIntervalDays == nil) {
+		return nil
+	}
+
+	var args []string
+	if s.opts.FsMaxMountCount != nil {
+		args = append(args, "-c", strconv.Itoa(*s.opts.FsMaxMountCount))
+	}
+	if s.opts.FsCheckIntervalDays != nil {
+		args = append(args, "-i", fmt.Sprintf("%dd", *s.opts.FsCheckIntervalDays))
+	}
+	return append(args, filename)
+}
+
+// waitFormatJitter waits random time up to format jitter, so simultaneously staged volumes aren't formatted at once
+func (s *SparseFileVolumeController) waitFormatJitter(ctx context.Context, volumeId string) error {
+	if s.opts.FormatJitter <= 0 {
+		return nil
+	}
+
+	delay := time.Duration(rand.Int63n(int64(s.opts.FormatJitter)))
+	s.logger.Debug("Wait before format", zap.String("volume_id", volumeId), zap.Duration("delay", delay))
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// GetFilesystemType returns filesystem type of volume image or empty string if volume isn't formatted
+func (s *SparseFileVolumeController) GetFilesystemType(ctx context.Context, volumeId string) (string, error) {
+	s.logger.Debug("GetFilesystemType called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return "", fmt.Errorf("volumeId can't be empty")
+	}
+
+	return s.getCurrentFilesystem(ctx, s.getImageFullPath(volumeId))
+}
+
+// getCurrentFilesystem returns current filesystem or empty string
+func (s *SparseFileVolumeController) getCurrentFilesystem(ctx context.Context, filename string) (string, error) {
+	s.logger.Debug("getCurrentFilesystem called", zap.String("filename", filename))
+
+	return s.getBlkidTag(ctx, filename, "TYPE")
+}
+
+// getFilesystemUUID returns filesystem UUID of image or device, empty string if there is no filesystem
+func (s *SparseFileVolumeController) getFilesystemUUID(ctx context.Context, filename string) (string, error) {
+	s.logger.Debug("getFilesystemUUID called", zap.String("filename", filename))
+
+	return s.getBlkidTag(ctx, filename, "UUID")
+}
+
+// getBlkidTag returns value of blkid tag of image or device or empty string if tag not found
+func (s *SparseFileVolumeController) getBlkidTag(ctx context.Context, filename string, tag string) (string, error) {
+	if filename == "" {
+		return "", fmt.Errorf("filename can't be empty")
+	}
+
+	if !s.isFileExists(filename) {
+		return "", ErrorVolumeNotFound
+	}
+
+	blkIdCmd := "blkid"
+
+	// cached result could be stale after image was recreated or reformatted, so always probe actual bytes
+	args := []string{
+		"-c",
+		"/dev/null",
+		"-o",
+		"value",
+		"-s",
+		tag,
+		filename,
+	}
+
+	// If the specified token was found, or if any tags were shown from (specified) devices, 0 is returned.
+	// If the specified token was not found, or no (specified) devices could be identified, an exit code of 2 is returned.
+	// For usage or other errors, an exit code of 4 is returned.
+	out, err := runCommand(ctx, s.logger, &commandOptions{handledExitCodes: []int{2}}, blkIdCmd, args...)
+	if err != nil {
+		if cmdErr := asCommandError(err); cmdErr != nil && cmdErr.ExitCode == 2 {
+			s.logger.Debug("Blkid returns code 2, assumed file has not tag",
+				zap.String("filename", filename),
+				zap.String("tag", tag),
+			)
+			return "", nil
+		}
+		return "", err
+	}
+
+	value := strings.TrimSpace(string(out))
+
+	s.logger.Debug("Blkid returns code 0, assumed file has tag",
+		zap.String("filename", filename),
+		zap.String("tag", tag),
+		zap.String("value", value),
+	)
+	return value, nil
+}
+
+// expandLoopDevice forces the loop driver to reread the size of the file associated with the specified loop device
+func (s *SparseFileVolumeController) expandLoopDevice(ctx context.Context, device string) error {
+	s.logger.Debug("expandLoopDevice called", zap.String("device", device))
+
+	loSetupCmd := fmt.Sprintf("losetup")
+
+	args := []string{
+		"--set-capacity",
+		device,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, loSetupCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Expanded loop device successfully", zap.String("device", device))
+	return nil
+}
+
+// truncate truncates file with given size
+func (s *SparseFileVolumeController) truncate(ctx context.Context, filename string, sizeBytes int64) error {
+	s.logger.Debug("truncate called", zap.String("filename", filename), zap.Int64("size", sizeBytes))
+
+	truncateCmd := "truncate"
+
+	args := []string{
+		"-s",
+		strconv.FormatInt(sizeBytes, 10),
+		filename,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, truncateCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Truncated file successfully",
+		zap.String("filename", filename),
+		zap.Int64("size_bytes", sizeBytes),
+	)
+	return nil
+}
+
+// punchHoles deallocates all blocks of file keeping its size
+func (s *SparseFileVolumeController) punchHoles(ctx context.Context, filename string) error {
+	s.logger.Debug("punchHoles called", zap.String("filename", filename))
+
+	info, err := os.Stat(filename)
+	if err != nil {
+		return fmt.Errorf("error stat file: %w", err)
+	}
+
+	if info.Size() == 0 {
+		return nil
+	}
+
+	fallocateCmd := "fallocate"
+
+	args := []string{
+		"--punch-hole",
+		"--offset", "0",
+		"--length", strconv.FormatInt(info.Size(), 10),
+		filename,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, fallocateCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Punched holes in file successfully", zap.String("filename", filename))
+	return nil
+}
+
+// checkFs checks and repairs filesystem of unmounted device automatically. Offline resize2fs requires it
+func (s *SparseFileVolumeController) checkFs(ctx context.Context, device string) error {
+	s.logger.Debug("checkFs called", zap.String("device", device))
+
+	return s.runE2fsck(ctx, device, "-f", "-p")
+}
+
+// runE2fsck runs e2fsck with given flags on unmounted device. Corrected errors are only logged.
+// Returns ErrorFilesystemCorrupted if errors were left uncorrected
+func (s *SparseFileVolumeController) runE2fsck(ctx context.Context, device string, flags ...string) error {
+	// todo: support other filesystems
+	e2fsckCmd := "e2fsck"
+
+	args := append(append([]string{}, flags...), device)
+
+	// exit codes 1 and 2 mean errors were corrected, 4 and greater mean errors left uncorrected
+	opts := s.heavyCommandOptions()
+	opts.handledExitCodes = []int{1, 2, 3}
+	out, err := runCommand(ctx, s.logger, opts, e2fsckCmd, args...)
+	if err != nil {
+		cmdErr := asCommandError(err)
+		if cmdErr != nil && cmdErr.ExitCode > 0 && cmdErr.ExitCode < 4 {
+			s.logger.Warn("Filesystem errors were corrected",
+				zap.String("device", device),
+				zap.ByteString("output", out),
+				zap.String("stderr", cmdErr.Stderr),
+			)
+			return nil
+		}
+
+		if cmdErr != nil && cmdErr.ExitCode&4 != 0 {
+			return &FilesystemError{Device: device, Err: cmdErr.withCause(ErrorFilesystemCorrupted)}
+		}
+		return err
+	}
+
+	s.logger.Debug("Checked device filesystem successfully", zap.String("device", device))
+	return nil
+}
+
+// RepairFileSystem checks ext filesystem of attached device before mount. Filesystem which was cleanly unmounted
+// is skipped, otherwise e2fsck preen runs and escalates to full check with fixing everything if preen gives up.
+// Mounted device and not ext filesystems are skipped
+func (s *SparseFileVolumeController) RepairFileSystem(ctx context.Context, volumeId string) error {
+	s.logger.Debug("RepairFileSystem called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get loop device: %w", err)
+	}
+
+	if dev == "" {
+		return fmt.Errorf("volume is not attached")
+	}
+
+	mounted, err := isDeviceMounted(dev)
+	if err != nil {
+		return fmt.Errorf("error check device is mounted: %w", err)
+	}
+
+	if mounted {
+		s.logger.Debug("Device is mounted, skip repair", zap.String("volume_id", volumeId), zap.String("device", dev))
+		return nil
+	}
+
+	fsType, err := s.getCurrentFilesystem(ctx, dev)
+	if err != nil {
+		return fmt.Errorf("error get current filesystem: %w", err)
+	}
+
+	if !isExtFilesystem(fsType) {
+		s.logger.Debug("Repair of filesystem is not supported, skip it",
+			zap.String("volume_id", volumeId),
+			zap.String("fs_type", fsType),
+		)
+		return nil
+	}
+
+	state, err := s.getFsState(ctx, dev)
+	if err != nil {
+		return fmt.Errorf("error get filesystem state: %w", err)
+	}
+
+	if state == "clean" {
+		s.logger.Debug("Filesystem is clean, skip repair", zap.String("volume_id", volumeId), zap.String("device", dev))
+		return nil
+	}
+
+	s.logger.Info("Filesystem wasn't cleanly unmounted, check it",
+		zap.String("volume_id", volumeId),
+		zap.String("device", dev),
+		zap.String("state", state),
+	)
+
+	err = s.runE2fsck(ctx, dev, "-p")
+	if errors.Is(err, ErrorFilesystemCorrupted) {
+		s.logger.Warn("Filesystem preen check gave up, run full check", zap.String("volume_id", volumeId), zap.String("device", dev))
+		err = s.runE2fsck(ctx, dev, "-f", "-y")
+	}
+	if err != nil {
+		return err
+	}
+
+	s.logger.Info("Filesystem was checked", zap.String("volume_id", volumeId), zap.String("device", dev))
+	return nil
+}
+
+// RepairImageFileSystem fully checks ext filesystem of volume image, which must not be attached, fixing everything
+// e2fsck can fix. Not ext filesystems are skipped
+func (s *SparseFileVolumeController) RepairImageFileSystem(ctx context.Context, volumeId string) error {
+	s.logger.Debug("RepairImageFileSystem called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	if err := s.checkDetached(ctx, volumeId); err != nil {
+		return err
+	}
+
+	fsType, err := s.getCurrentFilesystem(ctx, filename)
+	if err != nil {
+		return fmt.Errorf("error get current filesystem: %w", err)
+	}
+
+	if !isExtFilesystem(fsType) {
+		s.logger.Debug("Repair of filesystem is not supported, skip it",
+			zap.String("volume_id", volumeId),
+			zap.String("fs_type", fsType),
+		)
+		return nil
+	}
+
+	return s.runE2fsck(ctx, filename, "-f", "-y")
+}
+
+// getFsState returns "Filesystem state" of ext filesystem superblock, e.g. "clean" or "not clean"
+func (s *SparseFileVolumeController) getFsState(ctx context.Context, device string) (string, error) {
+	dumpe2fsCmd := "dumpe2fs"
+
+	args := []string{
+		"-h",
+		device,
+	}
+
+	out, err := runCommand(ctx, s.logger, nil, dumpe2fsCmd, args...)
+	if err != nil {
+		return "", err
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Filesystem state:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Filesystem state:")), nil
+		}
+	}
+
+	return "", fmt.Errorf("filesystem state not found in %s output", dumpe2fsCmd)
+}
+
+// CheckFileSystem checks ext filesystem of attached device with e2fsck without fixing anything,
+// so it's safe for mounted filesystem. Returns error if check found problems
+func (s *SparseFileVolumeController) CheckFileSystem(ctx context.Context, volumeId string) error {
+	s.logger.Debug("CheckFileSystem called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return fmt.Errorf("volumeId can't be empty")
+	}
+
+	dev, err := s.GetDeviceByVolumeId(ctx, volumeId)
+	if err != nil {
+		return fmt.Errorf("error get loop device: %w", err)
+	}
+
+	if dev == "" {
+		return fmt.Errorf("volume is not attached")
+	}
+
+	fsType, err := s.getCurrentFilesystem(ctx, dev)
+	if err != nil {
+		return fmt.Errorf("error get current filesystem: %w", err)
+	}
+
+	if !isExtFilesystem(fsType) {
+		return fmt.Errorf("check of %q filesystem is not supported", fsType)
+	}
+
+	e2fsckCmd := "e2fsck"
+
+	args := []string{
+		"-n",
+		dev,
+	}
+
+	if _, err := runCommand(ctx, s.logger, nil, e2fsckCmd, args...); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Device filesystem is clean", zap.String("volume_id", volumeId), zap.String("device", dev))
+	return nil
+}
+
+// resizeFs resizes filesystem to the given size or to the whole device if size is 0.
+// Returns errFsNeedsCheck if filesystem must be checked first
+func (s *SparseFileVolumeController) resizeFs(ctx context.Context, filename string, sizeBytes int64) error {
+	s.logger.Debug("resizeFs called", zap.String("filename", filename), zap.Int64("size_bytes", sizeBytes))
+
+	if !s.isFileExists(filename) {
+		return ErrorVolumeNotFound
+	}
+
+	// todo: support other filesystems
+	resize2fsCmd := "resize2fs"
+
+	args := []string{
+		filename,
+	}
+
+	// resize2fs takes size in filesystem blocks without unit, so KiB are passed to not depend on block size
+	if sizeBytes > 0 {
+		args = append(args, fmt.Sprintf("%dK", sizeBytes/1024))
+	}
+
+	if _, err := runCommand(ctx, s.logger, s.heavyCommandOptions(), resize2fsCmd, args...); err != nil {
+		if cmdErr := asCommandError(err); cmdErr != nil && strings.Contains(cmdErr.Stdout+cmdErr.Stderr, "Please run 'e2fsck -f") {
+			return &FilesystemError{Device: filename, Err: cmdErr.withCause(errFsNeedsCheck)}
+		}
+		return err
+	}
+
+	s.logger.Debug("Resized sparse file filesystem successfully", zap.String("filename", filename))
+	return nil
+}
+
+// isExtFilesystem returns true if filesystem is one of ext family
+func isExtFilesystem(fsType string) bool {
+	return fsType == "ext2" || fsType == "ext3" || fsType == "ext4"
+}
+
+// heavyCommandOptions returns run options wrapping cpu and disk heavy command with nice and ionice according to controller settings
+func (s *SparseFileVolumeController) heavyCommandOptions() *commandOptions {
+	var wrapper []string
+
+	if s.opts.HeavyCommandsIoniceClass != 0 {
+		wrapper = append([]string{"ionice", "-c", strconv.Itoa(s.opts.HeavyCommandsIoniceClass)}, wrapper...)
+	}
+
+	if s.opts.HeavyCommandsNice != 0 {
+		wrapper = append([]string{"nice", "-n", strconv.Itoa(s.opts.HeavyCommandsNice)}, wrapper...)
+	}
+
+	return &commandOptions{wrapper: wrapper}
+}
+
+// ListVolumeIds returns ids of all volume images in images dirs of all pools sorted by name
+func (s *SparseFileVolumeController) ListVolumeIds(_ context.Context) ([]string, error) {
+	s.logger.Debug("ListVolumeIds called")
+
+	volumeIds := make([]string, 0)
+	for _, dir := range s.getPoolDirs() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, fmt.Errorf("error read images dir: %w", err)
+		}
+
+		for _, entry := range entries {
+			if !entry.Type().IsRegular() {
+				continue
+			}
+
+			if volumeId, ok := s.parseImageFileName(entry.Name()); ok {
+				volumeIds = append(volumeIds, volumeId)
+			}
+		}
+	}
+
+	sort.Strings(volumeIds)
+	return volumeIds, nil
+}
+
+// GetVolumeDiskUsage returns apparent size and size of actually allocated data of volume sparse file. Allocated size
+// is sum of data extents, or size of allocated blocks if filesystem can't seek data. Preallocated extents are seen as
+// holes until written, so with preallocation size of allocated blocks is returned too
+func (s *SparseFileVolumeController) GetVolumeDiskUsage(ctx context.Context, volumeId string) (int64, int64, error) {
+	s.logger.Debug("GetVolumeDiskUsage called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return 0, 0, fmt.Errorf("volumeId can't be empty")
+	}
+
+	filename := s.getImageFullPath(volumeId)
+	info, err := os.Stat(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, 0, ErrorVolumeNotFound
+		}
+		return 0, 0, fmt.Errorf("error stat image: %w", err)
+	}
+
+	var allocated int64
+	useBlocks := s.opts.Preallocate
+	if !useBlocks {
+		allocated, err = dataExtentsSize(ctx, filename)
+		useBlocks = errors.Is(err, errorSeekDataUnsupported)
+	}
+	if useBlocks {
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			return 0, 0, fmt.Errorf("unsupported stat type %T", info.Sys())
+		}
+
+		// st_blocks is always counted in 512 bytes units
+		allocated, err = multiplyClamped(uint64(stat.Blocks), 512), nil
+	}
+	if err != nil {
+		// image could be deleted since stat
+		if os.IsNotExist(err) {
+			return 0, 0, ErrorVolumeNotFound
+		}
+		return 0, 0, fmt.Errorf("error get image data size: %w", err)
+	}
+
+	s.logger.Debug("Finish calculate volume disk usage",
+		zap.String("volume_id", volumeId),
+		zap.Int64("apparent_bytes", info.Size()),
+		zap.Int64("allocated_bytes", allocated),
+	)
+	return info.Size(), allocated, nil
+}
+
+// GetVolumePoolUsage returns sum of apparent sizes of images in images dir of volume's pool and total size of
+// its filesystem. Images of other pools sharing the filesystem aren't counted
+func (s *SparseFileVolumeController) GetVolumePoolUsage(_ context.Context, volumeId string) (int64, int64, error) {
+	s.logger.Debug("GetVolumePoolUsage called", zap.String("volume_id", volumeId))
+
+	if volumeId == "" {
+		return 0, 0, fmt.Errorf("volumeId can't be empty")
+	}
+
+	dir := s.getVolumeDir(volumeId)
+	if !s.isFileExists(s.getImageFullPath(volumeId)) {
+		return 0, 0, ErrorVolumeNotFound
+	}
+
+	fs := syscall.Statfs_t{}
+	if err := syscall.Statfs(dir, &fs); err != nil {
+		return 0, 0, fmt.Errorf("error get storage capacity stats: %w", err)
+	}
+	total := multiplyClamped(uint64(fs.Blocks), uint64(fs.Bsize))
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error read images dir: %w", err)
+	}
+
+	provisioned := int64(0)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		if _, ok := s.parseImageFileName(entry.Name()); !ok {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			// image could be deleted since listing
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, 0, fmt.Errorf("error stat image: %w", err)
+		}
+		provisioned += info.Size()
+	}
+
+	s.logger.Debug("Finish calculate volume pool usage",
+		zap.String("volume_id", volumeId),
+		zap.String("storage_path", dir),
+		zap.Int64("provisioned_bytes", provisioned),
+		zap.Int64("total_bytes", total),
+	)
+	return provisioned, total, nil
+}
+
+// getImageFullPath returns volume's image storage absolute path
+func (s *SparseFileVolumeController) getImageFullPath(volumeId string) string {
+	return fmt.Sprintf("%s/%s", strings.TrimSuffix(s.getVolumeDir(volumeId), "/"), s.getImageFileName(volumeId))
+}
+
+// getImageFileName returns volume's image file name: <prefix><volumeId>.<extension>
+func (s *SparseFileVolumeController) getImageFileName(volumeId string) string {
+	return fmt.Sprintf("%s%s%s", s.opts.ImagePrefix, volumeId, s.getImageExtension())
+}
+
+// parseImageFileName returns volume id of image file name. Returns false if name doesn't match naming scheme
+func (s *SparseFileVolumeController) parseImageFileName(name string) (string, bool) {
+	extension := s.getImageExtension()
+	if !strings.HasPrefix(name, s.opts.ImagePrefix) || !strings.HasSuffix(name, extension) {
+		return "", false
+	}
+
+	volumeId := strings.TrimSuffix(strings.TrimPrefix(name, s.opts.ImagePrefix), extension)
+	if volumeId == "" {
+		return "", false
+	}
+	return volumeId, true
+}
+
+// getImageExtension returns configured image extension with leading dot
+func (s *SparseFileVolumeController) getImageExtension() string {
+	if s.opts.ImageExtension == "" {
+		return "." + defaultImageExtension
+	}
+	return "." + s.opts.ImageExtension
+}
+
+// isFileExists returns true if file exists
+func (s *SparseFileVolumeController) isFileExists(filename string) bool {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return false
+	}
+
+	return !info.IsDir()
+}
+
+// onOff returns losetup boolean option value
+func onOff(enabled bool) string {
+	if enabled {
+		return "on"
+	}
+	return "off"
+}
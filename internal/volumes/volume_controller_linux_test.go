@@ -0,0 +1,298 @@
+//go:build linux
+
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"go.uber.org/zap"
+	"os"
+	"os/exec"
+	"reflect"
+	"regexp"
+	"strconv"
+	"testing"
+)
+
+// newTestSparseFileVolumeController returns controller over temp images dir. Test is skipped unless given commands
+// are installed, since they are real. Loop devices are attached by root only
+func newTestSparseFileVolumeController(t *testing.T, opts SparseFileVolumeControllerOptions, commands ...string) *SparseFileVolumeController {
+	t.Helper()
+
+	for _, command := range append([]string{"blkid"}, commands...) {
+		if command == "losetup" && os.Geteuid() != 0 {
+			t.Skip("test requires root to attach loop devices")
+		}
+
+		if _, err := exec.LookPath(command); err != nil {
+			t.Skipf("test requires %s", command)
+		}
+	}
+
+	return NewLinuxSparseFileVolumeController(t.TempDir(), opts, zap.NewNop())
+}
+
+// detachOnCleanup detaches loop devices of volume after test, so failed test doesn't leak them
+func detachOnCleanup(t *testing.T, s *SparseFileVolumeController, volumeId string) {
+	t.Cleanup(func() {
+		_ = s.DetachDevice(context.Background(), volumeId)
+	})
+}
+
+func TestFormatIfNotAttachedImage(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSparseFileVolumeController(t, SparseFileVolumeControllerOptions{}, "losetup", "mkfs.ext4")
+
+	if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	detachOnCleanup(t, s, "vol1")
+
+	// device left attached by stale stage attempt
+	if _, err := s.AttachDevice(ctx, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.FormatIfNot(ctx, "vol1", "ext4"); !errors.Is(err, ErrorVolumeInUse) {
+		t.Fatalf("FormatIfNot() error = %v, want %v", err, ErrorVolumeInUse)
+	}
+
+	fsType, err := s.getCurrentFilesystem(ctx, s.getImageFullPath("vol1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsType != "" {
+		t.Errorf("attached image was formatted with %s", fsType)
+	}
+}
+
+func TestDetachDeviceTwice(t *testing.T) {
+	tests := []struct {
+		name         string
+		detachSingle bool
+	}{
+		{name: "detach all"},
+		{name: "detach single", detachSingle: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestSparseFileVolumeController(t, SparseFileVolumeControllerOptions{DetachSingle: tt.detachSingle}, "losetup")
+
+			if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+				t.Fatal(err)
+			}
+			detachOnCleanup(t, s, "vol1")
+
+			if _, err := s.AttachDevice(ctx, "vol1"); err != nil {
+				t.Fatal(err)
+			}
+
+			// retried unstage detaches already detached volume
+			for i := 0; i < 2; i++ {
+				if err := s.DetachDevice(ctx, "vol1"); err != nil {
+					t.Fatalf("DetachDevice() call %d error = %v", i+1, err)
+				}
+			}
+
+			dev, err := s.GetDeviceByVolumeId(ctx, "vol1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dev != "" {
+				t.Errorf("volume is still attached to %s", dev)
+			}
+		})
+	}
+}
+
+func TestGetFilesystemTypeOfRecreatedVolume(t *testing.T) {
+	ctx := context.Background()
+	s := newTestSparseFileVolumeController(t, SparseFileVolumeControllerOptions{}, "mkfs.ext4")
+
+	if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+		t.Fatal(err)
+	}
+
+	fsType, err := s.GetFilesystemType(ctx, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsType != "ext4" {
+		t.Fatalf("GetFilesystemType() = %q after format, want ext4", fsType)
+	}
+
+	if err := s.Delete(ctx, "vol1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	// blkid cache still has filesystem of deleted image of the same path
+	fsType, err = s.GetFilesystemType(ctx, "vol1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsType != "" {
+		t.Errorf("GetFilesystemType() = %q for recreated volume, want unformatted", fsType)
+	}
+}
+
+// superblockValue returns numeric field of ext filesystem superblock of image listed by tune2fs
+func superblockValue(t *testing.T, filename string, field string) int64 {
+	t.Helper()
+
+	out, err := exec.Command("tune2fs", "-l", filename).Output()
+	if err != nil {
+		t.Fatalf("tune2fs -l error = %v", err)
+	}
+
+	match := regexp.MustCompile(`(?m)^` + regexp.QuoteMeta(field) + `:\s+(-?\d+)`).FindSubmatch(out)
+	if match == nil {
+		t.Fatalf("tune2fs -l output has no %q", field)
+	}
+
+	value, err := strconv.ParseInt(string(match[1]), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
+
+func TestFormatIfNotReservedBlocks(t *testing.T) {
+	one, five := 1, 5
+
+	tests := []struct {
+		name string
+		// controller controller's reserved blocks percent
+		controller *int
+		// volume volume's own reserved blocks percent
+		volume      *int
+		wantPercent int64
+	}{
+		{name: "mkfs default", wantPercent: 5},
+		{name: "controller setting", controller: new(int), wantPercent: 0},
+		{name: "volume setting", volume: &one, wantPercent: 1},
+		{name: "volume over controller setting", controller: &five, volume: new(int), wantPercent: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestSparseFileVolumeController(t, SparseFileVolumeControllerOptions{ReservedBlocksPercent: tt.controller}, "mkfs.ext4", "tune2fs")
+
+			if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.SaveMetadata(ctx, "vol1", &VolumeMetadata{ReservedBlocksPercent: tt.volume}); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+				t.Fatal(err)
+			}
+
+			filename := s.getImageFullPath("vol1")
+			blocks := superblockValue(t, filename, "Block count")
+			reserved := superblockValue(t, filename, "Reserved block count")
+			if percent := (reserved*100 + blocks/2) / blocks; percent != tt.wantPercent {
+				t.Errorf("reserved blocks = %d of %d (%d%%), want %d%%", reserved, blocks, percent, tt.wantPercent)
+			}
+		})
+	}
+}
+
+func TestTune2fsArgs(t *testing.T) {
+	zero, twenty, thirty := 0, 20, 30
+
+	tests := []struct {
+		name          string
+		maxMountCount *int
+		intervalDays  *int
+		fsType        string
+		want          []string
+	}{
+		{name: "not configured", fsType: "ext4", want: nil},
+		{name: "checks disabled", maxMountCount: &zero, intervalDays: &zero, fsType: "ext4", want: []string{"-c", "0", "-i", "0d", "image"}},
+		{name: "mount count only", maxMountCount: &twenty, fsType: "ext4", want: []string{"-c", "20", "image"}},
+		{name: "interval only", intervalDays: &thirty, fsType: "ext4", want: []string{"-i", "30d", "image"}},
+		{name: "ext3", maxMountCount: &zero, intervalDays: &zero, fsType: "ext3", want: []string{"-c", "0", "-i", "0d", "image"}},
+		{name: "ext2", maxMountCount: &zero, fsType: "ext2", want: []string{"-c", "0", "image"}},
+		{name: "xfs", maxMountCount: &zero, intervalDays: &zero, fsType: "xfs", want: nil},
+		{name: "unformatted", maxMountCount: &zero, intervalDays: &zero, fsType: "", want: nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &SparseFileVolumeController{opts: SparseFileVolumeControllerOptions{
+				FsMaxMountCount:     tt.maxMountCount,
+				FsCheckIntervalDays: tt.intervalDays,
+			}}
+
+			if got := s.tune2fsArgs(tt.fsType, "image"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("tune2fsArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatIfNotFilesystemChecks(t *testing.T) {
+	zero, twenty := 0, 20
+
+	tests := []struct {
+		name          string
+		maxMountCount *int
+		intervalDays  *int
+		// wantMaxMountCount tune2fs reports -1 for disabled mount count check
+		wantMaxMountCount int64
+		wantInterval      int64
+	}{
+		{name: "checks disabled", maxMountCount: &zero, intervalDays: &zero, wantMaxMountCount: -1, wantInterval: 0},
+		{name: "checks set", maxMountCount: &twenty, intervalDays: &twenty, wantMaxMountCount: 20, wantInterval: 20 * 24 * 60 * 60},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newTestSparseFileVolumeController(t, SparseFileVolumeControllerOptions{
+				FsMaxMountCount:     tt.maxMountCount,
+				FsCheckIntervalDays: tt.intervalDays,
+			}, "mkfs.ext4", "tune2fs")
+
+			if _, err := s.Create(ctx, "vol1", "", 64<<20); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.FormatIfNot(ctx, "vol1", "ext4"); err != nil {
+				t.Fatal(err)
+			}
+
+			filename := s.getImageFullPath("vol1")
+			if got := superblockValue(t, filename, "Maximum mount count"); got != tt.wantMaxMountCount {
+				t.Errorf("maximum mount count = %d, want %d", got, tt.wantMaxMountCount)
+			}
+			if got := superblockValue(t, filename, "Check interval"); got != tt.wantInterval {
+				t.Errorf("check interval = %d, want %d", got, tt.wantInterval)
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2023 Aleksandr Ovsiankin
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package volumes
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+const (
+	// defaultImageExtension volume sparse file extension used when extension is not configured
+	defaultImageExtension = "img"
+	// MaxReservedBlocksPercent maximum percentage of filesystem blocks reserved for root accepted by mke2fs
+	MaxReservedBlocksPercent = 50
+)
+
+var (
+	ErrorVolumeNotFound       = errors.New("volume not found")
+	ErrorVolumeAlreadyExists  = errors.New("volume already exists")
+	ErrorVolumeInUse          = errors.New("volume is in use")
+	ErrorNoFreeLoopDevice     = errors.New("no free loop device, raise loop module max_loop parameter or CONFIG_BLK_DEV_LOOP_MIN_COUNT")
+	ErrorInsufficientCapacity = errors.New("insufficient storage capacity")
+	ErrorFilesystemCorrupted  = errors.New("filesystem errors left uncorrected")
+	ErrorPoolNotFound         = errors.New("storage pool not found")
+	ErrorTemplateNotFound     = errors.New("volume template not found")
+	ErrorTemplateTooLarge     = errors.New("volume template is larger than requested size")
+	ErrorTemplateFsMismatch   = errors.New("volume template filesystem differs from requested one")
+	ErrorDeviceBusy           = errors.New("device is busy, it's still open by some process")
+)
+
+// VolumeController is responsible for low level local volumes operations
+// Implementations MUST ensure idempotence of all functions
+type VolumeController interface {
+	// Create creates new volume with the given size in the given storage pool, default pool if empty. Returns true if
+	// image was created by this call. Existing volume of the same size is kept, ErrorVolumeAlreadyExists is returned if its size differs
+	Create(ctx context.Context, volumeId string, pool string, sizeBytes int64) (bool, error)
+	// CreateFromTemplate creates new volume as a copy of template image with given filesystem expanded to the given size,
+	// existing volume is checked and reported like in Create
+	CreateFromTemplate(ctx context.Context, volumeId string, pool string, template string, fsType string, sizeBytes int64) (bool, error)
+	// Delete deletes volume by id
+	Delete(ctx context.Context, volumeId string) error
+	// GetVolumeStats returns volume capacity statistics
+	GetVolumeStats(_ context.Context, path string) (*VolumeStatistics, error)
+	// GetCapacity returns available space of the given storage pool, default pool if empty
+	GetCapacity(ctx context.Context, pool string) (bytes int64, err error)
+	// GetVolumeSize returns size of volume by id
+	GetVolumeSize(ctx context.Context, volumeId string) (bytes int64, err error)
+	// ExpandVolumeSize satisfy requested size of volume. Do nothing if newSize <= currentSize
+	ExpandVolumeSize(ctx context.Context, volumeId string, newSizeBytes int64) error
+	// ResizeDeviceFileSystem resize filesystem of attached to given volume to the given size, to the whole device if 0.
+	// Device is resolved by caller, e.g. from volume mount, or looked up by volume id if empty
+	ResizeDeviceFileSystem(ctx context.Context, volumeId string, device string, sizeBytes int64) error
+	// GetFilesystemType returns filesystem type of volume or empty string if volume isn't formatted
+	GetFilesystemType(ctx context.Context, volumeId string) (string, error)
+	// CheckFileSystem checks filesystem of attached device of given volume without changing it
+	CheckFileSystem(ctx context.Context, volumeId string) error
+	// RepairFileSystem checks and repairs filesystem of attached unmounted device of given volume, unless it's clean
+	RepairFileSystem(ctx context.Context, volumeId string) error
+	// RepairImageFileSystem fully checks and repairs filesystem of detached volume image
+	RepairImageFileSystem(ctx context.Context, volumeId string) error
+	// TrimFileSystem discards unused blocks of filesystem mounted to target, returning them to storage
+	TrimFileSystem(ctx context.Context, target string) error
+	// SparsifyImage rewrites image of detached volume, so its zeroed blocks don't take storage space
+	SparsifyImage(ctx context.Context, volumeId string, compress bool) error
+	// AttachDevice attaches volume to device and returns device name
+	AttachDevice(ctx context.Context, volumeId string) (string, error)
+	// DetachDevice detaches volume from loop device
+	DetachDevice(ctx context.Context, volumeId string) error
+	// GetDeviceByVolumeId returns device path attached to given volume
+	GetDeviceByVolumeId(ctx context.Context, volumeId string) (string, error)
+	// FormatIfNot formats volume by id when it isn't already has given filesystem
+	// If volume has different filesystem type from given, it will have to format with given
+	FormatIfNot(ctx context.Context, volumeId string, fsType string) error
+	// VerifyDeviceFilesystem returns FilesystemError if attached device has filesystem of another volume
+	VerifyDeviceFilesystem(ctx context.Context, volumeId string, device string) error
+	// SetDirectIO switches direct-io mode of already attached device
+	SetDirectIO(ctx context.Context, device string, enabled bool) error
+	// SetAutoclear makes attached device detached automatically when it's not used anymore
+	SetAutoclear(ctx context.Context, device string) error
+	// ApplyIOLimits sets io limits of attached device. Nil limits removes them
+	ApplyIOLimits(ctx context.Context, device string, limits *IOLimits) error
+	// TuneDevice sets read-ahead and io scheduler of attached device, controller's defaults are used for unset settings
+	TuneDevice(ctx context.Context, device string, tuning *DeviceTuning) error
+	// SaveMetadata persists per volume options
+	SaveMetadata(ctx context.Context, volumeId string, metadata *VolumeMetadata) error
+	// GetMetadata returns persisted per volume options
+	GetMetadata(ctx context.Context, volumeId string) (*VolumeMetadata, error)
+	// GetDeviceIOStats returns cumulative io statistics of attached device
+	GetDeviceIOStats(ctx context.Context, device string) (*DeviceIOStats, error)
+	// GetAttachedDevices returns devices of all attached volumes by volume id
+	GetAttachedDevices(ctx context.Context) (map[string]string, error)
+	// GetOrphanedDevices returns loop devices still bound to deleted volume images, with former image path by device
+	GetOrphanedDevices(ctx context.Context) (map[string]string, error)
+	// DetachOrphanedDevice detaches loop device bound to deleted volume image
+	DetachOrphanedDevice(ctx context.Context, device string) error
+	// GetLoopDevicesUsage returns count of loop devices in use and their limit
+	GetLoopDevicesUsage(ctx context.Context) (*LoopDevicesUsage, error)
+	// ListVolumeIds returns ids of all volumes
+	ListVolumeIds(ctx context.Context) ([]string, error)
+	// GetVolumeDiskUsage returns apparent (logical) and actually allocated size of volume image
+	GetVolumeDiskUsage(ctx context.Context, volumeId string) (apparent int64, allocated int64, err error)
+	// GetVolumePoolUsage returns sum of logical sizes of all volumes in the pool of given volume and total size of pool storage
+	GetVolumePoolUsage(ctx context.Context, volumeId string) (provisioned int64, total int64, err error)
+	// GetImagePath returns volume image path
+	GetImagePath(ctx context.Context, volumeId string) (string, error)
+	// GetVolumeModTime returns last modification time of volume image
+	GetVolumeModTime(ctx context.Context, volumeId string) (time.Time, error)
+	// CreateNameLink creates human-friendly symlink with given name to volume image
+	CreateNameLink(ctx context.Context, volumeId string, name string) error
+	// ApplyOwnership changes owner of files under mounted volume path
+	ApplyOwnership(ctx context.Context, path string, ownership *Ownership) error
+	// ExportVolume exports volume image read-only over nbd
+	ExportVolume(ctx context.Context, volumeId string) (*NbdExport, error)
+	// UnexportVolume stops nbd export of volume
+	UnexportVolume(ctx context.Context, volumeId string) error
+}
+
+// VolumeStatistics volume capacity statistics
+type VolumeStatistics struct {
+	// AvailableBytes .
+	AvailableBytes int64
+	// UsedBytes .
+	UsedBytes int64
+	// TotalBytes .
+	TotalBytes int64
+	// AvailableInodes .
+	AvailableInodes int64
+	// UserInodes .
+	UsedInodes int64
+	// TotalInodes .
+	TotalInodes int64
+}
+
+// DeviceIOStats cumulative io statistics of block device since it was attached
+type DeviceIOStats struct {
+	// ReadIOs completed read requests
+	ReadIOs uint64
+	// ReadBytes read bytes
+	ReadBytes uint64
+	// WriteIOs completed write requests
+	WriteIOs uint64
+	// WriteBytes written bytes
+	WriteBytes uint64
+	// InFlight requests currently in flight
+	InFlight uint64
+}
+
+// LoopDevicesUsage loop devices of the node
+type LoopDevicesUsage struct {
+	// InUse loop devices bound to any file
+	InUse int
+	// Volumes loop devices bound to volume images
+	Volumes int
+	// Total maximum count of loop devices, unknown if 0
+	Total int
+}
+
+// Mounter is responsible for low level local mount operations
+// Implementations MUST ensure idempotence of all functions
+type Mounter interface {
+	// Mount mounts source to target with given options
+	Mount(ctx context.Context, source string, target string, options []string) error
+	// Unmount unmounts target
+	Unmount(ctx context.Context, target string) error
+	// UnmountLazy detaches target from mount tree immediately, filesystem is released once it's not busy
+	UnmountLazy(ctx context.Context, target string) error
+	// IsMounted returns true if target is already mounted
+	IsMounted(ctx context.Context, target string) (bool, error)
+	// GetMountSource returns source device of mounted target or empty string if target isn't mounted
+	GetMountSource(ctx context.Context, target string) (string, error)
+	// GetMountOptions returns options of mounted target or nil if target isn't mounted
+	GetMountOptions(ctx context.Context, target string) ([]string, error)
+	// GetMountFsType returns filesystem type of mounted target or empty string if target isn't mounted
+	GetMountFsType(ctx context.Context, target string) (string, error)
+	// GetMountRefs returns all mount points backed by given device, including bind mounts
+	GetMountRefs(ctx context.Context, device string) ([]string, error)
+	// GetMountPropagation returns propagation flags (shared, slave, private, unbindable) of mount holding given path
+	GetMountPropagation(ctx context.Context, path string) ([]string, error)
+	// IsFilesystemReadOnly returns true if filesystem mounted to target is read-only itself, e.g. after io errors
+	IsFilesystemReadOnly(ctx context.Context, target string) (bool, error)
+	// Remount changes mount options of mounted target
+	Remount(ctx context.Context, target string, options []string) error
+}
+
+// hasOption returns true if mount options contain given one
+func hasOption(options []string, option string) bool {
+	for _, o := range options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}